@@ -10,11 +10,13 @@ import (
   "math/big"
   "net/http"
   "strconv"
+  "strings"
   "time"
 )
 
 func init() {
   http.HandleFunc("/ballot",fillBallot)
+  http.HandleFunc("/review_ballot", reviewBallot)
   http.HandleFunc("/cast_ballot", castBallot)
 }
 
@@ -23,11 +25,24 @@ type Ballot struct {
   // User.ID of the user that created this Ballot.
   User_id string
 
+  // User.Email of the user that created this Ballot, so that it can be
+  // matched up against Election.Emails.
+  Email string
+
   // Ordering[i] = j means that this Ballot places candidate i in rank j
   // when ranking the candidates.  Two candidates can have the same rank,
   // which is ok.  A rank <= 0 indicates that the candidate is tied for last.
   Ordering []int
 
+  // Scores[i] is the score this Ballot gives candidate i, for the kinds of
+  // ballot that use scores instead of an Ordering.  Approval ballots give
+  // a score of 1 to every candidate that the voter approves of.
+  Scores []int
+
+  // Index of the Question this Ballot answers, 0 for the Election's own
+  // question.  A voter casts a Ballot for every question at once.
+  Question int
+
   // The time.UnixNano() at which this Ballot was filled out.
   Time time.Time
 
@@ -38,101 +53,146 @@ type Ballot struct {
   Election_key *datastore.Key
 }
 
+// Returns who cast b, for telling voters apart: their email address in lower
+// case, or their user ID if b was cast before Ballot had an Email.
+func (b *Ballot) voter() string {
+  if b.Email == "" {
+    return b.User_id
+  }
+  return strings.ToLower(b.Email)
+}
+
 var ballotTemplate = template.Must(template.New("ballot").Parse(ballotTemplateHTML))
 
+// The part of the ballot that depends on the Ballot_type of the election is
+// filled in by the ballotKind, see ballotkinds.go.
 const ballotTemplateHTML = `
   <body>
-    {{ $data := .}}
-    <form action="/cast_ballot" method="post">
+    <form action="/review_ballot" method="post">
     <input type="hidden" name="key" value="{{.Key_str}}"/>
     Election: {{.Title}}<br>
-    <table>
-    <tr><td>Candidate</td><td colspan=10 align="center"><-Higher - Rank - Lower -></td></td>
-    {{range $index,$element := .Candidates}}
-      <tr>
-        <td>{{.Name}}</td>
-        <td><img src="/serve/image.jpg?blobKey={{.Image}}"></img></td>
-        {{range $rank_index,$rank := $data.Candidates}}
-          <td><input type="radio" name="rank_{{$index}}" value="{{$rank_index}}" {{if index $data.Ranks $index $rank_index}}checked{{end}} /></td>
-        {{end}}
-      </tr>
-    {{end}}
-    </table>
-    <div><input type="submit" value="Cast Ballot"></div>
+    {{.Fields}}
+    <div><input type="submit" value="Review Ballot"></div>
     </form>
+    {{if .Allow_delegation}}
+      <form action="/delegate" method="post">
+        <input type="hidden" name="key" value="{{.Key_str}}"/>
+        {{if .Delegate}}You are currently delegating your vote to {{.Delegate}}.<br/>{{end}}
+        Instead of filling out a ballot, you can delegate your vote to
+        another voter: <input type="text" name="delegate" value="{{.Delegate}}"/>
+        <input type="submit" value="Delegate"/>
+      </form>
+    {{end}}
+    <a href="/my_ballots?key={{.Key_str}}">Ballots you have already cast</a>
   </body>
 `
 
 type electionWithCandidates struct {
   Election
   Candidates []Candidate
-  Ranks      map[int]map[int]bool
+
+  // The fields of the ballot, which depend on the kind of ballot.
+  Fields template.HTML
+
+  // Who the voter has delegated their vote to, if their latest delegation is
+  // newer than their latest ballot.
+  Delegate string
 }
 
-func fillBallot(w http.ResponseWriter, r *http.Request) {
-  htmlWrapBegin(w)
-  defer htmlWrapEnd(w)
-  c, u, logged_in := promptLogin(w, r)
-  if !logged_in {
-    return
-  }
+// Loads the Election specified by the key in the request, along with its
+// Candidates, making sure that u is allowed to vote in it right now.
+func getVotableElection(w http.ResponseWriter, r *http.Request, c appengine.Context, u *user.User) (*datastore.Key, *Election, []Candidate, bool) {
   key, err := datastore.DecodeKey(r.FormValue("key"))
   if err != nil {
     http.Error(w, err.Error(), http.StatusInternalServerError)
-    return
+    return nil, nil, nil, false
   }
   var e Election
   err = datastore.Get(c, key, &e)
   if err != nil {
     http.Error(w, err.Error(), http.StatusInternalServerError)
-    return
+    return nil, nil, nil, false
   }
 
-  if !e.IsUserAllowedToVote(u) {
-    http.Error(w, "You have not been listed as a participant in this election.", http.StatusInternalServerError)
-    return
+  _, ok := checkElectionAccess(w, c, key, &e, u, permVote)
+  if !ok {
+    return nil, nil, nil, false
   }
 
   now := time.Now().UnixNano()
 
   if now < e.Start.UnixNano() {
     http.Error(w, "Voting for this election has not begun yet.", http.StatusInternalServerError)
-    return
+    return nil, nil, nil, false
   }
 
   if e.End.UnixNano() < now {
     http.Error(w, "Voting for this election has closed.", http.StatusInternalServerError)
-    return
+    return nil, nil, nil, false
   }
 
-
   cands, err := e.GetCandidates(c)
   if err != nil {
     http.Error(w, err.Error(), http.StatusInternalServerError)
-    return
+    return nil, nil, nil, false
   }
+  return key, &e, cands, true
+}
 
-  // Find the last ballot that this user cast on this election so that we can
-  // fill out the fields the way they were filled out last time.
-  query := datastore.NewQuery("Ballot").
-      Ancestor(key).
-      Filter("User_id =", u.ID).
-      Order("-Time").
-      Limit(1)
-  it := query.Run(c)
-  var b Ballot
-  ranks := make(map[int]map[int]bool)
-  for i := range cands {
-    ranks[i] = make(map[int]bool)
+func fillBallot(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  key, e, cands, ok := getVotableElection(w, r, c, u)
+  if !ok {
+    return
+  }
+  questions, err := getQuestions(c, key, e, cands)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
   }
-  _, err = it.Next(&b)
-  if err == nil {
-    for i,v := range b.Ordering {
-      ranks[i][v] = true
+
+  // If the voter came back from reviewing their ballot to change it then we
+  // fill out the fields the way they had them, otherwise we find the last
+  // ballot that this user cast for each question on this election so that we
+  // can fill out the fields the way they were filled out last time.  With
+  // secret ballots the form always starts out blank, so that nobody can look
+  // back at how they voted.
+  prev := make(map[int]*Ballot)
+  parsed, err := parseBallots(r, questions)
+  if r.FormValue("changing") != "" && err == nil {
+    for _, b := range parsed {
+      prev[b.Question] = b
     }
+  } else if !e.Secret_ballots {
+    query := datastore.NewQuery("Ballot").
+        Ancestor(key).
+        Filter("User_id =", u.ID).
+        Order("-Time").
+        Limit(len(questions))
+    var ballots []Ballot
+    query.GetAll(c, &ballots)
+    for i := range ballots {
+      if prev[ballots[i].Question] == nil {
+        prev[ballots[i].Question] = &ballots[i]
+      }
+    }
+  }
+  fields, err := questionFields(questions, prev)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
   }
 
-  ballotTemplate.Execute(w, electionWithCandidates{Election: e, Candidates: cands, Ranks: ranks})
+  data := electionWithCandidates{Election: *e, Candidates: cands, Fields: fields}
+  if e.Allow_delegation {
+    data.Delegate = currentDelegate(c, key, u.ID)
+  }
+  ballotTemplate.Execute(w, data)
 }
 
 func randN(n int64) (int64, error) {
@@ -140,83 +200,307 @@ func randN(n int64) (int64, error) {
   return r.Int64(), err
 }
 
-func castBallot(w http.ResponseWriter, r *http.Request) {
-  c := appengine.NewContext(r)
-  u := user.Current(c)
-  if u == nil {
-    url, err := user.LoginURL(c, r.URL.String())
+// Reads the rank of each candidate from the rank_<i> fields of the request.
+// A candidate that is left blank is unranked, which is stored as -1.  Ties
+// are allowed, but the ranks are renumbered so that there are no gaps, so a
+// voter that ranks candidates 1, 3 and 3 gets the ordering 0, 1, 1.
+func parseOrdering(r *http.Request, num_candidates int) ([]int, error) {
+  ordering := make([]int, num_candidates)
+  used := make([]bool, num_candidates)
+  for i := range ordering {
+    rank_str := r.FormValue(fmt.Sprintf("rank_%d", i))
+    if rank_str == "" {
+      ordering[i] = -1
+      continue
+    }
+    rank, err := strconv.ParseInt(rank_str, 10, 32)
     if err != nil {
-      http.Error(w, err.Error(), http.StatusInternalServerError)
-      return
+      return nil, &electionError{fmt.Sprintf("The rank given for candidate %d, '%s', is not a number.", i, rank_str)}
     }
-    http.Redirect(w, r, url, http.StatusFound)
+    if rank < 0 || rank >= int64(num_candidates) {
+      return nil, &electionError{fmt.Sprintf("The rank given for candidate %d, %d, should be between 0 and %d.", i, rank, num_candidates-1)}
+    }
+    ordering[i] = int(rank)
+    used[rank] = true
   }
 
-  key, err := datastore.DecodeKey(r.FormValue("key"))
+  // new_rank[i] is what rank i becomes once the gaps are closed up.
+  new_rank := make([]int, num_candidates)
+  next := 0
+  for i := range used {
+    new_rank[i] = next
+    if used[i] {
+      next++
+    }
+  }
+  for i := range ordering {
+    if ordering[i] >= 0 {
+      ordering[i] = new_rank[ordering[i]]
+    }
+  }
+  return ordering, nil
+}
+
+// Returns the names of cands joined into a list, like "A, B and C".
+func joinNames(cands []Candidate) string {
+  var names string
+  for i := range cands {
+    switch {
+    case i == 0:
+    case i == len(cands)-1:
+      names += " and "
+    default:
+      names += ", "
+    }
+    names += cands[i].Name
+  }
+  return names
+}
+
+// Splits the candidates up into tiers according to ordering, best first,
+// along with the candidates that weren't ranked at all.
+func orderingTiers(cands []Candidate, ordering []int) ([][]Candidate, []Candidate) {
+  var tiers [][]Candidate
+  var unranked []Candidate
+  for i, rank := range ordering {
+    if rank < 0 {
+      unranked = append(unranked, cands[i])
+      continue
+    }
+    for len(tiers) <= rank {
+      tiers = append(tiers, nil)
+    }
+    tiers[rank] = append(tiers[rank], cands[i])
+  }
+  return tiers, unranked
+}
+
+// Describes ordering in plain language, one sentence for each tier, such as
+// "You prefer A over B, C, D and E." and "D and E are tied last."
+func describeOrdering(cands []Candidate, ordering []int) []string {
+  tiers, unranked := orderingTiers(cands, ordering)
+  if len(tiers) == 0 {
+    return []string{"You have not ranked any candidates, so they are all tied."}
+  }
+  var sentences []string
+  for i, tier := range tiers {
+    var below []Candidate
+    for _, lower := range tiers[i+1:] {
+      below = append(below, lower...)
+    }
+    below = append(below, unranked...)
+    switch {
+    case len(below) == 0 && len(tier) > 1:
+      sentences = append(sentences, fmt.Sprintf("%s are tied last.", joinNames(tier)))
+    case len(below) == 0:
+    case len(tier) == 1:
+      sentences = append(sentences, fmt.Sprintf("You prefer %s over %s.", tier[0].Name, joinNames(below)))
+    default:
+      sentences = append(sentences, fmt.Sprintf("You rank %s equally, and prefer them over %s.", joinNames(tier), joinNames(below)))
+    }
+  }
+  switch len(unranked) {
+  case 0:
+  case 1:
+    sentences = append(sentences, fmt.Sprintf("%s is last.", unranked[0].Name))
+  default:
+    sentences = append(sentences, fmt.Sprintf("%s are tied last.", joinNames(unranked)))
+  }
+  return sentences
+}
+
+type reviewTemplateData struct {
+  Election  Election
+  Questions []reviewedQuestion
+
+  // Set if there is more than one question on the ballot.
+  Multiple bool
+
+  // The ballot, as it is submitted in the fields of the ballot form.
+  Fields []formField
+}
+
+// The voter's answer to one of the questions on the ballot.
+type reviewedQuestion struct {
+  Title       string
+  Tiers       [][]Candidate
+  Unranked    []Candidate
+  Description []string
+}
+
+var reviewTemplate = template.Must(template.New("review").Parse(reviewTemplateHTML))
+
+const reviewTemplateHTML = `
+  <body>
+    Election: {{.Election.Title}}<br/>
+    Please check your ballot before casting it.<br/>
+    {{range .Questions}}
+      {{if $.Multiple}}<b>{{.Title}}</b><br/>{{end}}
+      {{if .Tiers}}
+        <ol>
+          {{range .Tiers}}
+            <li>{{range $i,$cand := .}}{{if $i}}, {{end}}{{$cand.Name}}{{end}}</li>
+          {{end}}
+        </ol>
+      {{end}}
+      {{if .Unranked}}
+        Unranked: {{range $i,$cand := .Unranked}}{{if $i}}, {{end}}{{$cand.Name}}{{end}}<br/>
+      {{end}}
+      <p>
+      {{range .Description}}
+        {{.}}<br/>
+      {{end}}
+      </p>
+    {{end}}
+    <form action="/cast_ballot" method="post">
+      <input type="hidden" name="key" value="{{.Election.Key_str}}"/>
+      {{range .Fields}}
+        <input type="hidden" name="{{.Name}}" value="{{.Value}}"/>
+      {{end}}
+      <input type="submit" value="Cast this ballot"/>
+    </form>
+    <form action="/ballot" method="post">
+      <input type="hidden" name="key" value="{{.Election.Key_str}}"/>
+      <input type="hidden" name="changing" value="1"/>
+      {{range .Fields}}
+        <input type="hidden" name="{{.Name}}" value="{{.Value}}"/>
+      {{end}}
+      <input type="submit" value="Change my ballot"/>
+    </form>
+  </body>
+`
+
+// Shows the voter what their ballot means before they cast it.
+func reviewBallot(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  key, e, cands, ok := getVotableElection(w, r, c, u)
+  if !ok {
+    return
+  }
+  questions, err := getQuestions(c, key, e, cands)
   if err != nil {
     http.Error(w, err.Error(), http.StatusInternalServerError)
     return
   }
-
-  var e Election
-  err = datastore.Get(c, key, &e)
+  ballots, err := parseBallots(r, questions)
   if err != nil {
     http.Error(w, err.Error(), http.StatusInternalServerError)
     return
   }
+  data := reviewTemplateData{
+    Election: *e,
+    Multiple: len(questions) > 1,
+    Fields:   questionFormFields(questions, ballots),
+  }
+  for i, q := range questions {
+    b := ballots[i]
+    reviewed := reviewedQuestion{
+      Title:       q.Title,
+      Description: q.Election.ballotKind().Describe(q.Election, q.Candidates, b),
+    }
+    if b.Ordering != nil {
+      reviewed.Tiers, reviewed.Unranked = orderingTiers(q.Candidates, b.Ordering)
+    }
+    data.Questions = append(data.Questions, reviewed)
+  }
+  reviewTemplate.Execute(w, data)
+}
 
-  if !e.IsUserAllowedToVote(u) {
-    http.Error(w, "You have not been listed as a participant in this election.", http.StatusInternalServerError)
-    return
+// Returns the time at which a ballot cast at now (in nanoseconds) in e will
+// become viewable.  This is a random amount of time after the next
+// Refresh_interval boundary, rounded to a boundary, so that watching the
+// results change doesn't tell anyone who just voted.
+func viewableTime(e *Election, now int64) (time.Time, error) {
+  blind, err := randN(e.Refresh_interval)
+  if err != nil {
+    return time.Time{}, err
   }
+  viewable := now + blind + e.Refresh_interval
+  viewable = viewable - (viewable % e.Refresh_interval)
+  return time.Unix(0, viewable), nil
+}
 
-  now := time.Now().UnixNano()
+type castTemplateData struct {
+  Election Election
+  Viewable time.Time
+}
 
-  if now < e.Start.UnixNano() {
-    http.Error(w, "Voting for this election has not begun yet.", http.StatusInternalServerError)
+var castTemplate = template.Must(template.New("cast").Parse(castTemplateHTML))
+
+const castTemplateHTML = `
+  <body>
+    Your ballot in {{.Election.Title}} has been cast.<br/>
+    It will be counted in the results from {{.Viewable}}.  Until then the
+    results include the last ballot you cast before this one, if there was one.<br/>
+    {{if .Election.Hide_results}}
+      The results will be available once voting closes at {{.Election.End}}.<br/>
+    {{else}}
+      <a href="/view_results?key={{.Election.Key_str}}">View the results</a><br/>
+    {{end}}
+    <a href="/ballot?key={{.Election.Key_str}}">Change your ballot</a><br/>
+    <a href="/my_ballots?key={{.Election.Key_str}}">All of the ballots you have cast</a>
+  </body>
+`
+
+func castBallot(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
     return
   }
-
-  if e.End.UnixNano() < now {
-    http.Error(w, "Voting for this election has closed.", http.StatusInternalServerError)
+  key, e, cands, ok := getVotableElection(w, r, c, u)
+  if !ok {
     return
   }
 
-
-  cands, err := e.GetCandidates(c)
+  questions, err := getQuestions(c, key, e, cands)
   if err != nil {
     http.Error(w, err.Error(), http.StatusInternalServerError)
     return
   }
-
-  ordering := make([]int, len(cands))
-  for i := range cands {
-    rank_str := r.FormValue(fmt.Sprintf("rank_%d", i))
-    rank, err := strconv.ParseInt(rank_str, 10, 32)
-    if err != nil || rank < 0 {
-      rank = -1
-    }
-    ordering[i] = int(rank)
+  parsed, err := parseBallots(r, questions)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
   }
-  blind, err := randN(e.Refresh_interval)
+  now := time.Now().UnixNano()
+  viewable, err := viewableTime(e, now)
   if err != nil {
     http.Error(w, err.Error(), http.StatusInternalServerError)
     return
   }
-  viewable := now + blind + e.Refresh_interval
-  viewable = viewable - (viewable % e.Refresh_interval)
-  b := Ballot{
-    User_id:      u.ID,
-    Ordering:     ordering,
-    Time:         time.Unix(0, now),
-    Viewable:     time.Unix(0, viewable),
-    Election_key: key,
-  }
-  _, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Ballot", key), &b)
+  var ballots []Ballot
+  var keys []*datastore.Key
+  for _, p := range parsed {
+    ballots = append(ballots, Ballot{
+      User_id:      u.ID,
+      Email:        u.Email,
+      Ordering:     p.Ordering,
+      Scores:       p.Scores,
+      Question:     p.Question,
+      Time:         time.Unix(0, now),
+      Viewable:     viewable,
+      Election_key: key,
+    })
+    keys = append(keys, datastore.NewIncompleteKey(c, "Ballot", key))
+  }
+  // The answers to every question are cast together or not at all.  They
+  // are all in the Election's entity group, so one transaction covers them.
+  err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+    _, err := datastore.PutMulti(c, keys, ballots)
+    return err
+  }, nil)
   if err != nil {
     http.Error(w, err.Error(), http.StatusInternalServerError)
     return
   }
+  fireWebhooks(c, key, e, &webhookPayload{Event: eventBallotCast})
 
-  http.Redirect(w, r, fmt.Sprintf("/view_results?key=%s", key.Encode()), http.StatusFound)
+  castTemplate.Execute(w, castTemplateData{Election: *e, Viewable: viewable})
 }
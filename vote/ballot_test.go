@@ -0,0 +1,59 @@
+package vote
+
+import (
+  "fmt"
+  "net/http"
+  "net/url"
+  "reflect"
+  "testing"
+)
+
+func TestParseOrdering(t *testing.T) {
+  tests := []struct {
+    name  string
+    ranks []string
+    want  []int
+    ok    bool
+  }{
+    {"every candidate ranked", []string{"0", "1", "2"}, []int{0, 1, 2}, true},
+    {"ties", []string{"1", "0", "1"}, []int{1, 0, 1}, true},
+    {"gaps are closed up", []string{"0", "2", "2"}, []int{0, 1, 1}, true},
+    {"gap at the top", []string{"2", "1", ""}, []int{1, 0, -1}, true},
+    {"nobody ranked", []string{"", "", ""}, []int{-1, -1, -1}, true},
+    {"not a number", []string{"0", "first", "1"}, nil, false},
+    {"negative", []string{"0", "-1", "1"}, nil, false},
+    {"rank past the last place", []string{"0", "3", "1"}, nil, false},
+  }
+  for _, test := range tests {
+    form := make(url.Values)
+    for i, rank := range test.ranks {
+      form.Set(fmt.Sprintf("rank_%d", i), rank)
+    }
+    got, err := parseOrdering(&http.Request{Form: form}, len(test.ranks))
+    if (err == nil) != test.ok {
+      t.Errorf("%s: parseOrdering returned error %v, want ok = %v", test.name, err, test.ok)
+      continue
+    }
+    if _, is_election_error := err.(*electionError); err != nil && !is_election_error {
+      t.Errorf("%s: parseOrdering returned %T, want an electionError", test.name, err)
+    }
+    if !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: parseOrdering = %v, want %v", test.name, got, test.want)
+    }
+  }
+}
+
+func TestBallotVoter(t *testing.T) {
+  tests := []struct {
+    ballot Ballot
+    want   string
+  }{
+    {Ballot{User_id: "1", Email: "Alice@Example.com"}, "alice@example.com"},
+    {Ballot{User_id: "1"}, "1"},
+  }
+  for _, test := range tests {
+    if got := test.ballot.voter(); got != test.want {
+      t.Errorf("voter of %+v = %q, want %q", test.ballot, got, test.want)
+    }
+  }
+}
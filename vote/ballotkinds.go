@@ -0,0 +1,695 @@
+package vote
+
+import (
+  "bytes"
+  "fmt"
+  "html/template"
+  "net/http"
+  "sort"
+  "strconv"
+)
+
+// The kinds of ballot an Election can use, see Election.Ballot_type.
+const (
+  ballotRanked   = "ranked"
+  ballotApproval = "approval"
+  ballotScore    = "score"
+  ballotStar     = "star"
+  ballotJudgment   = "judgment"
+  ballotReferendum = "referendum"
+)
+
+// What is counted up from the ballots, before any ranking is worked out.
+type ballotCounts struct {
+  // Pairwise[i][j] is the total weight of the ballots that prefer candidate
+  // i to candidate j.  Nil for kinds of ballot that don't use it.
+  Pairwise [][]int
+
+  // Totals[i] is the total weighted score or number of approvals that
+  // candidate i got.  Nil for ranked ballots.
+  Totals []int
+
+  // Grades[i][g] is the total weight of the ballots that gave candidate i
+  // grade g.  Only used by Majority Judgment.
+  Grades [][]int
+}
+
+// The automatic runoff between the two candidates with the highest total
+// scores in a STAR election.
+type starRunoff struct {
+  Finalists [2]int `json:"finalists"`
+
+  // Total weight of the ballots that scored each finalist higher than the
+  // other.
+  Votes [2]int `json:"votes"`
+}
+
+// Everything that depends on the kind of ballot an election uses.
+type ballotKind struct {
+  // Shown when picking the kind of ballot for an election.
+  Label string
+
+  // What the Totals are called on the results page, for kinds that have
+  // them.
+  Totals_label string
+
+  // The name of the counting method, see compare.go.
+  Method string
+
+  // The fields of the ballot form, executed with ballotFieldsData.
+  Template *template.Template
+
+  // Reads a ballot from the fields of a request, filling in either the
+  // Ordering or the Scores of a Ballot.
+  Parse func(r *http.Request, e *Election, num_candidates int) (*Ballot, error)
+
+  // The fields that Parse reads, as they would be submitted for b.
+  Fields func(b *Ballot) []formField
+
+  // Describes b in plain language for the voter to check.
+  Describe func(e *Election, cands []Candidate, b *Ballot) []string
+
+  // Adds up ballots, where each ballot counts for its voter's weight.
+  Count func(e *Election, num_candidates int, ballots []Ballot) *ballotCounts
+
+  // Ranks the candidates into tiers, best first, from the counts.
+  Rank func(counts *ballotCounts) ([][]int, *starRunoff)
+
+  // How much the counts can change, in total, when one ballot of weight 1 is
+  // added or taken away.  This is what noise is calibrated to.
+  Sensitivity func(e *Election, num_candidates int) int
+}
+
+var ballotKinds map[string]*ballotKind
+
+// The order in which the kinds of ballot are offered on the election form.
+var ballotKindOrder = []string{ballotRanked, ballotApproval, ballotScore, ballotStar, ballotJudgment, ballotReferendum}
+
+func init() {
+  ballotKinds = map[string]*ballotKind{
+    ballotRanked: &ballotKind{
+      Label:    "Ranked: voters put the candidates in order, counted with the Schulze method",
+      Method:   methodSchulze,
+      Template: rankedBallotTemplate,
+      Parse: func(r *http.Request, e *Election, num_candidates int) (*Ballot, error) {
+        ordering, err := parseOrdering(r, num_candidates)
+        if err != nil {
+          return nil, err
+        }
+        return &Ballot{Ordering: ordering}, nil
+      },
+      Fields: func(b *Ballot) []formField {
+        var fields []formField
+        for i, rank := range b.Ordering {
+          value := ""
+          if rank >= 0 {
+            value = strconv.Itoa(rank)
+          }
+          fields = append(fields, formField{fmt.Sprintf("rank_%d", i), value})
+        }
+        return fields
+      },
+      Describe: func(e *Election, cands []Candidate, b *Ballot) []string {
+        return describeOrdering(cands, b.Ordering)
+      },
+      Count: func(e *Election, num_candidates int, ballots []Ballot) *ballotCounts {
+        return &ballotCounts{Pairwise: pairwiseGraph(e, num_candidates, ballots)}
+      },
+      Rank: func(counts *ballotCounts) ([][]int, *starRunoff) {
+        return schulzeRanking(counts.Pairwise), nil
+      },
+      Sensitivity: func(e *Election, n int) int {
+        return n * (n - 1) / 2
+      },
+    },
+    ballotApproval: &ballotKind{
+      Label:        "Approval: voters check every candidate they approve of",
+      Totals_label: "Approvals",
+      Method:       methodApproval,
+      Template:     approvalBallotTemplate,
+      Parse:    parseScoreBallot,
+      Fields:   scoreFields,
+      Describe: func(e *Election, cands []Candidate, b *Ballot) []string {
+        var approved []Candidate
+        for i, score := range b.Scores {
+          if score > 0 {
+            approved = append(approved, cands[i])
+          }
+        }
+        if len(approved) == 0 {
+          return []string{"You don't approve of any of the candidates."}
+        }
+        return []string{fmt.Sprintf("You approve of %s.", joinNames(approved))}
+      },
+      Count:       countScores,
+      Rank:        rankScores,
+      Sensitivity: scoreSensitivity,
+    },
+    ballotScore: &ballotKind{
+      Label:        "Score: voters give each candidate a score, and the highest total wins",
+      Totals_label: "Total score",
+      Method:       methodScore,
+      Template:     scoreBallotTemplate,
+      Parse:       parseScoreBallot,
+      Fields:      scoreFields,
+      Describe:    describeScores,
+      Count:       countScores,
+      Rank:        rankScores,
+      Sensitivity: scoreSensitivity,
+    },
+    ballotStar: &ballotKind{
+      Label:        "STAR: voters score the candidates, then the two highest totals go to an automatic runoff",
+      Totals_label: "Total score",
+      Method:       methodStar,
+      Template:     starBallotTemplate,
+      Parse:    parseScoreBallot,
+      Fields:   scoreFields,
+      Describe: func(e *Election, cands []Candidate, b *Ballot) []string {
+        return append(describeScores(e, cands, b),
+          "In the runoff between the two candidates with the highest total scores, your vote goes to whichever of them you scored higher.")
+      },
+      Count: func(e *Election, num_candidates int, ballots []Ballot) *ballotCounts {
+        counts := countScores(e, num_candidates, ballots)
+        counts.Pairwise = scorePairwise(e, num_candidates, ballots)
+        return counts
+      },
+      Rank: rankStar,
+      Sensitivity: func(e *Election, n int) int {
+        return scoreSensitivity(e, n) + n*(n-1)/2
+      },
+    },
+    ballotJudgment: &ballotKind{
+      Label:    "Majority Judgment: voters grade each candidate, and the best median grade wins",
+      Method:   methodJudgment,
+      Template: judgmentBallotTemplate,
+      Parse:    parseGradeBallot,
+      Fields:   scoreFields,
+      Describe: describeGrades,
+      Count:    countGrades,
+      Rank:     rankGrades,
+      // Each ballot adds one to a single grade of every candidate.
+      Sensitivity: func(e *Election, n int) int {
+        return n
+      },
+    },
+    ballotReferendum: &ballotKind{
+      Label:        "Referendum: voters answer Yes or No",
+      Totals_label: "Votes",
+      Method:       methodPlurality,
+      Template:     referendumBallotTemplate,
+      Parse:        parseChoiceBallot,
+      Fields: func(b *Ballot) []formField {
+        choice := ""
+        for i, score := range b.Scores {
+          if score > 0 {
+            choice = strconv.Itoa(i)
+          }
+        }
+        return []formField{{"choice", choice}}
+      },
+      Describe: func(e *Election, cands []Candidate, b *Ballot) []string {
+        for i, score := range b.Scores {
+          if score > 0 {
+            return []string{fmt.Sprintf("You vote %s.", cands[i].Name)}
+          }
+        }
+        return []string{"You abstain."}
+      },
+      Count: countScores,
+      Rank:  rankScores,
+      // Each ballot adds one to the total of at most one answer.
+      Sensitivity: func(e *Election, n int) int {
+        return 1
+      },
+    },
+  }
+}
+
+// Returns the ballotKind that e uses.  Elections from before there was more
+// than one kind of ballot are ranked.
+func (e *Election) ballotKind() *ballotKind {
+  if kind, ok := ballotKinds[e.Ballot_type]; ok {
+    return kind
+  }
+  return ballotKinds[ballotRanked]
+}
+
+// The highest score a voter can give a candidate in e.  For Majority
+// Judgment this is the index of the worst grade.
+func (e *Election) maxScore() int {
+  if e.Ballot_type == ballotJudgment {
+    return len(e.grades()) - 1
+  }
+  if e.Ballot_type == ballotApproval || e.Max_score <= 0 {
+    return 1
+  }
+  return e.Max_score
+}
+
+// One candidate on a score, STAR, approval or Majority Judgment ballot.
+type scoredCandidate struct {
+  Candidate
+  Options  []scoreOption
+  Approved bool
+}
+
+type scoreOption struct {
+  Score    int
+  Selected bool
+
+  // The name of the grade, on Majority Judgment ballots.
+  Grade string
+}
+
+type ballotFieldsData struct {
+  Election   Election
+  Candidates []Candidate
+
+  // Put in front of the name of every field, so that the fields of several
+  // questions can be on the same form, see questionPrefix.
+  Prefix string
+
+  // For ranked ballots, Ranks[i][j] is set if candidate i is ranked j.
+  Ranks map[int]map[int]bool
+
+  // For every other kind of ballot.
+  Scored []scoredCandidate
+}
+
+// Writes out the fields of the ballot form for e, filled in the way b is,
+// which may be nil, with prefix in front of the name of every field.
+func ballotFields(e *Election, cands []Candidate, b *Ballot, prefix string) (template.HTML, error) {
+  data := ballotFieldsData{Election: *e, Candidates: cands, Prefix: prefix, Ranks: make(map[int]map[int]bool)}
+  for i, cand := range cands {
+    data.Ranks[i] = make(map[int]bool)
+    score := 0
+    if e.Ballot_type == ballotJudgment {
+      // Anyone that isn't graded gets the worst grade.
+      score = e.maxScore()
+    }
+    if b != nil && len(b.Ordering) == len(cands) {
+      data.Ranks[i][b.Ordering[i]] = true
+    }
+    if b != nil && len(b.Scores) == len(cands) {
+      score = b.Scores[i]
+    }
+    sc := scoredCandidate{Candidate: cand, Approved: score > 0}
+    for s := 0; s <= e.maxScore(); s++ {
+      option := scoreOption{Score: s, Selected: s == score}
+      if e.Ballot_type == ballotJudgment {
+        option.Grade = e.grades()[s]
+      }
+      sc.Options = append(sc.Options, option)
+    }
+    data.Scored = append(data.Scored, sc)
+  }
+  var buf bytes.Buffer
+  err := e.ballotKind().Template.Execute(&buf, data)
+  return template.HTML(buf.String()), err
+}
+
+// Reads the score_<i> fields of the request.  A candidate that is left blank,
+// or an approval box that isn't checked, gets a score of 0.
+func parseScoreBallot(r *http.Request, e *Election, num_candidates int) (*Ballot, error) {
+  scores := make([]int, num_candidates)
+  for i := range scores {
+    score_str := r.FormValue(fmt.Sprintf("score_%d", i))
+    if score_str == "" {
+      continue
+    }
+    score, err := strconv.Atoi(score_str)
+    if err != nil {
+      return nil, &electionError{fmt.Sprintf("The score given for candidate %d, '%s', is not a number.", i, score_str)}
+    }
+    if score < 0 || score > e.maxScore() {
+      return nil, &electionError{fmt.Sprintf("The score given for candidate %d, %d, should be between 0 and %d.", i, score, e.maxScore())}
+    }
+    scores[i] = score
+  }
+  return &Ballot{Scores: scores}, nil
+}
+
+// Reads the choice field of the request, which is the index of the one
+// candidate the voter picked, and gives that candidate a score of 1.  A
+// voter that doesn't pick anyone abstains.
+func parseChoiceBallot(r *http.Request, e *Election, num_candidates int) (*Ballot, error) {
+  scores := make([]int, num_candidates)
+  choice_str := r.FormValue("choice")
+  if choice_str == "" {
+    return &Ballot{Scores: scores}, nil
+  }
+  choice, err := strconv.Atoi(choice_str)
+  if err != nil || choice < 0 || choice >= num_candidates {
+    return nil, &electionError{fmt.Sprintf("'%s' is not one of the answers.", choice_str)}
+  }
+  scores[choice] = 1
+  return &Ballot{Scores: scores}, nil
+}
+
+// The answers to a referendum.
+func referendumCandidates() []Candidate {
+  return []Candidate{{Name: "Yes", Index: 0}, {Name: "No", Index: 1}}
+}
+
+func scoreFields(b *Ballot) []formField {
+  var fields []formField
+  for i, score := range b.Scores {
+    fields = append(fields, formField{fmt.Sprintf("score_%d", i), strconv.Itoa(score)})
+  }
+  return fields
+}
+
+func describeScores(e *Election, cands []Candidate, b *Ballot) []string {
+  var sentences []string
+  for i, score := range b.Scores {
+    sentences = append(sentences, fmt.Sprintf("You give %s %d out of %d.", cands[i].Name, score, e.maxScore()))
+  }
+  return sentences
+}
+
+func countScores(e *Election, num_candidates int, ballots []Ballot) *ballotCounts {
+  totals := make([]int, num_candidates)
+  for _, b := range ballots {
+    if len(b.Scores) != num_candidates {
+      continue
+    }
+    weight := e.VoterWeight(b.Email)
+    for i, score := range b.Scores {
+      totals[i] += weight * score
+    }
+  }
+  return &ballotCounts{Totals: totals}
+}
+
+// The pairwise matrix of scored ballots, where a voter prefers whichever of
+// two candidates they scored higher.
+func scorePairwise(e *Election, num_candidates int, ballots []Ballot) [][]int {
+  graph := make([][]int, num_candidates)
+  for i := range graph {
+    graph[i] = make([]int, num_candidates)
+  }
+  for _, b := range ballots {
+    if len(b.Scores) != num_candidates {
+      continue
+    }
+    weight := e.VoterWeight(b.Email)
+    for i := range b.Scores {
+      for j := range b.Scores {
+        if b.Scores[i] > b.Scores[j] {
+          graph[i][j] += weight
+        }
+      }
+    }
+  }
+  return graph
+}
+
+func scoreSensitivity(e *Election, n int) int {
+  return n * e.maxScore()
+}
+
+// Candidates sorted by their totals, highest first, and by index when their
+// totals are the same.
+type byTotal struct {
+  cands  []int
+  totals []int
+}
+
+func (b byTotal) Len() int      { return len(b.cands) }
+func (b byTotal) Swap(i, j int) { b.cands[i], b.cands[j] = b.cands[j], b.cands[i] }
+func (b byTotal) Less(i, j int) bool {
+  ti, tj := b.totals[b.cands[i]], b.totals[b.cands[j]]
+  if ti != tj {
+    return ti > tj
+  }
+  return b.cands[i] < b.cands[j]
+}
+
+// Ranks cands by their totals, with candidates that have the same total in
+// the same tier.
+func rankByTotals(cands []int, totals []int) [][]int {
+  sorted := append([]int(nil), cands...)
+  sort.Sort(byTotal{sorted, totals})
+  var ranks [][]int
+  for i, c := range sorted {
+    if i > 0 && totals[c] == totals[sorted[i-1]] {
+      ranks[len(ranks)-1] = append(ranks[len(ranks)-1], c)
+      continue
+    }
+    ranks = append(ranks, []int{c})
+  }
+  return ranks
+}
+
+func allCandidates(n int) []int {
+  cands := make([]int, n)
+  for i := range cands {
+    cands[i] = i
+  }
+  return cands
+}
+
+func rankScores(counts *ballotCounts) ([][]int, *starRunoff) {
+  return rankByTotals(allCandidates(len(counts.Totals)), counts.Totals), nil
+}
+
+// The two candidates with the highest total scores go to a runoff, which is
+// won by whichever of them more of the voters scored higher.  The runner up
+// comes second, and everyone else is ranked by their total score.  If the
+// runoff is tied then the finalists are tied, unless one had a higher total.
+func rankStar(counts *ballotCounts) ([][]int, *starRunoff) {
+  n := len(counts.Totals)
+  if n < 2 {
+    return rankScores(counts)
+  }
+  sorted := allCandidates(n)
+  sort.Sort(byTotal{sorted, counts.Totals})
+  a, b := sorted[0], sorted[1]
+  runoff := &starRunoff{
+    Finalists: [2]int{a, b},
+    Votes:     [2]int{counts.Pairwise[a][b], counts.Pairwise[b][a]},
+  }
+  var ranks [][]int
+  switch {
+  case runoff.Votes[0] > runoff.Votes[1]:
+    ranks = [][]int{{a}, {b}}
+  case runoff.Votes[1] > runoff.Votes[0]:
+    ranks = [][]int{{b}, {a}}
+  default:
+    ranks = rankByTotals([]int{a, b}, counts.Totals)
+  }
+  return append(ranks, rankByTotals(sorted[2:], counts.Totals)...), runoff
+}
+
+var approvalBallotTemplate = template.Must(template.New("approval_ballot").Parse(approvalBallotTemplateHTML))
+
+const approvalBallotTemplateHTML = `
+    Check every candidate that you approve of.
+    <table>
+    {{range $index,$cand := .Scored}}
+      <tr>
+        <td><input type="checkbox" name="{{$.Prefix}}score_{{$index}}" value="1" {{if .Approved}}checked{{end}}/></td>
+        <td>{{.Name}}</td>
+        <td><img src="/serve/image.jpg?blobKey={{.Image}}"></img></td>
+      </tr>
+    {{end}}
+    </table>
+`
+
+var scoreBallotTemplate = template.Must(template.New("score_ballot").Parse(scoreBallotTemplateHTML))
+
+const scoreBallotTemplateHTML = `
+    Give each candidate a score, higher is better.  The candidate with the
+    highest total score wins.
+    <table>
+    {{range $index,$cand := .Scored}}
+      <tr>
+        <td>{{.Name}}</td>
+        <td><img src="/serve/image.jpg?blobKey={{.Image}}"></img></td>
+        <td>
+          {{range .Options}}
+            <input type="radio" name="{{$.Prefix}}score_{{$index}}" value="{{.Score}}" {{if .Selected}}checked{{end}}/>{{.Score}}
+          {{end}}
+        </td>
+      </tr>
+    {{end}}
+    </table>
+`
+
+var starBallotTemplate = template.Must(template.New("star_ballot").Parse(starBallotTemplateHTML))
+
+const starBallotTemplateHTML = `
+    Give each candidate a score, higher is better.  The two candidates with
+    the highest total scores go to a runoff, and your vote in the runoff goes
+    to whichever of them you scored higher, so give your favorite a higher
+    score than anyone else.
+    <table>
+    {{range $index,$cand := .Scored}}
+      <tr>
+        <td>{{.Name}}</td>
+        <td><img src="/serve/image.jpg?blobKey={{.Image}}"></img></td>
+        <td>
+          {{range .Options}}
+            <input type="radio" name="{{$.Prefix}}score_{{$index}}" value="{{.Score}}" {{if .Selected}}checked{{end}}/>{{.Score}}
+          {{end}}
+        </td>
+      </tr>
+    {{end}}
+    </table>
+`
+
+var referendumBallotTemplate = template.Must(template.New("referendum_ballot").Parse(referendumBallotTemplateHTML))
+
+const referendumBallotTemplateHTML = `
+    {{range $index,$cand := .Scored}}
+      <input type="radio" name="{{$.Prefix}}choice" value="{{$index}}" {{if .Approved}}checked{{end}}/>{{.Name}}<br/>
+    {{end}}
+    <input type="radio" name="{{$.Prefix}}choice" value=""/>Abstain<br/>
+`
+
+var rankedBallotTemplate = template.Must(template.New("ranked_ballot").Funcs(template.FuncMap{"inc": inc}).Parse(rankedBallotTemplateHTML))
+
+func inc(n int) int {
+  return n + 1
+}
+
+// Without javascript the ballot is just a table with a drop-down of ranks
+// for each candidate.  With javascript the table is hidden and replaced with
+// a list of tiers that candidates can be dragged between, which sets the
+// drop-downs behind the scenes, so either way the same form is submitted.
+const rankedBallotTemplateHTML = `
+    {{ $data := .}}
+    <style>
+      .tier { border: 1px solid #888; min-height: 2em; margin: 4px 0; padding: 4px; }
+      .tier.new { border-style: dashed; color: #888; }
+      .tier.unranked { background: #eee; }
+      .cand { display: inline-block; border: 1px solid #444; background: #fff; margin: 2px; padding: 2px; cursor: move; }
+    </style>
+    <div id="{{$data.Prefix}}tiers" style="display: none">
+      Drag the candidates into order, best first.  Candidates in the same box
+      are tied, and anyone left unranked is tied for last.
+    </div>
+    <table id="{{$data.Prefix}}fallback">
+    <tr><td>Candidate</td><td></td><td>Rank (1 is best, the same rank means a tie)</td></tr>
+    {{range $index,$element := .Candidates}}
+      <tr>
+        <td>{{.Name}}</td>
+        <td><img src="/serve/image.jpg?blobKey={{.Image}}"></img></td>
+        <td>
+          <select name="{{$data.Prefix}}rank_{{$index}}" id="{{$data.Prefix}}rank_{{$index}}" data-name="{{.Name}}">
+            <option value="">Unranked</option>
+            {{range $rank_index,$rank := $data.Candidates}}
+              <option value="{{$rank_index}}" {{if index $data.Ranks $index $rank_index}}selected{{end}}>{{inc $rank_index}}</option>
+            {{end}}
+          </select>
+        </td>
+      </tr>
+    {{end}}
+    </table>
+    <script>
+      (function(prefix) {
+        var container = document.getElementById(prefix + "tiers");
+        if (!container.addEventListener || !("draggable" in container)) {
+          return;
+        }
+        var selects = document.querySelectorAll("select[id^=" + prefix + "rank_]");
+
+        // tiers[i] is a list of the indices of the candidates ranked i.
+        var tiers = [];
+        var unranked = [];
+        for (var i = 0; i < selects.length; i++) {
+          if (selects[i].value === "") {
+            unranked.push(i);
+            continue;
+          }
+          var rank = parseInt(selects[i].value, 10);
+          while (tiers.length <= rank) {
+            tiers.push([]);
+          }
+          tiers[rank].push(i);
+        }
+
+        // Drops all the empty tiers and writes the rest back into the
+        // drop-downs, so that the ranks are always 0, 1, 2, ... with no gaps.
+        function save() {
+          tiers = tiers.filter(function(tier) { return tier.length > 0; });
+          for (var t = 0; t < tiers.length; t++) {
+            for (var j = 0; j < tiers[t].length; j++) {
+              selects[tiers[t][j]].value = String(t);
+            }
+          }
+          for (var j = 0; j < unranked.length; j++) {
+            selects[unranked[j]].value = "";
+          }
+        }
+
+        function remove(cand) {
+          var lists = tiers.concat([unranked]);
+          for (var t = 0; t < lists.length; t++) {
+            var at = lists[t].indexOf(cand);
+            if (at >= 0) {
+              lists[t].splice(at, 1);
+            }
+          }
+        }
+
+        // Makes a box that candidates can be dropped into.  drop is called
+        // with the index of the candidate that was dropped.
+        function makeTier(label, cands, className, drop) {
+          var div = document.createElement("div");
+          div.className = "tier " + className;
+          div.appendChild(document.createTextNode(label + " "));
+          for (var j = 0; j < cands.length; j++) {
+            var span = document.createElement("span");
+            span.className = "cand";
+            span.draggable = true;
+            span.textContent = selects[cands[j]].getAttribute("data-name");
+            span.addEventListener("dragstart", (function(cand) {
+              return function(event) {
+                event.dataTransfer.setData("text", String(cand));
+              };
+            })(cands[j]));
+            div.appendChild(span);
+          }
+          div.addEventListener("dragover", function(event) {
+            event.preventDefault();
+          });
+          div.addEventListener("drop", function(event) {
+            event.preventDefault();
+            var cand = parseInt(event.dataTransfer.getData("text"), 10);
+            remove(cand);
+            drop(cand);
+            save();
+            draw();
+          });
+          container.appendChild(div);
+        }
+
+        function draw() {
+          while (container.childNodes.length > 1) {
+            container.removeChild(container.lastChild);
+          }
+          // Between every pair of tiers there is a place to drop a candidate
+          // to give it a rank of its own.
+          for (var t = 0; t <= tiers.length; t++) {
+            makeTier("New rank", [], "new", (function(t) {
+              return function(cand) { tiers.splice(t, 0, [cand]); };
+            })(t));
+            if (t < tiers.length) {
+              makeTier("Rank " + (t + 1) + ":", tiers[t], "", (function(tier) {
+                return function(cand) { tier.push(cand); };
+              })(tiers[t]));
+            }
+          }
+          makeTier("Unranked:", unranked, "unranked", function(cand) {
+            unranked.push(cand);
+          });
+        }
+
+        save();
+        draw();
+        container.style.display = "";
+        document.getElementById(prefix + "fallback").style.display = "none";
+      })({{$data.Prefix}});
+    </script>
+`
@@ -0,0 +1,167 @@
+package vote
+
+import (
+  "appengine"
+  "bytes"
+  "fmt"
+  "html/template"
+  "math"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+func init() {
+  http.HandleFunc("/results.dot", resultsDOT)
+}
+
+// The beatpath graph of a Schulze result has an arrow from each candidate to
+// every candidate they are ranked above by a chain of defeats, labelled with
+// the strength of the strongest such chain, see strongestPaths.
+
+// One arrow of the beatpath graph.
+type beatpathEdge struct {
+  From, To int
+  Strength int
+
+  // Set if From beat To head to head, and not only through a chain of
+  // defeats.
+  Direct bool
+}
+
+// Returns the arrows of the beatpath graph of pairwise, strongest first.
+func beatpathEdges(pairwise [][]int) []beatpathEdge {
+  paths := strongestPaths(pairwise)
+  var edges []beatpathEdge
+  for i := range paths {
+    for j := range paths {
+      if i != j && paths[i][j] > paths[j][i] {
+        edges = append(edges, beatpathEdge{i, j, paths[i][j], pairwise[i][j] > pairwise[j][i]})
+      }
+    }
+  }
+  for i := 1; i < len(edges); i++ {
+    for j := i; j > 0 && edges[j].Strength > edges[j-1].Strength; j-- {
+      edges[j], edges[j-1] = edges[j-1], edges[j]
+    }
+  }
+  return edges
+}
+
+// Draws the beatpath graph with the candidates around a circle, in the order
+// they were ranked, starting from the top and going clockwise.  Thicker
+// arrows are stronger, and dashed arrows are defeats that only happen through
+// a chain of other defeats.
+func beatpathSVG(cands []Candidate, ranks [][]int, pairwise [][]int) template.HTML {
+  const (
+    size        = 500
+    radius      = 180
+    node_radius = 28
+  )
+  var order []int
+  for _, tier := range ranks {
+    order = append(order, tier...)
+  }
+  if len(order) == 0 {
+    return ""
+  }
+  x := make([]float64, len(cands))
+  y := make([]float64, len(cands))
+  for k, c := range order {
+    angle := 2*math.Pi*float64(k)/float64(len(order)) - math.Pi/2
+    x[c] = size/2 + radius*math.Cos(angle)
+    y[c] = size/2 + radius*math.Sin(angle)
+  }
+  edges := beatpathEdges(pairwise)
+
+  var svg bytes.Buffer
+  fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">`, size, size)
+  svg.WriteString(`<defs><marker id="beatpath_arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="6" markerHeight="6" orient="auto"><path d="M0,0 L10,5 L0,10 z"/></marker></defs>`)
+  for _, edge := range edges {
+    dx, dy := x[edge.To]-x[edge.From], y[edge.To]-y[edge.From]
+    length := math.Sqrt(dx*dx + dy*dy)
+    if length == 0 {
+      continue
+    }
+    ux, uy := dx/length, dy/length
+    x1, y1 := x[edge.From]+ux*node_radius, y[edge.From]+uy*node_radius
+    x2, y2 := x[edge.To]-ux*node_radius, y[edge.To]-uy*node_radius
+    width := 1 + 4*float64(edge.Strength)/float64(edges[0].Strength)
+    dash := ""
+    if !edge.Direct {
+      dash = ` stroke-dasharray="6,3"`
+    }
+    fmt.Fprintf(&svg, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#555" stroke-width="%.1f"%s marker-end="url(#beatpath_arrow)"><title>%s beats %s with strength %d</title></line>`,
+      x1, y1, x2, y2, width, dash, template.HTMLEscapeString(cands[edge.From].Name), template.HTMLEscapeString(cands[edge.To].Name), edge.Strength)
+    // The label goes nearer the start of the arrow, so that the labels of
+    // arrows into the same candidate don't pile up.
+    fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f" text-anchor="middle" fill="#a00">%d</text>`,
+      x1+(x2-x1)*0.3-uy*8, y1+(y2-y1)*0.3+ux*8, edge.Strength)
+  }
+  for _, c := range order {
+    fmt.Fprintf(&svg, `<circle cx="%.1f" cy="%.1f" r="%d" fill="#fff" stroke="#000"/>`, x[c], y[c], node_radius)
+    fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`, x[c], y[c]+4, template.HTMLEscapeString(cands[c].Name))
+  }
+  svg.WriteString(`</svg>`)
+  return template.HTML(svg.String())
+}
+
+// Quotes s as a Graphviz ID.
+func dotQuote(s string) string {
+  return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// Writes out the beatpath graph in the DOT language, with the candidates
+// labelled by their place in the ranking.
+func beatpathDOT(title string, cands []Candidate, ranks [][]int, pairwise [][]int) string {
+  var dot bytes.Buffer
+  fmt.Fprintf(&dot, "digraph beatpath {\n  label=%s;\n", dotQuote(title))
+  place := 1
+  for _, tier := range ranks {
+    for _, c := range tier {
+      fmt.Fprintf(&dot, "  c%d [label=%s];\n", c, dotQuote(fmt.Sprintf("%d. %s", place, cands[c].Name)))
+    }
+    place += len(tier)
+  }
+  for _, edge := range beatpathEdges(pairwise) {
+    style := ""
+    if !edge.Direct {
+      style = ", style=dashed"
+    }
+    fmt.Fprintf(&dot, "  c%d -> c%d [label=\"%d\"%s];\n", edge.From, edge.To, edge.Strength, style)
+  }
+  dot.WriteString("}\n")
+  return dot.String()
+}
+
+// Serves the beatpath graph of one question of an election, given by its
+// position on the ballot, as a Graphviz file.
+func resultsDOT(w http.ResponseWriter, r *http.Request) {
+  c := appengine.NewContext(r)
+  key, e, ok := getElectionWithResults(w, r, c)
+  if !ok {
+    return
+  }
+  tallies, err := tallyQuestions(c, key, e, time.Now())
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  q := 0
+  if q_str := r.FormValue("question"); q_str != "" {
+    q, err = strconv.Atoi(q_str)
+    if err != nil || q < 0 || q >= len(tallies) {
+      http.Error(w, fmt.Sprintf("There is no question %s.", q_str), http.StatusInternalServerError)
+      return
+    }
+  }
+  t := tallies[q]
+  if t.Pairwise == nil || t.Election.ballotKind().Method != methodSchulze {
+    http.Error(w, "There is no beatpath graph for this question yet.", http.StatusInternalServerError)
+    return
+  }
+  w.Header().Set("Content-Type", "text/vnd.graphviz")
+  w.Header().Set("Content-Disposition", `attachment; filename="results.dot"`)
+  fmt.Fprint(w, beatpathDOT(t.Title, t.Candidates, t.Ranks, t.Pairwise))
+}
@@ -0,0 +1,57 @@
+package vote
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestBeatpathEdges(t *testing.T) {
+  tests := []struct {
+    name     string
+    pairwise [][]int
+    want     []beatpathEdge
+  }{
+    {
+      name: "chain of defeats, strongest first",
+      pairwise: [][]int{
+        {0, 6, 7},
+        {4, 0, 8},
+        {3, 2, 0},
+      },
+      want: []beatpathEdge{{1, 2, 8, true}, {0, 2, 7, true}, {0, 1, 6, true}},
+    },
+    {
+      name: "defeat only through a chain",
+      pairwise: [][]int{
+        {0, 6, 5},
+        {4, 0, 7},
+        {5, 3, 0},
+      },
+      want: []beatpathEdge{{1, 2, 7, true}, {0, 1, 6, true}, {0, 2, 6, false}},
+    },
+    {
+      name:     "tie",
+      pairwise: [][]int{{0, 5}, {5, 0}},
+    },
+  }
+  for _, test := range tests {
+    if got := beatpathEdges(test.pairwise); !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: beatpathEdges = %v, want %v", test.name, got, test.want)
+    }
+  }
+}
+
+func TestDotQuote(t *testing.T) {
+  tests := []struct {
+    in, want string
+  }{
+    {"Alice", `"Alice"`},
+    {`Say "hi"`, `"Say \"hi\""`},
+    {`back\slash`, `"back\\slash"`},
+  }
+  for _, test := range tests {
+    if got := dotQuote(test.in); got != test.want {
+      t.Errorf("dotQuote(%q) = %s, want %s", test.in, got, test.want)
+    }
+  }
+}
@@ -0,0 +1,265 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "appengine/user"
+  "fmt"
+  "html/template"
+  "net/http"
+)
+
+func init() {
+  http.HandleFunc("/clone_election", cloneElection)
+  http.HandleFunc("/save_template", saveTemplate)
+  http.HandleFunc("/delete_template", deleteTemplate)
+}
+
+// An ElectionTemplate holds the parts of an Election that are worth reusing
+// from one election to the next.  The parent of a Candidate or a Question can
+// be an ElectionTemplate, in which case it will be copied into any Election
+// made from the template.
+type ElectionTemplate struct {
+  // key.Encode() for the key representing this ElectionTemplate.
+  Key_str string
+
+  // User.ID of the user that saved this template.
+  User_id string
+
+  // Name the user gave this template so that they can pick it out later.
+  Name string
+
+  // The Organization that elections made from this template belong to.
+  Org_key *datastore.Key
+
+  Title            string
+  Refresh_interval int64
+  Hide_results     bool
+  Visibility       string
+  Ballot_type      string
+  Max_score        int
+  Grades           []string
+  Num_candidates   int
+  Num_questions    int
+  Emails           []string
+  Weights          []int
+  Groups           []*datastore.Key
+
+  // The same as the fields of an Election with the same names.
+  Min_ballots      int
+  Noise_epsilon    float64
+  Quorum_count     int
+  Quorum_fraction  float64
+  Quorum_extension int64
+  Max_extensions   int
+  Secret_ballots   bool
+  Allow_delegation bool
+  Auto_runoff      bool
+  Runoff_duration  int64
+}
+
+// Returns a template with the reusable parts of e.
+func electionTemplateOf(e *Election) ElectionTemplate {
+  return ElectionTemplate{
+    Title:            e.Title,
+    Org_key:          e.Org_key,
+    Refresh_interval: e.Refresh_interval,
+    Hide_results:     e.Hide_results,
+    Visibility:       e.Visibility,
+    Ballot_type:      e.Ballot_type,
+    Max_score:        e.Max_score,
+    Grades:           e.Grades,
+    Num_candidates:   e.Num_candidates,
+    Num_questions:    e.Num_questions,
+    Emails:           e.Emails,
+    Weights:          e.Weights,
+    Groups:           e.Groups,
+    Min_ballots:      e.Min_ballots,
+    Noise_epsilon:    e.Noise_epsilon,
+    Quorum_count:     e.Quorum_count,
+    Quorum_fraction:  e.Quorum_fraction,
+    Quorum_extension: e.Quorum_extension,
+    Max_extensions:   e.Max_extensions,
+    Secret_ballots:   e.Secret_ballots,
+    Allow_delegation: e.Allow_delegation,
+    Auto_runoff:      e.Auto_runoff,
+    Runoff_duration:  e.Runoff_duration,
+  }
+}
+
+// Shows the election form filled out the same way as an existing election.
+// Candidate images are shared with the original election rather than copied.
+// The questions after the first are copied once the new election is made.
+func cloneElection(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  key, e, cands, ok := getElectionFor(w, r, c, u, permManage)
+  if !ok {
+    return
+  }
+  t := electionTemplateOf(e)
+  data := makeElectionFormData(&t, cands)
+  data.Source = key.Encode()
+  showElectionForm(w, c, u, data)
+}
+
+// Returns the key of the Election or ElectionTemplate that the election form
+// was filled in from, or nil if it started out blank.  u has to be able to
+// manage the election, or have saved the template.
+func formSource(c appengine.Context, u *user.User, source string) (*datastore.Key, error) {
+  if source == "" {
+    return nil, nil
+  }
+  key, err := datastore.DecodeKey(source)
+  if err != nil {
+    return nil, err
+  }
+  switch key.Kind() {
+  case "ElectionTemplate":
+    var t ElectionTemplate
+    err = datastore.Get(c, key, &t)
+    if err != nil {
+      return nil, err
+    }
+    if t.User_id != u.ID {
+      return nil, &electionError{"You can only use templates that you have saved."}
+    }
+  case "Election":
+    var e Election
+    err = datastore.Get(c, key, &e)
+    if err != nil {
+      return nil, err
+    }
+    a, err := electionAccess(c, key, &e, u)
+    if err != nil {
+      return nil, err
+    }
+    if !a.can(permManage) {
+      return nil, &electionError{permissionErrors[permManage]}
+    }
+  default:
+    return nil, &electionError{fmt.Sprintf("Can't make an election from a %s.", key.Kind())}
+  }
+  return key, nil
+}
+
+// Returns the images of the candidates of source, the Election or
+// ElectionTemplate an election form was filled in from.
+func sourceImages(c appengine.Context, source *datastore.Key) (map[appengine.BlobKey]bool, error) {
+  images := make(map[appengine.BlobKey]bool)
+  if source == nil {
+    return images, nil
+  }
+  var cands []Candidate
+  _, err := datastore.NewQuery("Candidate").Ancestor(source).GetAll(c, &cands)
+  if err != nil {
+    return nil, err
+  }
+  for _, cand := range cands {
+    if cand.Image != "" {
+      images[cand.Image] = true
+    }
+  }
+  return images, nil
+}
+
+func saveTemplate(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  election_key, e, cands, ok := getElectionFor(w, r, c, u, permManage)
+  if !ok {
+    return
+  }
+  name := r.FormValue("name")
+  if name == "" {
+    name = e.Title
+  }
+  t := electionTemplateOf(e)
+  t.User_id = u.ID
+  t.Name = name
+  key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "ElectionTemplate", nil), &t)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  t.Key_str = key.Encode()
+  t.Num_questions, err = copyQuestions(c, election_key, key)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  _, err = datastore.Put(c, key, &t)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  for i := range cands {
+    _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Candidate", key), &cands[i])
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+  }
+  fmt.Fprintf(w, `Saved template "%s".  <a href="/election?template=%s">Make an election from it</a>.`, template.HTMLEscapeString(name), key.Encode())
+}
+
+func deleteTemplate(w http.ResponseWriter, r *http.Request) {
+  c := appengine.NewContext(r)
+  u := user.Current(c)
+  if u == nil {
+    url, err := user.LoginURL(c, r.URL.String())
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    http.Redirect(w, r, url, http.StatusFound)
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  key, err := datastore.DecodeKey(r.FormValue("template"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  var t ElectionTemplate
+  err = datastore.Get(c, key, &t)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if t.User_id != u.ID {
+    http.Error(w, "You can only delete templates that you have saved.", http.StatusInternalServerError)
+    return
+  }
+  // The candidates' images are left alone since elections made from this
+  // template may still be using them.
+  cand_keys, err := datastore.NewQuery("Candidate").Ancestor(key).KeysOnly().GetAll(c, nil)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  question_keys, err := datastore.NewQuery("Question").Ancestor(key).KeysOnly().GetAll(c, nil)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  err = datastore.DeleteMulti(c, append(append(cand_keys, question_keys...), key))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  http.Redirect(w, r, "/election", http.StatusFound)
+}
@@ -0,0 +1,487 @@
+package vote
+
+import (
+  "appengine"
+  "fmt"
+  "html/template"
+  "net/http"
+  "sort"
+  "strings"
+  "time"
+)
+
+func init() {
+  http.HandleFunc("/compare_results", compareResults)
+}
+
+// The names of the counting methods, see countingMethods.
+const (
+  methodSchulze   = "Schulze"
+  methodCopeland  = "Copeland"
+  methodMinimax   = "Minimax"
+  methodBorda     = "Borda"
+  methodPlurality = "Plurality"
+  methodIRV       = "Instant runoff"
+  methodApproval  = "Approval"
+  methodScore     = "Score"
+  methodStar      = "STAR"
+  methodJudgment  = "Majority Judgment"
+)
+
+// A way of counting ballots, which can be run over the ballots of any
+// question it applies to, whatever the question was actually counted with.
+type countingMethod struct {
+  Name string
+
+  // The kinds of ballot that have what this method needs.  If nil then the
+  // method works on every kind of ballot, using the order of the candidates
+  // that each ballot implies, see impliedOrdering.
+  Kinds []string
+
+  // Ranks the candidates into tiers, best first.
+  Rank func(e *Election, num_candidates int, ballots []Ballot) [][]int
+}
+
+var countingMethods = []countingMethod{
+  {methodSchulze, nil, func(e *Election, n int, ballots []Ballot) [][]int {
+    return schulzeRanking(impliedPairwise(e, n, ballots))
+  }},
+  {methodCopeland, nil, rankCopeland},
+  {methodMinimax, nil, rankMinimax},
+  {methodBorda, nil, rankBorda},
+  {methodPlurality, nil, rankPlurality},
+  {methodIRV, nil, rankInstantRunoff},
+  {methodApproval, []string{ballotApproval}, func(e *Election, n int, ballots []Ballot) [][]int {
+    ranks, _ := rankScores(countScores(e, n, ballots))
+    return ranks
+  }},
+  {methodScore, []string{ballotScore, ballotStar}, func(e *Election, n int, ballots []Ballot) [][]int {
+    ranks, _ := rankScores(countScores(e, n, ballots))
+    return ranks
+  }},
+  {methodStar, []string{ballotScore, ballotStar}, func(e *Election, n int, ballots []Ballot) [][]int {
+    counts := countScores(e, n, ballots)
+    counts.Pairwise = scorePairwise(e, n, ballots)
+    ranks, _ := rankStar(counts)
+    return ranks
+  }},
+  {methodJudgment, []string{ballotJudgment}, func(e *Election, n int, ballots []Ballot) [][]int {
+    ranks, _ := rankGrades(countGrades(e, n, ballots))
+    return ranks
+  }},
+}
+
+// Returns whether m can count the ballots of e.
+func (m *countingMethod) appliesTo(e *Election) bool {
+  if m.Kinds == nil {
+    return true
+  }
+  kind := e.Ballot_type
+  if _, ok := ballotKinds[kind]; !ok {
+    kind = ballotRanked
+  }
+  for _, k := range m.Kinds {
+    if k == kind {
+      return true
+    }
+  }
+  return false
+}
+
+// Returns the order of the candidates that b puts them in, where lower is
+// better and num_candidates is worse than anyone that was ranked.  Higher
+// scores are better, and so are lower grades.  Returns nil if b doesn't fit
+// the question.
+func impliedOrdering(e *Election, num_candidates int, b *Ballot) []int {
+  ordering := make([]int, num_candidates)
+  switch {
+  case len(b.Ordering) == num_candidates:
+    for i, rank := range b.Ordering {
+      if rank < 0 {
+        rank = num_candidates
+      }
+      ordering[i] = rank
+    }
+  case len(b.Scores) == num_candidates:
+    for i, score := range b.Scores {
+      if e.Ballot_type == ballotJudgment {
+        ordering[i] = score
+      } else {
+        ordering[i] = e.maxScore() - score
+      }
+    }
+  default:
+    return nil
+  }
+  return ordering
+}
+
+// The pairwise matrix of the orders that ballots imply.  Unlike pairwiseGraph
+// this leaves ballots alone.
+func impliedPairwise(e *Election, n int, ballots []Ballot) [][]int {
+  graph := make([][]int, n)
+  for i := range graph {
+    graph[i] = make([]int, n)
+  }
+  for i := range ballots {
+    ordering := impliedOrdering(e, n, &ballots[i])
+    if ordering == nil {
+      continue
+    }
+    weight := e.VoterWeight(ballots[i].Email)
+    for a := range ordering {
+      for b := range ordering {
+        if ordering[a] < ordering[b] {
+          graph[a][b] += weight
+        }
+      }
+    }
+  }
+  return graph
+}
+
+// Ranks candidates by how many head to head contests they win, less how
+// many they lose.
+func rankCopeland(e *Election, n int, ballots []Ballot) [][]int {
+  pairwise := impliedPairwise(e, n, ballots)
+  totals := make([]int, n)
+  for i := range pairwise {
+    for j := range pairwise {
+      if pairwise[i][j] > pairwise[j][i] {
+        totals[i]++
+      }
+      if pairwise[i][j] < pairwise[j][i] {
+        totals[i]--
+      }
+    }
+  }
+  return rankByTotals(allCandidates(n), totals)
+}
+
+// Ranks candidates by their worst head to head defeat, where a smaller
+// margin of defeat is better.
+func rankMinimax(e *Election, n int, ballots []Ballot) [][]int {
+  pairwise := impliedPairwise(e, n, ballots)
+  totals := make([]int, n)
+  for i := range pairwise {
+    for j := range pairwise {
+      // Totals are ranked highest first, so the worst defeat is negated.
+      totals[i] = min(totals[i], pairwise[i][j]-pairwise[j][i])
+    }
+  }
+  return rankByTotals(allCandidates(n), totals)
+}
+
+// Gives each candidate a point for every candidate a ballot puts below them,
+// which is the same as the total of their row of the pairwise matrix.
+func rankBorda(e *Election, n int, ballots []Ballot) [][]int {
+  pairwise := impliedPairwise(e, n, ballots)
+  totals := make([]int, n)
+  for i := range pairwise {
+    for j := range pairwise {
+      totals[i] += pairwise[i][j]
+    }
+  }
+  return rankByTotals(allCandidates(n), totals)
+}
+
+// Returns the candidate that ordering puts first out of the ones that are
+// still in, or -1 if there is no single first choice among them.
+func firstChoice(ordering []int, in []bool) int {
+  first := -1
+  tied := false
+  for i, rank := range ordering {
+    if !in[i] {
+      continue
+    }
+    switch {
+    case first == -1 || rank < ordering[first]:
+      first = i
+      tied = false
+    case rank == ordering[first]:
+      tied = true
+    }
+  }
+  if tied {
+    return -1
+  }
+  return first
+}
+
+// Counts the weight of the ballots whose first choice, out of the candidates
+// that are in, is each candidate.  Ballots with a tie for first don't count.
+func firstChoices(e *Election, n int, ballots []Ballot, in []bool) []int {
+  totals := make([]int, n)
+  for i := range ballots {
+    ordering := impliedOrdering(e, n, &ballots[i])
+    if ordering == nil {
+      continue
+    }
+    if first := firstChoice(ordering, in); first >= 0 {
+      totals[first] += e.VoterWeight(ballots[i].Email)
+    }
+  }
+  return totals
+}
+
+func rankPlurality(e *Election, n int, ballots []Ballot) [][]int {
+  in := make([]bool, n)
+  for i := range in {
+    in[i] = true
+  }
+  return rankByTotals(allCandidates(n), firstChoices(e, n, ballots, in))
+}
+
+// Eliminates the candidates with the fewest first choices, all of them at
+// once if they are tied, and moves their ballots on to the next choice that
+// is still in, until nobody is left.  Candidates are ranked in the reverse
+// of the order they were eliminated in.
+func rankInstantRunoff(e *Election, n int, ballots []Ballot) [][]int {
+  in := make([]bool, n)
+  for i := range in {
+    in[i] = true
+  }
+  var eliminated [][]int
+  for left := n; left > 0; {
+    totals := firstChoices(e, n, ballots, in)
+    fewest := -1
+    for i := range totals {
+      if in[i] && (fewest == -1 || totals[i] < fewest) {
+        fewest = totals[i]
+      }
+    }
+    var out []int
+    for i := range totals {
+      if in[i] && totals[i] == fewest {
+        out = append(out, i)
+      }
+    }
+    for _, i := range out {
+      in[i] = false
+    }
+    left -= len(out)
+    eliminated = append(eliminated, out)
+  }
+  var ranks [][]int
+  for i := len(eliminated) - 1; i >= 0; i-- {
+    ranks = append(ranks, eliminated[i])
+  }
+  return ranks
+}
+
+// The outcome of one counting method on the comparison page.
+type methodResult struct {
+  Method string
+
+  // Set for the method the question is actually counted with.
+  Official bool
+
+  Tiers [][]Candidate
+
+  // Whether this method picks the same winners as the official method, and
+  // whether it puts every candidate in the same order.
+  Same_winners bool
+  Same_order   bool
+}
+
+// Where each method places one candidate, in the order of
+// methodComparison.Methods.  Candidates that are tied share a place.
+type candidatePlaces struct {
+  Candidate Candidate
+  Places    []int
+}
+
+type methodComparison struct {
+  Title    string
+  Official string
+  Methods  []methodResult
+  Places   []candidatePlaces
+  Summary  []string
+}
+
+// Returns a string that is the same for two rankings exactly when they put
+// the candidates in the same tiers.
+func rankingKey(ranks [][]int) string {
+  var tiers []string
+  for _, tier := range ranks {
+    sorted := append([]int(nil), tier...)
+    sort.Ints(sorted)
+    tiers = append(tiers, fmt.Sprint(sorted))
+  }
+  return strings.Join(tiers, ">")
+}
+
+func rankTiers(cands []Candidate, ranks [][]int) [][]Candidate {
+  var tiers [][]Candidate
+  for _, tier := range ranks {
+    var names []Candidate
+    for _, i := range tier {
+      names = append(names, cands[i])
+    }
+    tiers = append(tiers, names)
+  }
+  return tiers
+}
+
+// Runs every method that applies to q over its ballots and compares what
+// they come up with.
+func compareMethods(q *countedQuestion) methodComparison {
+  e := q.Election
+  n := len(q.Candidates)
+  cmp := methodComparison{Title: q.Title, Official: e.ballotKind().Method}
+  places := make([][]int, n)
+  var official [][]int
+  var rankings [][][]int
+  for i := range countingMethods {
+    m := &countingMethods[i]
+    if !m.appliesTo(e) {
+      continue
+    }
+    ranks := m.Rank(e, n, q.Ballots)
+    if m.Name == cmp.Official {
+      official = ranks
+    }
+    rankings = append(rankings, ranks)
+    cmp.Methods = append(cmp.Methods, methodResult{
+      Method:   m.Name,
+      Official: m.Name == cmp.Official,
+      Tiers:    rankTiers(q.Candidates, ranks),
+    })
+    place := 1
+    for _, tier := range ranks {
+      for _, c := range tier {
+        places[c] = append(places[c], place)
+      }
+      place += len(tier)
+    }
+  }
+  for i := range q.Candidates {
+    cmp.Places = append(cmp.Places, candidatePlaces{q.Candidates[i], places[i]})
+  }
+  if len(official) == 0 {
+    return cmp
+  }
+
+  // Methods are grouped by the winners they pick, in the order that each
+  // group first comes up.
+  var winner_keys []string
+  by_winners := make(map[string][]string)
+  winners := make(map[string][]Candidate)
+  same_order := 0
+  for i, ranks := range rankings {
+    m := &cmp.Methods[i]
+    var top []int
+    if len(ranks) > 0 {
+      top = ranks[0]
+    }
+    key := rankingKey([][]int{top})
+    m.Same_winners = key == rankingKey(official[:1])
+    m.Same_order = rankingKey(ranks) == rankingKey(official)
+    if m.Same_order && !m.Official {
+      same_order++
+    }
+    if _, ok := by_winners[key]; !ok {
+      winner_keys = append(winner_keys, key)
+      if len(ranks) > 0 {
+        winners[key] = m.Tiers[0]
+      }
+    }
+    by_winners[key] = append(by_winners[key], m.Method)
+  }
+  if len(winner_keys) == 1 {
+    cmp.Summary = append(cmp.Summary, fmt.Sprintf("Every method has %s winning.", joinNames(winners[winner_keys[0]])))
+  } else {
+    cmp.Summary = append(cmp.Summary, "The methods don't agree on the winner:")
+    for _, key := range winner_keys {
+      cmp.Summary = append(cmp.Summary, fmt.Sprintf("%s under %s.", joinNames(winners[key]), strings.Join(by_winners[key], ", ")))
+    }
+  }
+  cmp.Summary = append(cmp.Summary, fmt.Sprintf("%d of the other %d methods put every candidate in the same order as %s.",
+    same_order, len(rankings)-1, cmp.Official))
+  return cmp
+}
+
+type compareTemplateData struct {
+  Election  Election
+  Questions []methodComparison
+  Multiple  bool
+}
+
+var compareTemplate = template.Must(template.New("compare").Parse(compareTemplateHTML))
+
+const compareTemplateHTML = `
+  <body>
+    {{.Election.Title}}: the same ballots counted with every method that can
+    count them.<br/>
+    {{range .Questions}}
+      {{$q := .}}
+      {{if $.Multiple}}<h3>{{$q.Title}}</h3>{{end}}
+      <table border="1">
+        <tr><td>Method</td><td>Winner</td><td>Order</td><td>Same winner as {{$q.Official}}</td><td>Same order as {{$q.Official}}</td></tr>
+        {{range $q.Methods}}
+          <tr>
+            <td>{{if .Official}}<b>{{.Method}}</b> (used){{else}}{{.Method}}{{end}}</td>
+            <td>{{range $i,$tier := .Tiers}}{{if not $i}}{{range $j,$cand := $tier}}{{if $j}} = {{end}}{{$cand.Name}}{{end}}{{end}}{{end}}</td>
+            <td>
+              {{range $i,$tier := .Tiers}}
+                {{if $i}}&gt;{{end}}
+                {{range $j,$cand := $tier}}{{if $j}} = {{end}}{{$cand.Name}}{{end}}
+              {{end}}
+            </td>
+            <td>{{if .Official}}-{{else}}{{if .Same_winners}}yes{{else}}<b>no</b>{{end}}{{end}}</td>
+            <td>{{if .Official}}-{{else}}{{if .Same_order}}yes{{else}}<b>no</b>{{end}}{{end}}</td>
+          </tr>
+        {{end}}
+      </table>
+      <br/>
+      Where each method places each candidate:
+      <table border="1">
+        <tr><td></td>{{range $q.Methods}}<td>{{.Method}}</td>{{end}}</tr>
+        {{range $q.Places}}
+          <tr><td>{{.Candidate.Name}}</td>{{range .Places}}<td>{{.}}</td>{{end}}</tr>
+        {{end}}
+      </table>
+      <p>
+      {{range $q.Summary}}
+        {{.}}<br/>
+      {{end}}
+      </p>
+    {{end}}
+    <a href="/view_results?key={{.Election.Key_str}}">Back to the results</a>
+  </body>
+`
+
+// Shows what every question would have come out as under each counting
+// method.  The methods have to see the actual ballots, and most of them work
+// from the pairwise counts, so this isn't available until voting has closed.
+func compareResults(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c := appengine.NewContext(r)
+  key, e, ok := getElectionWithResults(w, r, c)
+  if !ok {
+    return
+  }
+  now := time.Now()
+  if now.Before(e.End) {
+    http.Error(w, "Results can't be compared until voting is closed.", http.StatusInternalServerError)
+    return
+  }
+  questions, err := countedQuestions(c, key, e, now)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if e.Min_ballots > 0 && len(questions[0].Ballots) < e.Min_ballots {
+    http.Error(w, fmt.Sprintf("Results can't be compared until at least %d ballots have been cast.", e.Min_ballots), http.StatusInternalServerError)
+    return
+  }
+  data := compareTemplateData{Election: *e, Multiple: len(questions) > 1}
+  for i := range questions {
+    data.Questions = append(data.Questions, compareMethods(&questions[i]))
+  }
+  err = compareTemplate.Execute(w, data)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+  }
+}
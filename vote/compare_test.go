@@ -0,0 +1,74 @@
+package vote
+
+import (
+  "reflect"
+  "testing"
+)
+
+// Returns count copies of a ranked ballot from email, where ordering gives
+// the rank of each candidate, best first.
+func rankedBallots(count int, email string, ordering ...int) []Ballot {
+  var ballots []Ballot
+  for i := 0; i < count; i++ {
+    ballots = append(ballots, Ballot{Email: email, Ordering: ordering})
+  }
+  return ballots
+}
+
+func TestCountingMethods(t *testing.T) {
+  // A has the most first choices, but C beats everyone head to head.
+  var split []Ballot
+  split = append(split, rankedBallots(8, "", 0, 2, 1)...)
+  split = append(split, rankedBallots(7, "", 1, 2, 0)...)
+  split = append(split, rankedBallots(6, "", 2, 0, 1)...)
+
+  weighted := &Election{Emails: []string{"heavy@x", "light@x"}, Weights: []int{3, 1}}
+  var heavy []Ballot
+  heavy = append(heavy, rankedBallots(1, "heavy@x", 1, 0, 2)...)
+  heavy = append(heavy, rankedBallots(2, "light@x", 0, 1, 2)...)
+
+  // Two ballots with a tie for first, which plurality doesn't count.
+  var tied []Ballot
+  tied = append(tied, rankedBallots(2, "", 0, 0, 1)...)
+  tied = append(tied, rankedBallots(1, "", 1, 0, 2)...)
+
+  tests := []struct {
+    name    string
+    e       *Election
+    rank    func(e *Election, n int, ballots []Ballot) [][]int
+    ballots []Ballot
+    want    [][]int
+  }{
+    {"plurality", &Election{}, rankPlurality, split, [][]int{{0}, {2}, {1}}},
+    {"instant runoff", &Election{}, rankInstantRunoff, split, [][]int{{2}, {0}, {1}}},
+    {"Copeland", &Election{}, rankCopeland, split, [][]int{{2}, {0}, {1}}},
+    {"minimax", &Election{}, rankMinimax, split, [][]int{{2}, {0}, {1}}},
+    {"Borda", &Election{}, rankBorda, split, [][]int{{2}, {0}, {1}}},
+    {"weighted plurality", weighted, rankPlurality, heavy, [][]int{{1}, {0}, {2}}},
+    {"weighted Borda", weighted, rankBorda, heavy, [][]int{{1}, {0}, {2}}},
+    {"plurality skips ties for first", &Election{}, rankPlurality, tied, [][]int{{1}, {0, 2}}},
+    {"instant runoff drops ties together", &Election{}, rankInstantRunoff, tied, [][]int{{1}, {0, 2}}},
+  }
+  for _, test := range tests {
+    if got := test.rank(test.e, 3, test.ballots); !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: ranked %v, want %v", test.name, got, test.want)
+    }
+  }
+}
+
+func TestImpliedOrdering(t *testing.T) {
+  tests := []struct {
+    name   string
+    e      *Election
+    ballot Ballot
+    want   []int
+  }{
+    {"ranked, with one left unranked", &Election{}, Ballot{Ordering: []int{1, -1, 0}}, []int{1, 3, 0}},
+    {"scores", &Election{Ballot_type: ballotScore, Max_score: 5}, Ballot{Scores: []int{5, 2, 2}}, []int{0, 3, 3}},
+  }
+  for _, test := range tests {
+    if got := impliedOrdering(test.e, 3, &test.ballot); !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: impliedOrdering = %v, want %v", test.name, got, test.want)
+    }
+  }
+}
@@ -0,0 +1,216 @@
+package vote
+
+import (
+  "fmt"
+)
+
+// What the pairwise counts of an election say about it, apart from how the
+// candidates were ranked.  Candidate i beats candidate j if more votes
+// preferred i to j than preferred j to i.
+type condorcetReport struct {
+  // The candidate that beats everyone else, and the candidate that everyone
+  // else beats, if there are such candidates.
+  Winner string `json:"winner,omitempty"`
+  Loser  string `json:"loser,omitempty"`
+
+  // The smallest set of candidates that each beat everyone outside of it.
+  Smith []string `json:"smith"`
+
+  // The candidates that nobody beats, directly or through a chain of wins,
+  // without being beaten back the same way.
+  Schwartz []string `json:"schwartz"`
+
+  // Majority cycles, such as A beats B, B beats C and C beats A.  Each cycle
+  // is listed in order, and the last candidate beats the first.
+  Cycles [][]string `json:"cycles,omitempty"`
+
+  // The report in plain language.
+  Explanation []string `json:"explanation"`
+}
+
+// Returns reach, where reach[i][j] is true if i can get to j by following
+// edges, starting with the edges given by edge.
+func transitiveClosure(n int, edge func(i, j int) bool) [][]bool {
+  reach := make([][]bool, n)
+  for i := range reach {
+    reach[i] = make([]bool, n)
+    for j := range reach[i] {
+      reach[i][j] = i == j || edge(i, j)
+    }
+  }
+  for k := 0; k < n; k++ {
+    for i := 0; i < n; i++ {
+      for j := 0; j < n; j++ {
+        if reach[i][k] && reach[k][j] {
+          reach[i][j] = true
+        }
+      }
+    }
+  }
+  return reach
+}
+
+func candidateNames(cands []Candidate, indices []int) []string {
+  var names []string
+  for _, i := range indices {
+    names = append(names, cands[i].Name)
+  }
+  return names
+}
+
+func namesOf(cands []Candidate, indices []int) string {
+  var chosen []Candidate
+  for _, i := range indices {
+    chosen = append(chosen, cands[i])
+  }
+  return joinNames(chosen)
+}
+
+// Finds a cycle of wins through each group of candidates that beat each
+// other around in a circle.
+func majorityCycles(n int, beats func(i, j int) bool, reach [][]bool) [][]int {
+  var cycles [][]int
+  done := make([]bool, n)
+  for start := 0; start < n; start++ {
+    if done[start] {
+      continue
+    }
+    // The candidates that start can get to and back from are one strongly
+    // connected group.
+    var group []int
+    in_group := make([]bool, n)
+    for j := 0; j < n; j++ {
+      if reach[start][j] && reach[j][start] {
+        group = append(group, j)
+        in_group[j] = true
+        done[j] = true
+      }
+    }
+    if len(group) < 3 {
+      continue
+    }
+    // Every candidate in the group beats someone else in it, so following
+    // wins around the group has to come back to a candidate already seen.
+    seen := make(map[int]int)
+    var path []int
+    c := start
+    for {
+      if at, ok := seen[c]; ok {
+        cycles = append(cycles, path[at:])
+        break
+      }
+      seen[c] = len(path)
+      path = append(path, c)
+      for _, next := range group {
+        if beats(c, next) {
+          c = next
+          break
+        }
+      }
+    }
+  }
+  return cycles
+}
+
+// Works out the condorcetReport for the candidates with the given pairwise
+// counts.  Returns nil if there are no pairwise counts.
+func condorcetAnalysis(cands []Candidate, pairwise [][]int) *condorcetReport {
+  n := len(pairwise)
+  if n == 0 || len(cands) != n {
+    return nil
+  }
+  beats := func(i, j int) bool { return pairwise[i][j] > pairwise[j][i] }
+  beats_or_ties := func(i, j int) bool { return pairwise[i][j] >= pairwise[j][i] }
+  report := &condorcetReport{}
+
+  winner, loser := -1, -1
+  for i := 0; i < n; i++ {
+    wins, losses := 0, 0
+    for j := 0; j < n; j++ {
+      if beats(i, j) {
+        wins++
+      }
+      if beats(j, i) {
+        losses++
+      }
+    }
+    if wins == n-1 {
+      winner = i
+    }
+    if losses == n-1 {
+      loser = i
+    }
+  }
+
+  // Members of the Smith set can get to everyone through a chain of wins and
+  // ties.
+  weak := transitiveClosure(n, beats_or_ties)
+  var smith []int
+  for i := 0; i < n; i++ {
+    all := true
+    for j := 0; j < n; j++ {
+      all = all && weak[i][j]
+    }
+    if all {
+      smith = append(smith, i)
+    }
+  }
+
+  // Members of the Schwartz set can get back, through a chain of wins, to
+  // anyone that can get to them.
+  strong := transitiveClosure(n, beats)
+  var schwartz []int
+  for i := 0; i < n; i++ {
+    undominated := true
+    for j := 0; j < n; j++ {
+      if strong[j][i] && !strong[i][j] {
+        undominated = false
+      }
+    }
+    if undominated {
+      schwartz = append(schwartz, i)
+    }
+  }
+
+  report.Smith = candidateNames(cands, smith)
+  report.Schwartz = candidateNames(cands, schwartz)
+  if winner >= 0 {
+    report.Winner = cands[winner].Name
+    report.Explanation = append(report.Explanation, fmt.Sprintf(
+      "%s is the Condorcet winner: for every other candidate, more voters preferred %s to them than the other way around.",
+      cands[winner].Name, cands[winner].Name))
+  } else {
+    report.Explanation = append(report.Explanation,
+      "There is no Condorcet winner: no candidate was preferred by more voters to every other candidate.")
+  }
+  if loser >= 0 && n > 1 {
+    report.Loser = cands[loser].Name
+    report.Explanation = append(report.Explanation, fmt.Sprintf(
+      "%s is the Condorcet loser: every other candidate was preferred to %s by more voters than the other way around.",
+      cands[loser].Name, cands[loser].Name))
+  }
+  if winner < 0 {
+    report.Explanation = append(report.Explanation, fmt.Sprintf(
+      "The Smith set, the smallest group of candidates that each beat everyone outside the group, is %s.",
+      namesOf(cands, smith)))
+    report.Explanation = append(report.Explanation, fmt.Sprintf(
+      "The Schwartz set, the candidates that nobody beats without being beaten back, directly or through a chain of wins, is %s.",
+      namesOf(cands, schwartz)))
+  }
+  for _, cycle := range majorityCycles(n, beats, strong) {
+    report.Cycles = append(report.Cycles, candidateNames(cands, cycle))
+    var steps string
+    for k, c := range cycle {
+      switch {
+      case k == 0:
+      case k == len(cycle)-1:
+        steps += " and "
+      default:
+        steps += ", "
+      }
+      steps += fmt.Sprintf("%s beats %s", cands[c].Name, cands[cycle[(k+1)%len(cycle)]].Name)
+    }
+    report.Explanation = append(report.Explanation, fmt.Sprintf("There is a majority cycle: %s.", steps))
+  }
+  return report
+}
@@ -0,0 +1,79 @@
+package vote
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestCondorcetAnalysis(t *testing.T) {
+  cands := []Candidate{{Name: "A"}, {Name: "B"}, {Name: "C"}, {Name: "D"}}
+  tests := []struct {
+    name     string
+    pairwise [][]int
+
+    winner, loser string
+    smith         []string
+    schwartz      []string
+    cycles        [][]string
+  }{
+    {
+      name: "Condorcet winner and loser",
+      pairwise: [][]int{
+        {0, 6, 6},
+        {4, 0, 6},
+        {4, 4, 0},
+      },
+      winner:   "A",
+      loser:    "C",
+      smith:    []string{"A"},
+      schwartz: []string{"A"},
+    },
+    {
+      name: "cycle above a loser",
+      pairwise: [][]int{
+        {0, 6, 4, 9},
+        {4, 0, 6, 9},
+        {6, 4, 0, 9},
+        {1, 1, 1, 0},
+      },
+      loser:    "D",
+      smith:    []string{"A", "B", "C"},
+      schwartz: []string{"A", "B", "C"},
+      cycles:   [][]string{{"A", "B", "C"}},
+    },
+    {
+      name: "ties make the Smith set bigger than the Schwartz set",
+      pairwise: [][]int{
+        {0, 5, 5},
+        {5, 0, 6},
+        {5, 4, 0},
+      },
+      smith:    []string{"A", "B", "C"},
+      schwartz: []string{"A", "B"},
+    },
+    {
+      name:     "everyone tied",
+      pairwise: [][]int{{0, 5}, {5, 0}},
+      smith:    []string{"A", "B"},
+      schwartz: []string{"A", "B"},
+    },
+  }
+  for _, test := range tests {
+    report := condorcetAnalysis(cands[:len(test.pairwise)], test.pairwise)
+    if report.Winner != test.winner || report.Loser != test.loser {
+      t.Errorf("%s: winner %q and loser %q, want %q and %q", test.name, report.Winner, report.Loser, test.winner, test.loser)
+    }
+    if !reflect.DeepEqual(report.Smith, test.smith) || !reflect.DeepEqual(report.Schwartz, test.schwartz) {
+      t.Errorf("%s: Smith set %v and Schwartz set %v, want %v and %v", test.name, report.Smith, report.Schwartz, test.smith, test.schwartz)
+    }
+    if !reflect.DeepEqual(report.Cycles, test.cycles) {
+      t.Errorf("%s: cycles %v, want %v", test.name, report.Cycles, test.cycles)
+    }
+    if len(report.Explanation) == 0 {
+      t.Errorf("%s: no explanation", test.name)
+    }
+  }
+  if report := condorcetAnalysis(cands, nil); report != nil {
+    t.Errorf("condorcetAnalysis with no pairwise counts = %+v, want nil", report)
+  }
+}
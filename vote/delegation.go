@@ -0,0 +1,259 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "html/template"
+  "net/http"
+  "sort"
+  "strings"
+  "time"
+)
+
+func init() {
+  http.HandleFunc("/delegate", delegate)
+}
+
+// The parent of a Delegation is the Election it is part of.  A Delegation
+// stands in for a Ballot: whichever of a voter's latest viewable Ballot and
+// latest viewable Delegation is newer is the one that counts.
+type Delegation struct {
+  // User.ID and User.Email of the user that is delegating their vote.
+  User_id string
+  Email   string
+
+  // Email of the voter that is being trusted with the vote.
+  Delegate_email string
+
+  // Same as for a Ballot, so that delegating doesn't show up in the results
+  // any sooner than voting would.
+  Time     time.Time
+  Viewable time.Time
+}
+
+// Returns the most recent Delegation made by each user in the Election with
+// the given key, ignoring any that aren't viewable as of now.
+func latestDelegations(c appengine.Context, key *datastore.Key, now time.Time) ([]Delegation, error) {
+  query := datastore.NewQuery("Delegation")
+  query = query.Ancestor(key).Order("User_id")
+
+  var delegations []Delegation
+  it := query.Run(c)
+  for {
+    var d Delegation
+    _, err := it.Next(&d)
+    if err == datastore.Done {
+      break
+    }
+    if err != nil {
+      return nil, err
+    }
+    if !d.Viewable.Before(now) {
+      continue
+    }
+    last := len(delegations) - 1
+    if last >= 0 && delegations[last].User_id == d.User_id {
+      if d.Time.After(delegations[last].Time) {
+        delegations[last] = d
+      }
+      continue
+    }
+    delegations = append(delegations, d)
+  }
+  return delegations, nil
+}
+
+// How many votes ended up with one delegate, including their own.
+type delegateCount struct {
+  Email string
+
+  // What the results show instead of Email, see voterName.
+  Name string
+
+  Votes int
+}
+
+// Returns the part of email before the @, which is as much of a voter's
+// address as is shown to everyone that can see the results.
+func voterName(email string) string {
+  if i := strings.Index(email, "@"); i >= 0 {
+    return email[:i]
+  }
+  return email
+}
+
+type delegateCounts []delegateCount
+
+func (d delegateCounts) Len() int      { return len(d) }
+func (d delegateCounts) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d delegateCounts) Less(i, j int) bool {
+  if d[i].Votes != d[j].Votes {
+    return d[i].Votes > d[j].Votes
+  }
+  return d[i].Email < d[j].Email
+}
+
+// What happened to the delegated votes in a tally.
+type delegationSummary struct {
+  // Number of votes that were counted using a delegate's ballot.
+  Delegated int
+
+  // Number of delegations that didn't lead to a ballot, either because they
+  // went around in a cycle or because the last delegate in the chain didn't
+  // vote.
+  Unresolved int
+
+  // Every voter that was trusted with at least one vote, most votes first.
+  Delegates delegateCounts
+
+  // Withheld is set if too few ballots have been cast to say anything about
+  // delegation, and Blurred is set if the counts are only approximate, see
+  // applyDisclosure.
+  Withheld bool
+  Blurred  bool
+}
+
+// Works out the ballot that counts for each voter.  A voter whose latest
+// Delegation is newer than their latest Ballot uses the ballot of whoever the
+// chain of delegates ends at, so delegation is transitive, and casting a
+// ballot after delegating overrides the delegation.  The ballots that are
+// returned for delegators have their own User_id and Email, so that they're
+// counted as the delegator's vote.  Addresses are matched ignoring case.
+func resolveDelegations(ballots []Ballot, delegations []Delegation) ([]Ballot, delegationSummary) {
+  var summary delegationSummary
+  direct := make(map[string]*Ballot)
+  for i := range ballots {
+    direct[strings.ToLower(ballots[i].Email)] = &ballots[i]
+  }
+  delegate_of := make(map[string]string)
+  var delegators []Delegation
+  for _, d := range delegations {
+    delegator := strings.ToLower(d.Email)
+    if b, ok := direct[delegator]; ok {
+      if b.Time.After(d.Time) {
+        continue
+      }
+      delete(direct, delegator)
+    }
+    delegate_of[delegator] = strings.ToLower(d.Delegate_email)
+    delegators = append(delegators, d)
+  }
+
+  var counted []Ballot
+  for i := range ballots {
+    if _, ok := direct[strings.ToLower(ballots[i].Email)]; ok {
+      counted = append(counted, ballots[i])
+    }
+  }
+  votes := make(map[string]int)
+  for _, d := range delegators {
+    seen := map[string]bool{strings.ToLower(d.Email): true}
+    email := strings.ToLower(d.Delegate_email)
+    for direct[email] == nil && !seen[email] && delegate_of[email] != "" {
+      seen[email] = true
+      email = delegate_of[email]
+    }
+    b := direct[email]
+    if b == nil {
+      summary.Unresolved++
+      continue
+    }
+    copied := *b
+    copied.User_id = d.User_id
+    copied.Email = d.Email
+    copied.Ordering = append([]int(nil), b.Ordering...)
+    copied.Scores = append([]int(nil), b.Scores...)
+    counted = append(counted, copied)
+    summary.Delegated++
+    votes[email]++
+  }
+  for email, n := range votes {
+    summary.Delegates = append(summary.Delegates, delegateCount{email, voterName(email), n + 1})
+  }
+  sort.Sort(summary.Delegates)
+  return counted, summary
+}
+
+// Returns who the user has delegated their vote to, or "" if they haven't or
+// they have since cast a ballot of their own.
+func currentDelegate(c appengine.Context, key *datastore.Key, user_id string) string {
+  var ballots []Ballot
+  _, err := datastore.NewQuery("Ballot").Ancestor(key).Filter("User_id =", user_id).Order("-Time").Limit(1).GetAll(c, &ballots)
+  if err != nil {
+    return ""
+  }
+  var delegations []Delegation
+  _, err = datastore.NewQuery("Delegation").Ancestor(key).Filter("User_id =", user_id).Order("-Time").Limit(1).GetAll(c, &delegations)
+  if err != nil || len(delegations) == 0 {
+    return ""
+  }
+  if len(ballots) > 0 && ballots[0].Time.After(delegations[0].Time) {
+    return ""
+  }
+  return delegations[0].Delegate_email
+}
+
+type delegateTemplateData struct {
+  Election       Election
+  Delegate_email string
+  Viewable       time.Time
+}
+
+var delegateTemplate = template.Must(template.New("delegate").Parse(delegateTemplateHTML))
+
+const delegateTemplateHTML = `
+  <body>
+    You have delegated your vote in {{.Election.Title}} to {{.Delegate_email}}.<br/>
+    This will take effect from {{.Viewable}}.  If you change your mind you can
+    still <a href="/ballot?key={{.Election.Key_str}}">cast your own ballot</a>,
+    which will replace this delegation.
+  </body>
+`
+
+func delegate(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  key, e, _, ok := getVotableElection(w, r, c, u)
+  if !ok {
+    return
+  }
+  if !e.Allow_delegation {
+    http.Error(w, "This election does not allow delegating your vote.", http.StatusInternalServerError)
+    return
+  }
+  delegate_email := strings.TrimSpace(r.FormValue("delegate"))
+  if delegate_email == "" || strings.EqualFold(delegate_email, u.Email) {
+    http.Error(w, "You must delegate your vote to someone other than yourself.", http.StatusInternalServerError)
+    return
+  }
+  if !e.IsEmailAllowedToVote(c, delegate_email) {
+    http.Error(w, delegate_email+" has not been listed as a participant in this election.", http.StatusInternalServerError)
+    return
+  }
+  now := time.Now().UnixNano()
+  viewable, err := viewableTime(e, now)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  d := Delegation{
+    User_id:        u.ID,
+    Email:          u.Email,
+    Delegate_email: delegate_email,
+    Time:           time.Unix(0, now),
+    Viewable:       viewable,
+  }
+  _, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Delegation", key), &d)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  delegateTemplate.Execute(w, delegateTemplateData{Election: *e, Delegate_email: delegate_email, Viewable: viewable})
+}
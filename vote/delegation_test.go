@@ -0,0 +1,120 @@
+package vote
+
+import (
+  "fmt"
+  "reflect"
+  "testing"
+  "time"
+)
+
+// Describes each counted ballot as the voter it counts for and the ordering
+// it has.
+func countedOrderings(ballots []Ballot) []string {
+  var described []string
+  for _, b := range ballots {
+    described = append(described, fmt.Sprintf("%s:%v", b.Email, b.Ordering))
+  }
+  return described
+}
+
+func TestResolveDelegations(t *testing.T) {
+  before := time.Unix(100, 0)
+  after := time.Unix(200, 0)
+  ballot := func(email string, at time.Time, ordering ...int) Ballot {
+    return Ballot{User_id: email, Email: email, Ordering: ordering, Time: at}
+  }
+  delegation := func(email, delegate string, at time.Time) Delegation {
+    return Delegation{User_id: email, Email: email, Delegate_email: delegate, Time: at}
+  }
+  tests := []struct {
+    name        string
+    ballots     []Ballot
+    delegations []Delegation
+
+    counted    []string
+    delegated  int
+    unresolved int
+    delegates  delegateCounts
+  }{
+    {
+      name:    "no delegations",
+      ballots: []Ballot{ballot("a@x", before, 0, 1), ballot("b@x", before, 1, 0)},
+      counted: []string{"a@x:[0 1]", "b@x:[1 0]"},
+    },
+    {
+      name:        "chain of delegates",
+      ballots:     []Ballot{ballot("a@x", before, 0, 1)},
+      delegations: []Delegation{delegation("c@x", "d@x", before), delegation("d@x", "a@x", before)},
+      counted:     []string{"a@x:[0 1]", "c@x:[0 1]", "d@x:[0 1]"},
+      delegated:   2,
+      delegates:   delegateCounts{{"a@x", "a", 3}},
+    },
+    {
+      name:        "voting after delegating takes the vote back",
+      ballots:     []Ballot{ballot("a@x", before, 0, 1), ballot("b@x", after, 1, 0)},
+      delegations: []Delegation{delegation("b@x", "a@x", before)},
+      counted:     []string{"a@x:[0 1]", "b@x:[1 0]"},
+    },
+    {
+      name:        "delegating after voting replaces the ballot",
+      ballots:     []Ballot{ballot("a@x", before, 0, 1), ballot("b@x", before, 1, 0)},
+      delegations: []Delegation{delegation("b@x", "a@x", after)},
+      counted:     []string{"a@x:[0 1]", "b@x:[0 1]"},
+      delegated:   1,
+      delegates:   delegateCounts{{"a@x", "a", 2}},
+    },
+    {
+      name:        "cycle",
+      ballots:     []Ballot{ballot("a@x", before, 0, 1)},
+      delegations: []Delegation{delegation("x@x", "y@x", before), delegation("y@x", "x@x", before)},
+      counted:     []string{"a@x:[0 1]"},
+      unresolved:  2,
+    },
+    {
+      name:        "delegate didn't vote",
+      delegations: []Delegation{delegation("c@x", "z@x", before)},
+      unresolved:  1,
+    },
+    {
+      name:        "addresses match ignoring case",
+      ballots:     []Ballot{ballot("Alice@x", before, 1, 0)},
+      delegations: []Delegation{delegation("b@x", "alice@x", before)},
+      counted:     []string{"Alice@x:[1 0]", "b@x:[1 0]"},
+      delegated:   1,
+      delegates:   delegateCounts{{"alice@x", "alice", 2}},
+    },
+    {
+      name:    "most votes first",
+      ballots: []Ballot{ballot("a@x", before, 0, 1), ballot("b@x", before, 1, 0)},
+      delegations: []Delegation{
+        delegation("c@x", "a@x", before),
+        delegation("d@x", "b@x", before),
+        delegation("e@x", "b@x", before),
+      },
+      counted:   []string{"a@x:[0 1]", "b@x:[1 0]", "c@x:[0 1]", "d@x:[1 0]", "e@x:[1 0]"},
+      delegated: 3,
+      delegates: delegateCounts{{"b@x", "b", 3}, {"a@x", "a", 2}},
+    },
+  }
+  for _, test := range tests {
+    counted, summary := resolveDelegations(test.ballots, test.delegations)
+    if got := countedOrderings(counted); !reflect.DeepEqual(got, test.counted) {
+      t.Errorf("%s: counted %v, want %v", test.name, got, test.counted)
+    }
+    if summary.Delegated != test.delegated || summary.Unresolved != test.unresolved {
+      t.Errorf("%s: %d delegated and %d unresolved, want %d and %d", test.name, summary.Delegated, summary.Unresolved, test.delegated, test.unresolved)
+    }
+    if !reflect.DeepEqual(summary.Delegates, test.delegates) {
+      t.Errorf("%s: delegates %v, want %v", test.name, summary.Delegates, test.delegates)
+    }
+  }
+}
+
+func TestDelegationSummaryBlur(t *testing.T) {
+  s := delegationSummary{Delegated: 7, Delegates: delegateCounts{{"a@x", "a", 8}}}
+  s.blur()
+  want := delegationSummary{Delegated: 5, Delegates: delegateCounts{{"a@x", "a", 10}}, Blurred: true}
+  if !reflect.DeepEqual(s, want) {
+    t.Errorf("blurred to %+v, want %+v", s, want)
+  }
+}
@@ -0,0 +1,207 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "crypto/sha256"
+  "math"
+  "math/rand"
+  "time"
+)
+
+// How much of a tally can be published is decided by the Election's
+// disclosure policy:
+//   Min_ballots   - nothing but the number of votes is shown until at least
+//                   this many ballots have been counted.
+//   Noise_epsilon - while voting is open, Laplace noise calibrated to this
+//                   privacy budget is added to every pairwise count, total
+//                   and count of grades, and the ranking is worked out
+//                   from the noisy counts.  The budget is split evenly
+//                   between noisyReleases counts made at set times, see
+//                   noisyRelease.
+// Without noise, the pairwise counts, and everything worked out from them,
+// aren't shown at all until voting has closed, since watching them change
+// would show how each new ballot was filled out.  Once voting has closed the
+// counts are exact.
+
+// How many times the noisy results are counted while voting is open.
+const noisyReleases = 10
+
+// Largest weight that any one voter in e has, which is how much more their
+// ballot can change the counts than the ballot of a voter with weight 1.
+func maxVoterWeight(e *Election) int {
+  most := 1
+  for _, w := range e.Weights {
+    if w > most {
+      most = w
+    }
+  }
+  return most
+}
+
+// Returns the time that the noisy results of e shown as of now were counted
+// at.  The time between Start and End, as it was before any extensions for
+// lack of a quorum, is split into noisyReleases parts, and the results are
+// counted at the start of each part, but not more often than once every
+// Refresh_interval.  The last count is shown until voting closes, even if it
+// is extended, so that there are never more than noisyReleases of them.
+func (e *Election) noisyRelease(now time.Time) time.Time {
+  end := e.End.Add(-time.Duration(int64(e.Extensions) * e.Quorum_extension))
+  interval := end.Sub(e.Start) / noisyReleases
+  if interval < time.Duration(e.Refresh_interval) {
+    interval = time.Duration(e.Refresh_interval)
+  }
+  if interval <= 0 || now.Before(e.Start) {
+    return e.Start
+  }
+  n := now.Sub(e.Start) / interval
+  if n >= noisyReleases {
+    n = noisyReleases - 1
+  }
+  return e.Start.Add(n * interval)
+}
+
+// Gives the Election with the given key a Noise_secret if it doesn't have one
+// yet, which is only the case for elections made before there were secrets.
+// e is updated to match what is stored.
+func ensureNoiseSecret(c appengine.Context, key *datastore.Key, e *Election) error {
+  if e.Noise_secret != "" {
+    return nil
+  }
+  secret, err := newSecret()
+  if err != nil {
+    return err
+  }
+  return datastore.RunInTransaction(c, func(c appengine.Context) error {
+    var stored Election
+    err := datastore.Get(c, key, &stored)
+    if err != nil {
+      return err
+    }
+    if stored.Noise_secret == "" {
+      stored.Noise_secret = secret
+      _, err = datastore.Put(c, key, &stored)
+      if err != nil {
+        return err
+      }
+    }
+    e.Noise_secret = stored.Noise_secret
+    return nil
+  }, nil)
+}
+
+// Returns a source of randomness that depends only on e's Noise_secret and
+// on which ballots were counted.  The noise stays the same until the counted
+// ballots change, so reloading the results can't average it away, and it
+// can't be worked out and taken back out without the secret.
+func disclosureRand(e *Election, ballots []Ballot) *rand.Rand {
+  h := sha256.New()
+  h.Write([]byte(e.Noise_secret))
+  for _, b := range ballots {
+    h.Write([]byte(b.User_id))
+    h.Write([]byte{0})
+    h.Write([]byte(b.Email))
+    h.Write([]byte{0})
+    at := b.Time.UnixNano()
+    for i := uint(0); i < 64; i += 8 {
+      h.Write([]byte{byte(at >> i)})
+    }
+  }
+  sum := h.Sum(nil)
+  var seed int64
+  for i := 0; i < 8; i++ {
+    seed = seed<<8 | int64(sum[i])
+  }
+  return rand.New(rand.NewSource(seed))
+}
+
+// Draws from the Laplace distribution centered on 0 with the given scale.
+func laplace(rng *rand.Rand, scale float64) float64 {
+  u := rng.Float64() - 0.5
+  if u < 0 {
+    return scale * math.Log(1+2*u)
+  }
+  return -scale * math.Log(1-2*u)
+}
+
+// Returns count with noise of the given scale added to it.  Counts are kept
+// whole and never go below zero.
+func noisyCount(count int, scale float64, rng *rand.Rand) int {
+  noisy := int(math.Floor(float64(count) + laplace(rng, scale) + 0.5))
+  if noisy < 0 {
+    return 0
+  }
+  return noisy
+}
+
+// Adds noise to every count in counts, which are changed in place.  The
+// noise is calibrated to sensitivity, which is how much one ballot can change
+// all of the counts put together.  epsilon is the part of the privacy budget
+// that this release uses up.
+func addNoise(counts *ballotCounts, epsilon float64, sensitivity int, rng *rand.Rand) {
+  if sensitivity == 0 {
+    return
+  }
+  scale := float64(sensitivity) / epsilon
+  for i := range counts.Pairwise {
+    for j := range counts.Pairwise[i] {
+      if i != j {
+        counts.Pairwise[i][j] = noisyCount(counts.Pairwise[i][j], scale, rng)
+      }
+    }
+  }
+  for i := range counts.Totals {
+    counts.Totals[i] = noisyCount(counts.Totals[i], scale, rng)
+  }
+  for i := range counts.Grades {
+    for g := range counts.Grades[i] {
+      counts.Grades[i][g] = noisyCount(counts.Grades[i][g], scale, rng)
+    }
+  }
+}
+
+// Replaces every count in s with blurNumber of it, leaving counts of 0 alone
+// since blurNumber never gives 0.
+func (s *delegationSummary) blur() {
+  if s.Delegated > 0 {
+    s.Delegated = blurNumber(s.Delegated)
+  }
+  if s.Unresolved > 0 {
+    s.Unresolved = blurNumber(s.Unresolved)
+  }
+  for i := range s.Delegates {
+    s.Delegates[i].Votes = blurNumber(s.Delegates[i].Votes)
+  }
+  s.Blurred = true
+}
+
+// Applies e's disclosure policy to t as of now.  ballots are the ballots that
+// were counted to make t.
+func applyDisclosure(e *Election, t *tally, ballots []Ballot, now time.Time) {
+  if e.Min_ballots > 0 && t.Num_votes < e.Min_ballots {
+    t.Withheld = true
+    t.Ranks = nil
+    t.Pairwise = nil
+    t.Totals = nil
+    t.Grades = nil
+    t.Runoff = nil
+    t.Delegation = delegationSummary{Withheld: true}
+    return
+  }
+  // Like Num_votes, the delegation counts are only shown roughly until voting
+  // closes, so that they can't be watched to see when each voter voted.
+  if now.Before(e.End) {
+    t.Delegation.blur()
+    if e.Noise_epsilon == 0 {
+      t.Pairwise = nil
+    }
+  }
+  if e.Noise_epsilon > 0 && now.Before(e.End) {
+    kind := e.ballotKind()
+    counts := &ballotCounts{Pairwise: t.Pairwise, Totals: t.Totals, Grades: t.Grades}
+    sensitivity := maxVoterWeight(e) * kind.Sensitivity(e, len(t.Candidates))
+    addNoise(counts, e.Noise_epsilon/noisyReleases, sensitivity, disclosureRand(e, ballots))
+    t.Ranks, t.Runoff = kind.Rank(counts)
+    t.Noisy = true
+  }
+}
@@ -0,0 +1,159 @@
+package vote
+
+import (
+  "math/rand"
+  "reflect"
+  "testing"
+  "time"
+)
+
+func TestNoisyRelease(t *testing.T) {
+  start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+  hours := func(h float64) time.Time {
+    return start.Add(time.Duration(h * float64(time.Hour)))
+  }
+  minute := int64(time.Minute)
+  tests := []struct {
+    name string
+    e    *Election
+    now  time.Time
+    want time.Time
+  }{
+    {"before voting opens", &Election{Start: start, End: hours(10), Refresh_interval: minute}, hours(-1), start},
+    {"first part", &Election{Start: start, End: hours(10), Refresh_interval: minute}, hours(0.5), start},
+    {"later part", &Election{Start: start, End: hours(10), Refresh_interval: minute}, hours(3.5), hours(3)},
+    {"last part", &Election{Start: start, End: hours(10), Refresh_interval: minute}, hours(9.9), hours(9)},
+    {
+      "extended for lack of a quorum",
+      &Election{Start: start, End: hours(12), Refresh_interval: minute, Extensions: 1, Quorum_extension: int64(2 * time.Hour)},
+      hours(11.5),
+      hours(9),
+    },
+    {"refreshed less often than the parts", &Election{Start: start, End: hours(10), Refresh_interval: int64(2 * time.Hour)}, hours(3), hours(2)},
+  }
+  for _, test := range tests {
+    if got := test.e.noisyRelease(test.now); !got.Equal(test.want) {
+      t.Errorf("%s: noisyRelease = %v, want %v", test.name, got, test.want)
+    }
+  }
+}
+
+func TestDisclosureRand(t *testing.T) {
+  ballots := []Ballot{{User_id: "1", Email: "a@x", Time: time.Unix(100, 0)}}
+  draw := func(e *Election, ballots []Ballot) int64 {
+    return disclosureRand(e, ballots).Int63()
+  }
+  e := &Election{Noise_secret: "secret"}
+  if draw(e, ballots) != draw(e, ballots) {
+    t.Errorf("different noise for the same ballots")
+  }
+  if draw(e, ballots) == draw(&Election{Noise_secret: "other"}, ballots) {
+    t.Errorf("same noise with a different secret")
+  }
+  changed := append([]Ballot{{User_id: "2", Email: "b@x", Time: time.Unix(200, 0)}}, ballots...)
+  if draw(e, ballots) == draw(e, changed) {
+    t.Errorf("same noise after a ballot was added")
+  }
+}
+
+func TestAddNoise(t *testing.T) {
+  exact := func() *ballotCounts {
+    return &ballotCounts{
+      Pairwise: [][]int{{0, 3}, {1, 0}},
+      Totals:   []int{0, 2},
+      Grades:   [][]int{{1, 0}, {0, 1}},
+    }
+  }
+  tests := []struct {
+    name        string
+    sensitivity int
+    seed        int64
+  }{
+    {"no sensitivity", 0, 1},
+    {"one seed", 2, 1},
+    {"another seed", 2, 2},
+  }
+  for _, test := range tests {
+    counts := exact()
+    addNoise(counts, 0.5, test.sensitivity, rand.New(rand.NewSource(test.seed)))
+    again := exact()
+    addNoise(again, 0.5, test.sensitivity, rand.New(rand.NewSource(test.seed)))
+    if !reflect.DeepEqual(counts, again) {
+      t.Errorf("%s: the same randomness gave %+v and %+v", test.name, counts, again)
+    }
+    if test.sensitivity == 0 && !reflect.DeepEqual(counts, exact()) {
+      t.Errorf("%s: counts changed to %+v", test.name, counts)
+    }
+    for i := range counts.Pairwise {
+      if counts.Pairwise[i][i] != 0 {
+        t.Errorf("%s: noise added to a candidate against themselves: %v", test.name, counts.Pairwise)
+      }
+    }
+    for _, row := range append(append([][]int{counts.Totals}, counts.Pairwise...), counts.Grades...) {
+      for _, n := range row {
+        if n < 0 {
+          t.Errorf("%s: negative count in %+v", test.name, counts)
+        }
+      }
+    }
+  }
+}
+
+func TestApplyDisclosure(t *testing.T) {
+  end := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+  open := end.Add(-time.Hour)
+  closed := end.Add(time.Hour)
+  ballots := []Ballot{{User_id: "1", Email: "a@x", Ordering: []int{0, 1}}}
+  exact := func(e *Election) *tally {
+    return &tally{
+      Election:   e,
+      Candidates: []Candidate{{Name: "A"}, {Name: "B"}},
+      Pairwise:   [][]int{{0, 7}, {3, 0}},
+      Ranks:      [][]int{{0}, {1}},
+      Num_votes:  10,
+      Delegation: delegationSummary{Delegated: 3},
+    }
+  }
+  tests := []struct {
+    name string
+    e    *Election
+    now  time.Time
+
+    withheld, noisy, pairwise, blurred bool
+  }{
+    {"too few ballots", &Election{End: end, Min_ballots: 20}, open, true, false, false, false},
+    {"too few ballots after voting closes", &Election{End: end, Min_ballots: 20}, closed, true, false, false, false},
+    {"open without noise", &Election{End: end}, open, false, false, false, true},
+    {"open with noise", &Election{End: end, Noise_epsilon: 1, Noise_secret: "secret"}, open, false, true, true, true},
+    {"closed without noise", &Election{End: end}, closed, false, false, true, false},
+    {"closed with noise", &Election{End: end, Noise_epsilon: 1, Noise_secret: "secret"}, closed, false, false, true, false},
+  }
+  for _, test := range tests {
+    got := exact(test.e)
+    applyDisclosure(test.e, got, ballots, test.now)
+    if got.Withheld != test.withheld || got.Noisy != test.noisy {
+      t.Errorf("%s: withheld %v and noisy %v, want %v and %v", test.name, got.Withheld, got.Noisy, test.withheld, test.noisy)
+    }
+    if (got.Pairwise != nil) != test.pairwise {
+      t.Errorf("%s: pairwise counts %v, want them shown = %v", test.name, got.Pairwise, test.pairwise)
+    }
+    if got.Delegation.Blurred != test.blurred {
+      t.Errorf("%s: delegations %+v, want blurred = %v", test.name, got.Delegation, test.blurred)
+    }
+    if test.withheld && (got.Ranks != nil || !got.Delegation.Withheld) {
+      t.Errorf("%s: ranks %v and delegations %+v shown while withheld", test.name, got.Ranks, got.Delegation)
+    }
+    if !test.withheld && !test.noisy && test.pairwise && !reflect.DeepEqual(got, exact(test.e)) {
+      t.Errorf("%s: exact results changed to %+v", test.name, got)
+    }
+  }
+
+  // Looking again without any new ballots gives the same noise.
+  e := &Election{End: end, Noise_epsilon: 1, Noise_secret: "secret"}
+  first, second := exact(e), exact(e)
+  applyDisclosure(e, first, ballots, open)
+  applyDisclosure(e, second, ballots, open.Add(time.Minute))
+  if !reflect.DeepEqual(first.Pairwise, second.Pairwise) {
+    t.Errorf("noise changed from %v to %v without any new ballots", first.Pairwise, second.Pairwise)
+  }
+}
@@ -5,9 +5,9 @@ import (
   "appengine/datastore"
   "appengine/user"
   "fmt"
-  "io/ioutil"
   "html/template"
   "net/http"
+  "strconv"
   "time"
   "strings"
 )
@@ -29,6 +29,10 @@ type Candidate struct {
   // Index is just so that we have a well-defined ordering among Candidates,
   // independent of anything the datastore does.
   Index int
+
+  // Index of the Question this is a candidate in, 0 for the Election's own
+  // candidates.
+  Question int
 }
 
 type Election struct {
@@ -39,6 +43,14 @@ type Election struct {
   // User.ID of the user that created this election.
   User_id string
 
+  // User.Email of the user that created this election, so that they can be
+  // told when it is over.
+  User_email string
+
+  // The Organization this election belongs to, or nil if it is just the
+  // creator's own.
+  Org_key *datastore.Key
+
   // Time when the election begins.
   Start time.Time
 
@@ -54,31 +66,296 @@ type Election struct {
   // closed.
   Hide_results bool
 
+  // Who can find this election, one of the visibility constants.  Empty
+  // means public, since that's how every election used to be.
+  Visibility string
+
+  // Which kind of ballot the voters fill out, one of the ballotKinds.  Empty
+  // means ranked.  Max_score is the highest score a voter can give on a score
+  // or STAR ballot.  Grades are the grades of a Majority Judgment ballot,
+  // best first.
+  Ballot_type string
+  Max_score   int
+  Grades      []string
+
+  // The disclosure policy for the results, see disclosure.go.  Zero for
+  // either means that part of the policy isn't used.
+  Min_ballots   int
+  Noise_epsilon float64
+
+  // Mixed into the noise added to the results, so that nobody can work out
+  // what it was.  Never shown to anyone.
+  Noise_secret string
+
+  // The quorum, as a number of voters, or as a fraction of everyone that is
+  // eligible, whichever is more.  Voters with weights count for their weight.
+  // If the quorum hasn't been reached when voting closes, End is pushed back
+  // by Quorum_extension up to Max_extensions times, after which the result
+  // is marked as Non_binding.
+  Quorum_count     int
+  Quorum_fraction  float64
+  Quorum_extension int64
+  Max_extensions   int
+  Extensions       int
+  Non_binding      bool
+
+  // Whether or not voters are kept from looking back at how they voted.  They
+  // can still see when they voted.
+  Secret_ballots bool
+
+  // Whether or not voters may delegate their vote to another voter instead of
+  // ranking the candidates themselves.
+  Allow_delegation bool
+
   Title string
   Text  string
 
   Num_candidates int
 
+  // Number of Questions on the ballot after the first, see question.go.
+  Num_questions int
+
   // List of email addresses of all of the valid voters.  If it is empty then
   // anyone is allowed to vote.
   Emails []string
+
+  // Weights[i] is how much the vote of Emails[i] counts for.  If it is empty
+  // then everyone's vote counts the same.
+  Weights []int
+
+  // Voter_names[i] is the name of Emails[i], if the voters were imported
+  // along with their names.  Empty names are fine.
+  Voter_names []string
+
+  // VoterGroups whose members are also allowed to vote.  Until the election
+  // opens the groups are looked up every time, once it opens their members
+  // are copied into Group_emails and that is used instead, so that there is a
+  // record of exactly who was eligible.
+  Groups        []*datastore.Key
+  Group_emails  []string
+  Snapshot_time time.Time
+
+  // If this Election was made by a Recurrence, this is the key of that
+  // Recurrence, and Previous_key is the key of the Election it made the time
+  // before this one, if there was one.
+  Recurrence_key *datastore.Key
+  Previous_key   *datastore.Key
+
+  // Whether to make a runoff if there is no clear winner when voting
+  // closes, see runoff.go, and how long voting in the runoff lasts, in
+  // nanoseconds.  Zero means as long as this election did.
+  Auto_runoff     bool
+  Runoff_duration int64
+
+  // The runoff that was made for this Election, and the Election that this
+  // one is a runoff of.
+  Runoff_key *datastore.Key
+  Runoff_of  *datastore.Key
+
+  // Where this Election is in its lifecycle.  These are set by the
+  // lifecycle cron job as the election opens, as voters are reminded to vote,
+  // as the election closes, and as everyone is told that the results are
+  // ready.
+  Opened       bool
+  Reminded     bool
+  Closed       bool
+  Results_sent bool
+
+  // The last Refresh_interval boundary at which the results were announced
+  // as refreshed.
+  Last_refresh time.Time
 }
 
 
-func (e *Election) IsUserAllowedToVote(u *user.User) bool {
+func (e *Election) IsUserAllowedToVote(c appengine.Context, u *user.User) bool {
+  return e.IsEmailAllowedToVote(c, u.Email)
+}
+
+// Returns everyone that is allowed to vote in e.  If this is empty then
+// anyone is allowed to vote.  Someone that is both listed and in a group, in
+// any mix of upper and lower case, is only returned once.
+func (e *Election) Electorate(c appengine.Context) ([]string, error) {
+  group_emails := e.Group_emails
+  if e.Snapshot_time.IsZero() && len(e.Groups) > 0 {
+    var err error
+    group_emails, err = groupMembers(c, e.Groups)
+    if err != nil {
+      return nil, err
+    }
+  }
+  electorate := append([]string(nil), e.Emails...)
+  listed := make(map[string]bool)
+  for _, email := range e.Emails {
+    listed[strings.ToLower(email)] = true
+  }
+  for _, email := range group_emails {
+    if !listed[strings.ToLower(email)] {
+      listed[strings.ToLower(email)] = true
+      electorate = append(electorate, email)
+    }
+  }
+  return electorate, nil
+}
+
+// Returns the set of everyone that is allowed to vote in e, by their address
+// in lower case, or nil if anyone is allowed to vote.
+func (e *Election) eligibleVoters(c appengine.Context) (map[string]bool, error) {
+  if len(e.Emails) == 0 && len(e.Groups) == 0 {
+    return nil, nil
+  }
+  electorate, err := e.Electorate(c)
+  if err != nil {
+    return nil, err
+  }
+  eligible := make(map[string]bool)
+  for _, email := range electorate {
+    eligible[strings.ToLower(email)] = true
+  }
+  return eligible, nil
+}
+
+// Returns how much the vote of the voter with the given email counts for.
+// Anyone that isn't listed counts once, which includes the empty email of a
+// ballot cast before Ballot had an Email.
+func (e *Election) VoterWeight(address string) int {
+  if len(e.Weights) != len(e.Emails) {
+    return 1
+  }
+  for i, email := range e.Emails {
+    if strings.EqualFold(address, email) {
+      return e.Weights[i]
+    }
+  }
+  return 1
+}
+
+// Returns the total weight of all of the voters in electorate.
+func (e *Election) TotalWeight(electorate []string) int {
+  total := 0
+  for _, email := range electorate {
+    total += e.VoterWeight(email)
+  }
+  return total
+}
+
+// Parses the list of voters entered on the election form.  Each email address
+// may be followed by a number, which is the weight of that voter's vote.
+// Weights is nil if no weights were given, otherwise anyone without a weight
+// gets a weight of 1.
+func parseVoters(s string) (emails []string, weights []int, err error) {
+  weighted := false
+  for _, field := range strings.Fields(s) {
+    weight, err := strconv.Atoi(field)
+    if err != nil {
+      emails = append(emails, field)
+      weights = append(weights, 1)
+      continue
+    }
+    if len(emails) == 0 || weight <= 0 {
+      return nil, nil, &electionError{fmt.Sprintf("Expected a positive weight following an email address, found '%s'.", field)}
+    }
+    weights[len(weights)-1] = weight
+    weighted = true
+  }
+  if !weighted {
+    weights = nil
+  }
+  return emails, weights, nil
+}
+
+// Formats a list of voters the way parseVoters expects them.
+func formatVoters(emails []string, weights []int) string {
+  var lines []string
+  for i, email := range emails {
+    if len(weights) == len(emails) {
+      email = fmt.Sprintf("%s %d", email, weights[i])
+    }
+    lines = append(lines, email)
+  }
+  return strings.Join(lines, "\n")
+}
+
+func (e *Election) IsEmailAllowedToVote(c appengine.Context, address string) bool {
   // If the election was not limited to a set of users then it is implicitly
   // open to everyone.
-  if len(e.Emails) == 0 {
+  if len(e.Emails) == 0 && len(e.Groups) == 0 {
     return true
   }
-  for _, email := range e.Emails {
-    if u.Email == email {
+  electorate, err := e.Electorate(c)
+  if err != nil {
+    c.Errorf("Unable to find the voters for %s: %v", e.Key_str, err)
+    return false
+  }
+  // Imported addresses are in lower case, but the address of a user's
+  // account might not be.
+  for _, email := range electorate {
+    if strings.EqualFold(address, email) {
       return true
     }
   }
   return false
 }
 
+const (
+  // Listed on the front page for anyone to see.
+  visibilityPublic = "public"
+
+  // Not listed anywhere, but anyone with a link to it can see it.
+  visibilityUnlisted = "unlisted"
+
+  // Only its voters and organizers can see anything about it.
+  visibilityPrivate = "private"
+)
+
+type visibilityChoice struct {
+  Value    string
+  Label    string
+  Selected bool
+}
+
+var visibilityLabels = []struct{ Value, Label string }{
+  {visibilityPublic, "Public: listed on the front page"},
+  {visibilityUnlisted, "Unlisted: only people with a link can find it"},
+  {visibilityPrivate, "Private: only voters and organizers can see it"},
+}
+
+func visibilityChoices(selected string) []visibilityChoice {
+  if selected == "" {
+    selected = visibilityPublic
+  }
+  var choices []visibilityChoice
+  for _, v := range visibilityLabels {
+    choices = append(choices, visibilityChoice{v.Value, v.Label, v.Value == selected})
+  }
+  return choices
+}
+
+func parseVisibility(s string) (string, error) {
+  for _, v := range visibilityLabels {
+    if v.Value == s {
+      return s, nil
+    }
+  }
+  return "", &electionError{fmt.Sprintf("Unknown visibility: '%s'", s)}
+}
+
+type ballotTypeChoice struct {
+  Value    string
+  Label    string
+  Selected bool
+}
+
+func ballotTypeChoices(selected string) []ballotTypeChoice {
+  if selected == "" {
+    selected = ballotRanked
+  }
+  var choices []ballotTypeChoice
+  for _, name := range ballotKindOrder {
+    choices = append(choices, ballotTypeChoice{name, ballotKinds[name].Label, name == selected})
+  }
+  return choices
+}
+
 type electionError struct {
   msg string
 }
@@ -92,30 +369,231 @@ func (e *Election) GetCandidates(c appengine.Context) ([]Candidate, error) {
   if err != nil {
     return nil, err
   }
-  query := datastore.NewQuery("Candidate").Ancestor(key).Order("Index")
+  return getCandidates(c, key, e.Num_candidates)
+}
+
+// Returns the Candidates that are children of parent, which may be either an
+// Election or an ElectionTemplate, in Index order.
+func getCandidates(c appengine.Context, parent *datastore.Key, num_candidates int) ([]Candidate, error) {
+  return loadCandidates(c, parent, 0, num_candidates)
+}
+
+// Returns the Candidates of question q that are descendants of parent, in
+// Index order.  The Candidates of later questions are descendants of the
+// Election too, see Question.
+func loadCandidates(c appengine.Context, parent *datastore.Key, q int, num_candidates int) ([]Candidate, error) {
+  query := datastore.NewQuery("Candidate").Ancestor(parent).Order("Index")
   var cands []Candidate
   it := query.Run(c)
-  var cand Candidate
-  for _, err := it.Next(&cand); err == nil; _, err = it.Next(&cand) {
-    cands = append(cands, cand)
+  for {
+    var cand Candidate
+    _, err := it.Next(&cand)
+    if err != nil {
+      break
+    }
+    if cand.Question == q {
+      cands = append(cands, cand)
+    }
   }
-  if len(cands) != e.Num_candidates {
-    return nil, &electionError{fmt.Sprintf("Expected %d candidates, found %d.", e.Num_candidates, len(cands))}
+  if len(cands) != num_candidates {
+    return nil, &electionError{fmt.Sprintf("Expected %d candidates, found %d.", num_candidates, len(cands))}
   }
   return cands, nil
 }
 
+// The most candidates that can be entered on the election form.
+const maxCandidates = 10
+
+type refreshOption struct {
+  Value    string
+  Label    string
+  Interval int64
+}
+
+var refreshOptions = []refreshOption{
+  {"1second", "1 Second", 1000 * 1000 * 1000},
+  {"1minute", "1 Minute", 60 * 1000 * 1000 * 1000},
+  {"10minute", "10 Minutes", 10 * 60 * 1000 * 1000 * 1000},
+  {"hour", "1 Hour", 60 * 60 * 1000 * 1000 * 1000},
+  {"day", "1 Day", 24 * 60 * 60 * 1000 * 1000 * 1000},
+}
+
+type refreshChoice struct {
+  refreshOption
+  Selected bool
+}
+
+// Everything needed to fill out the election form, either blank or with the
+// values from an existing Election or ElectionTemplate.
+type electionFormData struct {
+  Title        string
+  Refresh      []refreshChoice
+  Hide_results bool
+  Visibility   []visibilityChoice
+  Ballot_types []ballotTypeChoice
+  Max_score    int
+  Grades       string
+  Emails       string
+  Candidates   []Candidate
+
+  // The disclosure, quorum and runoff settings, formatted the way the form
+  // expects them.  Blank means the setting isn't used.
+  Min_ballots      string
+  Epsilon          string
+  Quorum_count     string
+  Quorum_percent   string
+  Quorum_extension string
+  Max_extensions   int
+  Secret_ballots   bool
+  Allow_delegation bool
+  Auto_runoff      bool
+  Runoff_duration  string
+
+  // Templates the user has saved, so they can pick one to start from.
+  Templates []ElectionTemplate
+
+  // key.Encode() of the Election or ElectionTemplate the form was filled in
+  // from, if any, see formSource.  Its questions after the first are copied
+  // into the new election.
+  Source        string
+  Num_questions int
+
+  // The user's voter groups, and which of them are already picked.
+  Groups          []groupChoice
+  selected_groups []*datastore.Key
+
+  // The organizations the user is a member of, and which of them is
+  // already picked.
+  Orgs         []orgChoice
+  selected_org *datastore.Key
+}
+
+type groupChoice struct {
+  VoterGroup
+  Selected bool
+}
+
+func makeElectionFormData(t *ElectionTemplate, cands []Candidate) electionFormData {
+  data := electionFormData{
+    Title:           t.Title,
+    Hide_results:    t.Hide_results,
+    Visibility:      visibilityChoices(t.Visibility),
+    Ballot_types:    ballotTypeChoices(t.Ballot_type),
+    Max_score:       t.Max_score,
+    Grades:          strings.Join(t.Grades, "\n"),
+    Emails:          formatVoters(t.Emails, t.Weights),
+    selected_groups: t.Groups,
+    selected_org:    t.Org_key,
+    Num_questions:   t.Num_questions,
+
+    Max_extensions:   t.Max_extensions,
+    Secret_ballots:   t.Secret_ballots,
+    Allow_delegation: t.Allow_delegation,
+    Auto_runoff:      t.Auto_runoff,
+  }
+  if t.Min_ballots > 0 {
+    data.Min_ballots = strconv.Itoa(t.Min_ballots)
+  }
+  if t.Noise_epsilon > 0 {
+    data.Epsilon = strconv.FormatFloat(t.Noise_epsilon, 'g', -1, 64)
+  }
+  if t.Quorum_count > 0 {
+    data.Quorum_count = strconv.Itoa(t.Quorum_count)
+  }
+  if t.Quorum_fraction > 0 {
+    data.Quorum_percent = strconv.FormatFloat(t.Quorum_fraction*100, 'g', -1, 64)
+  }
+  if t.Quorum_extension > 0 {
+    data.Quorum_extension = formatDuration(time.Duration(t.Quorum_extension))
+  } else {
+    data.Max_extensions = 1
+  }
+  if t.Runoff_duration > 0 {
+    data.Runoff_duration = formatDuration(time.Duration(t.Runoff_duration))
+  }
+  for _, opt := range refreshOptions {
+    data.Refresh = append(data.Refresh, refreshChoice{opt, opt.Interval == t.Refresh_interval})
+  }
+  for i := 0; i < maxCandidates; i++ {
+    var cand Candidate
+    if i < len(cands) {
+      cand = cands[i]
+    }
+    cand.Index = i
+    data.Candidates = append(data.Candidates, cand)
+  }
+  return data
+}
+
+var electionFormTemplate = template.Must(template.ParseFiles("static/make_election.html"))
+
+// Writes out the election form, prefilled with data.  The user's saved
+// templates and voter groups are looked up and added to data before it is
+// displayed.
+func showElectionForm(w http.ResponseWriter, c appengine.Context, u *user.User, data electionFormData) {
+  query := datastore.NewQuery("ElectionTemplate").Filter("User_id =", u.ID).Order("Name")
+  _, err := query.GetAll(c, &data.Templates)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  groups, err := usableGroups(c, u)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  orgs, _, err := userOrgs(c, u)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  data.Orgs = orgChoices(orgs, data.selected_org)
+  for _, g := range groups {
+    choice := groupChoice{VoterGroup: g}
+    for _, key := range data.selected_groups {
+      choice.Selected = choice.Selected || key.Encode() == g.Key_str
+    }
+    data.Groups = append(data.Groups, choice)
+  }
+  err = electionFormTemplate.Execute(w, data)
+  if err != nil {
+    fmt.Fprintf(w, "Error: %v", err)
+  }
+}
+
 func election(w http.ResponseWriter, r *http.Request) {
   htmlWrapBegin(w)
   defer htmlWrapEnd(w)
-  if _, _, logged_in := promptLogin(w, r); logged_in {
-    data, err := ioutil.ReadFile("static/make_election.html")
-    if err != nil {
-      fmt.Fprintf(w, "Error: %v", err)
-      return
-    }
-    w.Write(data)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+
+  // If a template was specified then we start from that, otherwise the form
+  // starts out blank.
+  key, err := datastore.DecodeKey(r.FormValue("template"))
+  if err != nil {
+    showElectionForm(w, c, u, makeElectionFormData(&ElectionTemplate{Refresh_interval: refreshOptions[0].Interval}, nil))
+    return
+  }
+  var t ElectionTemplate
+  err = datastore.Get(c, key, &t)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if t.User_id != u.ID {
+    http.Error(w, "You can only use templates that you have saved.", http.StatusInternalServerError)
+    return
+  }
+  cands, err := getCandidates(c, key, t.Num_candidates)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
   }
+  data := makeElectionFormData(&t, cands)
+  data.Source = key.Encode()
+  showElectionForm(w, c, u, data)
 }
 
 func makeElection(w http.ResponseWriter, r *http.Request) {
@@ -133,16 +611,40 @@ func makeElection(w http.ResponseWriter, r *http.Request) {
     return
   }
 
+  source, err := formSource(c, u, r.FormValue("source"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  source_images, err := sourceImages(c, source)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
   var cands []Candidate
-  for i := 0; i <= 9; i++ {
+  for i := 0; i < maxCandidates; i++ {
     name := r.FormValue(fmt.Sprintf("cand%d", i))
     if name == "" {
       continue
     }
-    var image appengine.BlobKey
+    // Candidates that were cloned from another election or a template keep
+    // their image unless a new one is uploaded, and so do candidates whose
+    // image was uploaded before the user was asked to confirm the voters.
+    // Any other image the form names is ignored.
+    image := appengine.BlobKey(r.FormValue(fmt.Sprintf("existing_image%d", i)))
+    if image != "" && !source_images[image] && !uploadedBy(c, u, image) {
+      image = ""
+    }
     file, _, err := r.FormFile(fmt.Sprintf("image%d", i))
     if err == nil {
-      image, _ = processImage(c, file)
+      image, err = processImage(c, file)
+      if err == nil {
+        err = recordImageUpload(c, u, image)
+        if err != nil {
+          c.Errorf("Unable to record the upload of image %s: %v", image, err)
+        }
+      }
       // if err != nil {
       //   http.Error(w, err.Error(), http.StatusInternalServerError)
       //   return
@@ -157,20 +659,19 @@ func makeElection(w http.ResponseWriter, r *http.Request) {
     cands = append(cands, cand)
   }
 
+  imported, done := importVoters(w, r, c, u, cands)
+  if done {
+    return
+  }
+
   var refresh int64
   refresh_str := r.FormValue("refresh")
-  switch refresh_str {
-  case "1second":
-    refresh = 1
-  case "1minute":
-    refresh = 60 * 1000 * 1000 * 1000
-  case "10minute":
-    refresh = 10 * 60 * 1000 * 1000 * 1000
-  case "hour":
-    refresh = 60 * 60 * 1000 * 1000 * 1000
-  case "day":
-    refresh = 24 * 60 * 60 * 1000 * 1000 * 1000
-  default:
+  for _, opt := range refreshOptions {
+    if opt.Value == refresh_str {
+      refresh = opt.Interval
+    }
+  }
+  if refresh == 0 {
     http.Error(w, fmt.Sprintf("Unknown refresh interval: '%s'", refresh_str), http.StatusInternalServerError)
     return
   }
@@ -198,13 +699,12 @@ func makeElection(w http.ResponseWriter, r *http.Request) {
   var end_time int64
   switch end_kind {
   case "duration":
-    var d, h, m time.Duration
-    n, err := fmt.Sscanf(r.FormValue("end_duration"), "%d:%d:%d", &d, &h, &m)
-    if n != 3 || err != nil {
+    d, err := parseDuration(r.FormValue("end_duration"))
+    if err != nil {
       http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
       return
     }
-    end_time = start_time + int64((d * 24 + h) * time.Hour + m * time.Minute)
+    end_time = start_time + int64(d)
 
   case "specify":
     t, err := time.Parse("2006-01-02 15:04", r.FormValue("end_time"))
@@ -219,44 +719,256 @@ func makeElection(w http.ResponseWriter, r *http.Request) {
     return
   }
 
+  emails, weights, err := parseVoters(r.FormValue("emails"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  emails, weights, names := mergeVoters(emails, weights, imported)
+
+  org_key, err := parseOrg(c, u, r.FormValue("org"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  groups, err := parseGroups(c, u, r.Form["group"])
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  imported_groups, err := importGroups(c, u, imported)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  for _, key := range imported_groups {
+    found := false
+    for _, other := range groups {
+      found = found || key.Equal(other)
+    }
+    if !found {
+      groups = append(groups, key)
+    }
+  }
+
+  visibility, err := parseVisibility(r.FormValue("visibility"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  ballot_type, max_score, grades, err := parseBallotSettings(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if ballot_type == ballotReferendum {
+    cands = referendumCandidates()
+  }
+
+  var min_ballots int
+  if s := r.FormValue("min_ballots"); s != "" {
+    min_ballots, err = strconv.Atoi(s)
+    if err != nil || min_ballots < 0 {
+      http.Error(w, fmt.Sprintf("Expected a number of ballots, got '%s'.", s), http.StatusInternalServerError)
+      return
+    }
+  }
+  var epsilon float64
+  if s := r.FormValue("epsilon"); s != "" {
+    epsilon, err = strconv.ParseFloat(s, 64)
+    if err != nil || epsilon < 0 {
+      http.Error(w, fmt.Sprintf("Expected a positive privacy budget, got '%s'.", s), http.StatusInternalServerError)
+      return
+    }
+  }
+
+  var quorum_count, max_extensions int
+  var quorum_percent float64
+  var quorum_extension time.Duration
+  if s := r.FormValue("quorum_count"); s != "" {
+    quorum_count, err = strconv.Atoi(s)
+    if err != nil || quorum_count < 0 {
+      http.Error(w, fmt.Sprintf("Expected a number of voters for the quorum, got '%s'.", s), http.StatusInternalServerError)
+      return
+    }
+  }
+  if s := r.FormValue("quorum_percent"); s != "" {
+    quorum_percent, err = strconv.ParseFloat(s, 64)
+    if err != nil || quorum_percent < 0 || quorum_percent > 100 {
+      http.Error(w, fmt.Sprintf("Expected a percentage for the quorum, got '%s'.", s), http.StatusInternalServerError)
+      return
+    }
+  }
+  if s := r.FormValue("quorum_extension"); s != "" {
+    quorum_extension, err = parseDuration(s)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    max_extensions, err = strconv.Atoi(r.FormValue("max_extensions"))
+    if err != nil || max_extensions < 0 {
+      http.Error(w, fmt.Sprintf("Expected a number of extensions, got '%s'.", r.FormValue("max_extensions")), http.StatusInternalServerError)
+      return
+    }
+  }
+
+  auto_runoff := (r.FormValue("auto_runoff") == "auto_runoff")
+  var runoff_duration time.Duration
+  if s := r.FormValue("runoff_duration"); auto_runoff && s != "" {
+    runoff_duration, err = parseDuration(s)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+  }
+
   hide := (r.FormValue("hide") == "hide")
+  secret := (r.FormValue("secret") == "secret")
+  delegation := (r.FormValue("delegation") == "delegation")
 
   e := Election{
     User_id:          u.ID,
+    User_email:       u.Email,
+    Org_key:          org_key,
     Title:            r.FormValue("title"),
     Start:            time.Unix(0, start_time),
     End:              time.Unix(0, end_time),
     Hide_results:     hide,
+    Visibility:       visibility,
+    Ballot_type:      ballot_type,
+    Max_score:        max_score,
+    Grades:           grades,
+    Min_ballots:      min_ballots,
+    Noise_epsilon:    epsilon,
+    Quorum_count:     quorum_count,
+    Quorum_fraction:  quorum_percent / 100,
+    Quorum_extension: int64(quorum_extension),
+    Max_extensions:   max_extensions,
+    Secret_ballots:   secret,
+    Allow_delegation: delegation,
+    Auto_runoff:      auto_runoff,
+    Runoff_duration:  int64(runoff_duration),
     Num_candidates:   len(cands),
     Refresh_interval: refresh,
-    Emails:           strings.Fields(r.FormValue("emails")),
+    Emails:           emails,
+    Weights:          weights,
+    Voter_names:      names,
+    Groups:           groups,
+  }
+
+  key, err := putElection(c, &e, cands)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  recordAudit(c, key, u.Email, "Created the election with %d candidates", len(cands))
+
+  if source != nil {
+    e.Num_questions, err = copyQuestions(c, source, key)
+    if err == nil {
+      _, err = datastore.Put(c, key, &e)
+    }
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+  }
+
+  if hook_url := r.FormValue("webhook"); hook_url != "" {
+    err = registerWebhook(c, key, hook_url)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    fireWebhooks(c, key, &e, &webhookPayload{Event: eventCreated})
+  }
+
+  http.Redirect(w, r, fmt.Sprintf("/view_election?key=%s", key.Encode()), http.StatusFound)
+}
+
+// Reads the kind of ballot from the ballot_type field of a form, along with
+// the max_score or grades that go with it.
+func parseBallotSettings(r *http.Request) (string, int, []string, error) {
+  ballot_type := r.FormValue("ballot_type")
+  if _, ok := ballotKinds[ballot_type]; !ok {
+    return "", 0, nil, &electionError{fmt.Sprintf("Unknown kind of ballot: '%s'", ballot_type)}
+  }
+  var max_score int
+  var grades []string
+  var err error
+  switch ballot_type {
+  case ballotScore, ballotStar:
+    max_score, err = strconv.Atoi(r.FormValue("max_score"))
+    if err != nil || max_score < 1 {
+      return "", 0, nil, &electionError{fmt.Sprintf("Expected a maximum score of at least 1, got '%s'.", r.FormValue("max_score"))}
+    }
+  case ballotJudgment:
+    grades, err = parseGrades(r.FormValue("grades"))
+    if err != nil {
+      return "", 0, nil, err
+    }
+  }
+  return ballot_type, max_score, grades, nil
+}
+
+// Parses a duration given as DD:HH:MM.
+func parseDuration(s string) (time.Duration, error) {
+  var d, h, m time.Duration
+  n, err := fmt.Sscanf(s, "%d:%d:%d", &d, &h, &m)
+  if err != nil {
+    return 0, err
+  }
+  if n != 3 {
+    return 0, &electionError{fmt.Sprintf("Expected a duration of the form DD:HH:MM, got '%s'.", s)}
   }
+  return (d * 24 + h) * time.Hour + m * time.Minute, nil
+}
+
+// Formats a duration the way parseDuration expects it.
+func formatDuration(d time.Duration) string {
+  minutes := int64(d / time.Minute)
+  return fmt.Sprintf("%02d:%02d:%02d", minutes/(24*60), minutes/60%24, minutes%60)
+}
+
+// Adds a new Election, along with its Candidates, to the datastore.  e.Key_str
+// is filled in with the key of the new Election.
+func putElection(c appengine.Context, e *Election, cands []Candidate) (*datastore.Key, error) {
+  return putElectionAt(c, datastore.NewIncompleteKey(c, "Election", nil), e, cands)
+}
+
+// Like putElection, but stores e under the given key, which can be complete
+// or not.
+func putElectionAt(c appengine.Context, key *datastore.Key, e *Election, cands []Candidate) (*datastore.Key, error) {
+  secret, err := newSecret()
+  if err != nil {
+    return nil, err
+  }
+  e.Noise_secret = secret
 
   // We've created the element that we're going to add, now go ahead and add it
   // TODO: Need to make sure the name of the election doesn't conflict with an
   // existing election.
-  key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Election", nil), &e)
+  key, err = datastore.Put(c, key, e)
   if err != nil {
-    http.Error(w, err.Error(), http.StatusInternalServerError)
-    return
+    return nil, err
   }
   e.Key_str = key.Encode()
-  _, err = datastore.Put(c, key, &e)
+  _, err = datastore.Put(c, key, e)
   if err != nil {
-    http.Error(w, err.Error(), http.StatusInternalServerError)
-    return
+    return nil, err
   }
 
   // Now we add all of the Candidates as children of the Election
   for i := range cands {
     _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Candidate", key), &cands[i])
     if err != nil {
-      http.Error(w, err.Error(), http.StatusInternalServerError)
-      return
+      return nil, err
     }
   }
-
-  http.Redirect(w, r, fmt.Sprintf("/view_election?key=%s", key.Encode()), http.StatusFound)
+  return key, nil
 }
 
 var viewElectionTemplate = template.Must(template.New("view_election").Parse(viewElectionTemplateHTML))
@@ -267,11 +979,21 @@ const viewElectionTemplateHTML = `
     {{range $index,$cand := .Candidates}}
     Candidate {{$index}}: {{$cand.Name}}<br/>
     {{end}}
+    {{range .Questions}}
+    <br/>
+    Question {{.Index}}: {{.Title}}<br/>
+    {{range $index,$cand := .Candidates}}
+    Candidate {{$index}}: {{$cand.Name}}<br/>
+    {{end}}
+    {{end}}
   </body>
 `
 type viewElectionData struct {
   Election   string
   Candidates []Candidate
+
+  // The questions on the ballot after the first.
+  Questions []electionQuestion
 }
 
 func viewElection(w http.ResponseWriter, r *http.Request) {
@@ -289,14 +1011,23 @@ func viewElection(w http.ResponseWriter, r *http.Request) {
     http.Error(w, err.Error(), http.StatusInternalServerError)
     return
   }
+  if !checkCanView(w, c, key, &e) {
+    return
+  }
   cands, err := e.GetCandidates(c)
   if err != nil {
     http.Error(w, err.Error(), http.StatusInternalServerError)
     return
   }
+  questions, err := getQuestions(c, key, &e, cands)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
   data := viewElectionData{
     Election:   e.Title,
     Candidates: cands,
+    Questions:  questions[1:],
   }
   viewElectionTemplate.Execute(w, data)
   // fmt.Fprintf(w, "Election: %s<br>", e.Title)
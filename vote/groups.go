@@ -0,0 +1,319 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "appengine/user"
+  "fmt"
+  "html/template"
+  "net/http"
+  "strings"
+  "time"
+)
+
+func init() {
+  http.HandleFunc("/groups", viewGroups)
+  http.HandleFunc("/group", viewGroup)
+  http.HandleFunc("/save_group", saveGroup)
+  http.HandleFunc("/delete_group", deleteGroup)
+}
+
+// A VoterGroup is a named list of voters that a user can attach to any of
+// their elections instead of listing everyone each time.
+type VoterGroup struct {
+  // key.Encode() for the key representing this VoterGroup.
+  Key_str string
+
+  // User.ID of the user that owns this group.
+  User_id string
+
+  // The Organization this group belongs to, if any.  Every member of the
+  // organization can use and change the group.
+  Org_key *datastore.Key
+
+  Name    string
+  Emails  []string
+  Updated time.Time
+}
+
+// Returns everyone that is in any of the groups with the given keys.  Groups
+// that have since been deleted are skipped.
+func groupMembers(c appengine.Context, keys []*datastore.Key) ([]string, error) {
+  var members []string
+  seen := make(map[string]bool)
+  for _, key := range keys {
+    var g VoterGroup
+    err := datastore.Get(c, key, &g)
+    if err == datastore.ErrNoSuchEntity {
+      continue
+    }
+    if err != nil {
+      return nil, err
+    }
+    for _, email := range g.Emails {
+      if !seen[email] {
+        seen[email] = true
+        members = append(members, email)
+      }
+    }
+  }
+  return members, nil
+}
+
+// Returns true if u may use and change the group g.
+func canUseGroup(c appengine.Context, g *VoterGroup, u *user.User) (bool, error) {
+  if g.User_id == u.ID {
+    return true, nil
+  }
+  if g.Org_key == nil {
+    return false, nil
+  }
+  return isOrgMember(c, g.Org_key, u)
+}
+
+// Returns the groups that u owns along with the groups of every organization
+// u is a member of.
+func usableGroups(c appengine.Context, u *user.User) ([]VoterGroup, error) {
+  var groups []VoterGroup
+  _, err := datastore.NewQuery("VoterGroup").Filter("User_id =", u.ID).Order("Name").GetAll(c, &groups)
+  if err != nil {
+    return nil, err
+  }
+  _, org_keys, err := userOrgs(c, u)
+  if err != nil {
+    return nil, err
+  }
+  for _, org_key := range org_keys {
+    var org_groups []VoterGroup
+    _, err := datastore.NewQuery("VoterGroup").Filter("Org_key =", org_key).Order("Name").GetAll(c, &org_groups)
+    if err != nil {
+      return nil, err
+    }
+    for _, g := range org_groups {
+      if g.User_id != u.ID {
+        groups = append(groups, g)
+      }
+    }
+  }
+  return groups, nil
+}
+
+// Decodes the keys of the groups picked on the election form, making sure
+// that u is allowed to use all of them.
+func parseGroups(c appengine.Context, u *user.User, key_strs []string) ([]*datastore.Key, error) {
+  var keys []*datastore.Key
+  for _, key_str := range key_strs {
+    key, err := datastore.DecodeKey(key_str)
+    if err != nil {
+      return nil, err
+    }
+    var g VoterGroup
+    err = datastore.Get(c, key, &g)
+    if err != nil {
+      return nil, err
+    }
+    ok, err := canUseGroup(c, &g, u)
+    if err != nil {
+      return nil, err
+    }
+    if !ok {
+      return nil, &electionError{"You can only use voter groups that you own or that belong to your organizations."}
+    }
+    keys = append(keys, key)
+  }
+  return keys, nil
+}
+
+var groupsTemplate = template.Must(template.New("groups").Parse(groupsTemplateHTML))
+
+const groupsTemplateHTML = `
+  <body>
+    Your voter groups:<br/>
+    <table>
+      {{range .}}
+        <tr>
+          <td><a href="/group?key={{.Key_str}}">{{.Name}}</a></td>
+          <td>{{len .Emails}} voters</td>
+          <td>updated {{.Updated}}</td>
+        </tr>
+      {{end}}
+    </table>
+    <br/>
+    <a href="/group">Make a new group</a>
+  </body>
+`
+
+func viewGroups(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  groups, err := usableGroups(c, u)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  groupsTemplate.Execute(w, groups)
+}
+
+type groupTemplateData struct {
+  Group  VoterGroup
+  Emails string
+  Orgs   []orgChoice
+}
+
+var groupTemplate = template.Must(template.New("group").Parse(groupTemplateHTML))
+
+const groupTemplateHTML = `
+  <body>
+    <form action="/save_group" method="post">
+      <input type="hidden" name="key" value="{{.Group.Key_str}}"/>
+      Name: <input type="text" name="name" value="{{.Group.Name}}"/><br/>
+      {{if .Orgs}}
+        Organization:
+        <select name="org">
+          <option value="">None</option>
+          {{range .Orgs}}
+            <option value="{{.Key_str}}" {{if .Selected}}selected{{end}}>{{.Name}}</option>
+          {{end}}
+        </select><br/>
+      {{end}}
+      Email addresses of everyone in the group:<br/>
+      <textarea name="emails" cols="70" rows="15">{{.Emails}}</textarea><br/>
+      <input type="submit" value="Save"/>
+    </form>
+    {{if .Group.Key_str}}
+      Elections that have already opened keep the members the group had when
+      they opened.<br/>
+      <form action="/delete_group" method="post">
+        <input type="hidden" name="key" value="{{.Group.Key_str}}"/>
+        <input type="submit" value="Delete this group"/>
+      </form>
+    {{end}}
+  </body>
+`
+
+// Loads the VoterGroup specified by the key in the request, making sure that
+// u is allowed to change it.
+func getOwnGroup(w http.ResponseWriter, r *http.Request, c appengine.Context, u *user.User) (*datastore.Key, *VoterGroup, bool) {
+  key, err := datastore.DecodeKey(r.FormValue("key"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, nil, false
+  }
+  var g VoterGroup
+  err = datastore.Get(c, key, &g)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, nil, false
+  }
+  ok, err := canUseGroup(c, &g, u)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, nil, false
+  }
+  if !ok {
+    http.Error(w, "Only the owner of a voter group can do that.", http.StatusInternalServerError)
+    return nil, nil, false
+  }
+  return key, &g, true
+}
+
+// Shows the form for editing a group, or for making a new one if no key was
+// given.
+func viewGroup(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  var data groupTemplateData
+  if r.FormValue("key") != "" {
+    _, g, ok := getOwnGroup(w, r, c, u)
+    if !ok {
+      return
+    }
+    data.Group = *g
+    data.Emails = strings.Join(g.Emails, "\n")
+  }
+  orgs, _, err := userOrgs(c, u)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  data.Orgs = orgChoices(orgs, data.Group.Org_key)
+  groupTemplate.Execute(w, data)
+}
+
+func saveGroup(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  key := datastore.NewIncompleteKey(c, "VoterGroup", nil)
+  g := &VoterGroup{User_id: u.ID}
+  if r.FormValue("key") != "" {
+    var ok bool
+    key, g, ok = getOwnGroup(w, r, c, u)
+    if !ok {
+      return
+    }
+  }
+  g.Name = strings.TrimSpace(r.FormValue("name"))
+  if g.Name == "" {
+    http.Error(w, "A voter group needs a name.", http.StatusInternalServerError)
+    return
+  }
+  org_key, err := parseOrg(c, u, r.FormValue("org"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  g.Org_key = org_key
+  g.Emails = strings.Fields(r.FormValue("emails"))
+  g.Updated = time.Now()
+  key, err = datastore.Put(c, key, g)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if g.Key_str == "" {
+    g.Key_str = key.Encode()
+    _, err = datastore.Put(c, key, g)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+  }
+  fmt.Fprintf(w, `Saved %s with %d voters.  <a href="/groups">Back to your voter groups</a>.`, template.HTMLEscapeString(g.Name), len(g.Emails))
+}
+
+func deleteGroup(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  key, _, ok := getOwnGroup(w, r, c, u)
+  if !ok {
+    return
+  }
+  err := datastore.Delete(c, key)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  fmt.Fprintf(w, `Deleted.  <a href="/groups">Back to your voter groups</a>.`)
+}
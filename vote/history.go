@@ -0,0 +1,150 @@
+package vote
+
+import (
+  "appengine/datastore"
+  "html/template"
+  "net/http"
+  "time"
+)
+
+func init() {
+  http.HandleFunc("/my_ballots", viewBallotHistory)
+}
+
+// One of the ballots a voter has cast in an election.
+type ballotRevision struct {
+  Time     time.Time
+  Viewable time.Time
+
+  // The question this Ballot answers, if there is more than one.
+  Question string
+
+  // Nil if the election has secret ballots.  Tiers and Unranked are for
+  // ranked ballots, and Description for every other kind.
+  Tiers       [][]Candidate
+  Unranked    []Candidate
+  Description []string
+
+  // Exactly one of these is set.  The Counted ballot is the one that is in
+  // the results right now, Pending ballots are newer but aren't viewable yet,
+  // and Superseded ballots will never be counted again.
+  Counted    bool
+  Pending    bool
+  Superseded bool
+}
+
+type ballotHistoryTemplateData struct {
+  Election  Election
+  Revisions []ballotRevision
+  Multiple  bool
+}
+
+var ballotHistoryTemplate = template.Must(template.New("ballot_history").Parse(ballotHistoryTemplateHTML))
+
+const ballotHistoryTemplateHTML = `
+  <body>
+    Ballots you have cast in {{.Election.Title}}, newest first:<br/>
+    <table border="1">
+      <tr><td>Cast</td>{{if .Multiple}}<td>Question</td>{{end}}<td>Status</td>{{if not .Election.Secret_ballots}}<td>Ballot</td>{{end}}</tr>
+      {{range .Revisions}}
+        <tr>
+          <td>{{.Time}}</td>
+          {{if $.Multiple}}<td>{{.Question}}</td>{{end}}
+          <td>
+            {{if .Counted}}Counted{{end}}
+            {{if .Pending}}Counted from {{.Viewable}}{{end}}
+            {{if .Superseded}}Replaced by a newer ballot{{end}}
+          </td>
+          {{if not $.Election.Secret_ballots}}
+            <td>
+              {{range $i,$tier := .Tiers}}
+                {{if $i}}&gt;{{end}}
+                {{range $j,$cand := $tier}}{{if $j}} = {{end}}{{$cand.Name}}{{end}}
+              {{end}}
+              {{if .Unranked}}
+                (unranked: {{range $j,$cand := .Unranked}}{{if $j}}, {{end}}{{$cand.Name}}{{end}})
+              {{end}}
+              {{range .Description}}{{.}}<br/>{{end}}
+            </td>
+          {{end}}
+        </tr>
+      {{end}}
+    </table>
+  </body>
+`
+
+// Lists every Ballot the user has cast in an election, and which of them is
+// the one that is being counted.
+func viewBallotHistory(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  key, err := datastore.DecodeKey(r.FormValue("key"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  var e Election
+  err = datastore.Get(c, key, &e)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if !checkCanView(w, c, key, &e) {
+    return
+  }
+  cands, err := e.GetCandidates(c)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  questions, err := getQuestions(c, key, &e, cands)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  query := datastore.NewQuery("Ballot").
+      Ancestor(key).
+      Filter("User_id =", u.ID).
+      Order("-Time")
+  var ballots []Ballot
+  _, err = query.GetAll(c, &ballots)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  // Ballots are newest first, so the first viewable one for each question
+  // is the one that is counted, and everything before that is still pending.
+  now := time.Now()
+  data := ballotHistoryTemplateData{Election: e, Multiple: len(questions) > 1}
+  found_counted := make(map[int]bool)
+  for _, b := range ballots {
+    if b.Question >= len(questions) {
+      continue
+    }
+    q := questions[b.Question]
+    rev := ballotRevision{Time: b.Time, Viewable: b.Viewable, Question: q.Title}
+    switch {
+    case found_counted[b.Question]:
+      rev.Superseded = true
+    case b.Viewable.Before(now):
+      rev.Counted = true
+      found_counted[b.Question] = true
+    default:
+      rev.Pending = true
+    }
+    if !e.Secret_ballots && len(b.Ordering) == len(q.Candidates) {
+      rev.Tiers, rev.Unranked = orderingTiers(q.Candidates, b.Ordering)
+    }
+    if !e.Secret_ballots && len(b.Scores) == len(q.Candidates) {
+      rev.Description = q.Election.ballotKind().Describe(q.Election, q.Candidates, &b)
+    }
+    data.Revisions = append(data.Revisions, rev)
+  }
+  ballotHistoryTemplate.Execute(w, data)
+}
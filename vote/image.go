@@ -8,7 +8,10 @@ import (
   "net/http"
   "appengine"
   "appengine/blobstore"
+  "appengine/datastore"
+  "appengine/user"
   "io"
+  "time"
 )
 
 func init() {
@@ -43,3 +46,25 @@ func processImage(c appengine.Context, in io.Reader) (appengine.BlobKey, error)
   }
   return w.Key()
 }
+
+// An ImageUpload records who uploaded an image, so that an image a user
+// uploaded can be passed along through a form that asks them to confirm
+// something, see importVoters, without taking the form's word for whose image
+// it is.  Its key is the image's BlobKey.
+type ImageUpload struct {
+  User_id string
+  Created time.Time
+}
+
+func recordImageUpload(c appengine.Context, u *user.User, image appengine.BlobKey) error {
+  key := datastore.NewKey(c, "ImageUpload", string(image), 0, nil)
+  _, err := datastore.Put(c, key, &ImageUpload{User_id: u.ID, Created: time.Now()})
+  return err
+}
+
+// Returns whether u uploaded image.
+func uploadedBy(c appengine.Context, u *user.User, image appengine.BlobKey) bool {
+  var upload ImageUpload
+  err := datastore.Get(c, datastore.NewKey(c, "ImageUpload", string(image), 0, nil), &upload)
+  return err == nil && upload.User_id == u.ID
+}
@@ -0,0 +1,362 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "appengine/user"
+  "bytes"
+  "encoding/csv"
+  "fmt"
+  "html/template"
+  "io"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// One row of a CSV file of voters.
+type importedVoter struct {
+  Email  string
+  Name   string
+  Weight int
+  Group  string
+}
+
+// What was found in a CSV file of voters.  Rows with Errors are left out of
+// Voters, Warnings are about rows that were changed or dropped but didn't
+// stop the rest of the file from being used.
+type importReport struct {
+  Voters   []importedVoter
+  Errors   []string
+  Warnings []string
+  Weighted bool
+}
+
+func isEmailAddress(s string) bool {
+  at := strings.Index(s, "@")
+  return at > 0 && at == strings.LastIndex(s, "@") && at < len(s)-1 && !strings.ContainsAny(s, " \t<>,;\"")
+}
+
+// Reads a CSV file of voters with the columns email, name, weight and group,
+// of which only the email is required.  Addresses are trimmed and lower
+// cased, and only the first row for each address is kept.  A first row whose
+// first column is "email" is taken to be a header and skipped.
+func parseVoterCSV(in io.Reader) importReport {
+  var report importReport
+  reader := csv.NewReader(in)
+  reader.FieldsPerRecord = -1
+  reader.TrimLeadingSpace = true
+  first_line := make(map[string]int)
+  normalized := 0
+  for line := 1; ; line++ {
+    row, err := reader.Read()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      report.Errors = append(report.Errors, err.Error())
+      break
+    }
+    if len(row) == 0 || strings.TrimSpace(row[0]) == "" {
+      continue
+    }
+    if line == 1 && strings.ToLower(strings.TrimSpace(row[0])) == "email" {
+      continue
+    }
+    if len(row) > 4 {
+      report.Errors = append(report.Errors, fmt.Sprintf("Line %d has %d columns, expected at most 4.", line, len(row)))
+      continue
+    }
+    v := importedVoter{Email: strings.ToLower(strings.TrimSpace(row[0])), Weight: 1}
+    if v.Email != row[0] {
+      normalized++
+    }
+    if !isEmailAddress(v.Email) {
+      report.Errors = append(report.Errors, fmt.Sprintf("Line %d: '%s' is not an email address.", line, row[0]))
+      continue
+    }
+    if len(row) > 1 {
+      v.Name = strings.TrimSpace(row[1])
+    }
+    if len(row) > 2 && strings.TrimSpace(row[2]) != "" {
+      weight, err := strconv.Atoi(strings.TrimSpace(row[2]))
+      if err != nil || weight <= 0 {
+        report.Errors = append(report.Errors, fmt.Sprintf("Line %d: the weight '%s' is not a positive number.", line, row[2]))
+        continue
+      }
+      v.Weight = weight
+      report.Weighted = true
+    }
+    if len(row) > 3 {
+      v.Group = strings.TrimSpace(row[3])
+    }
+    if prev, ok := first_line[v.Email]; ok {
+      report.Warnings = append(report.Warnings, fmt.Sprintf("Line %d: %s is already on line %d, so this line was skipped.", line, v.Email, prev))
+      continue
+    }
+    first_line[v.Email] = line
+    report.Voters = append(report.Voters, v)
+  }
+  if normalized > 0 {
+    report.Warnings = append(report.Warnings, fmt.Sprintf("%d addresses had spaces trimmed or were changed to lower case.", normalized))
+  }
+  return report
+}
+
+// Writes voters back out in the form that parseVoterCSV reads.
+func formatVoterCSV(voters []importedVoter) string {
+  var buf bytes.Buffer
+  out := csv.NewWriter(&buf)
+  for _, v := range voters {
+    out.Write([]string{v.Email, v.Name, strconv.Itoa(v.Weight), v.Group})
+  }
+  out.Flush()
+  return buf.String()
+}
+
+// Adds the imported voters to the ones that were typed into the election
+// form.  Anyone that was already typed in keeps the weight they were given
+// there.  The names that are returned line up with the emails, and are nil
+// if nobody has a name.
+func mergeVoters(emails []string, weights []int, voters []importedVoter) ([]string, []int, []string) {
+  if len(voters) == 0 {
+    return emails, weights, nil
+  }
+  listed := make(map[string]bool)
+  for _, email := range emails {
+    listed[strings.ToLower(email)] = true
+  }
+  weighted := len(weights) == len(emails) && len(weights) > 0
+  named := false
+  names := make([]string, len(emails))
+  for _, v := range voters {
+    if listed[v.Email] {
+      continue
+    }
+    listed[v.Email] = true
+    emails = append(emails, v.Email)
+    weights = append(weights, v.Weight)
+    names = append(names, v.Name)
+    weighted = weighted || v.Weight != 1
+    named = named || v.Name != ""
+  }
+  if !weighted {
+    weights = nil
+  } else if len(weights) < len(emails) {
+    // Nobody typed into the form had a weight, so they all count once.
+    padded := make([]int, len(emails)-len(weights))
+    for i := range padded {
+      padded[i] = 1
+    }
+    weights = append(padded, weights...)
+  }
+  if !named {
+    names = nil
+  }
+  return emails, weights, names
+}
+
+// What importing voters does to one of the user's VoterGroups.
+type groupImport struct {
+  Name string
+
+  // Set if the user already has a group with this name, in which case Added
+  // are only the voters that weren't in it already.
+  Existing bool
+  Added    []string
+
+  key   *datastore.Key
+  group VoterGroup
+}
+
+// Works out which of u's VoterGroups the imported voters that have a group
+// will be added to, and which groups will have to be made, without changing
+// anything.
+func planGroupImports(c appengine.Context, u *user.User, voters []importedVoter) ([]groupImport, error) {
+  var names []string
+  members := make(map[string][]string)
+  for _, v := range voters {
+    if v.Group == "" {
+      continue
+    }
+    if _, ok := members[v.Group]; !ok {
+      names = append(names, v.Group)
+    }
+    members[v.Group] = append(members[v.Group], v.Email)
+  }
+
+  var plan []groupImport
+  for _, name := range names {
+    var groups []VoterGroup
+    found, err := datastore.NewQuery("VoterGroup").Filter("User_id =", u.ID).Filter("Name =", name).Limit(1).GetAll(c, &groups)
+    if err != nil {
+      return nil, err
+    }
+    gi := groupImport{
+      Name:  name,
+      key:   datastore.NewIncompleteKey(c, "VoterGroup", nil),
+      group: VoterGroup{User_id: u.ID, Name: name},
+    }
+    if len(found) > 0 {
+      gi.Existing = true
+      gi.key, gi.group = found[0], groups[0]
+    }
+    in_group := make(map[string]bool)
+    for _, email := range gi.group.Emails {
+      in_group[strings.ToLower(email)] = true
+    }
+    for _, email := range members[name] {
+      if !in_group[email] {
+        in_group[email] = true
+        gi.Added = append(gi.Added, email)
+      }
+    }
+    plan = append(plan, gi)
+  }
+  return plan, nil
+}
+
+// Adds each imported voter that has a group to u's VoterGroup of that name,
+// making the group if u doesn't have one yet, and returns the keys of all of
+// those groups.
+func importGroups(c appengine.Context, u *user.User, voters []importedVoter) ([]*datastore.Key, error) {
+  plan, err := planGroupImports(c, u, voters)
+  if err != nil {
+    return nil, err
+  }
+  var keys []*datastore.Key
+  for _, gi := range plan {
+    key, g := gi.key, gi.group
+    g.Emails = append(g.Emails, gi.Added...)
+    g.Updated = time.Now()
+    key, err = datastore.Put(c, key, &g)
+    if err != nil {
+      return nil, err
+    }
+    if g.Key_str == "" {
+      g.Key_str = key.Encode()
+      _, err = datastore.Put(c, key, &g)
+      if err != nil {
+        return nil, err
+      }
+    }
+    keys = append(keys, key)
+  }
+  return keys, nil
+}
+
+// A form value that is passed along unchanged from the election form to the
+// import report, so that nothing has to be typed in again.
+type formField struct {
+  Name  string
+  Value string
+}
+
+type importTemplateData struct {
+  Report importReport
+  Groups []groupImport
+  Fields []formField
+  Data   string
+}
+
+var importTemplate = template.Must(template.New("import").Parse(importTemplateHTML))
+
+const importTemplateHTML = `
+  <body>
+    Found {{len .Report.Voters}} voters in the file you uploaded.<br/>
+    {{if .Report.Errors}}
+      These rows have problems and will be left out:
+      <ul>{{range .Report.Errors}}<li>{{.}}</li>{{end}}</ul>
+    {{end}}
+    {{if .Report.Warnings}}
+      <ul>{{range .Report.Warnings}}<li>{{.}}</li>{{end}}</ul>
+    {{end}}
+    <table border="1">
+      <tr><td>Email</td><td>Name</td>{{if .Report.Weighted}}<td>Weight</td>{{end}}<td>Group</td></tr>
+      {{range .Report.Voters}}
+        <tr>
+          <td>{{.Email}}</td>
+          <td>{{.Name}}</td>
+          {{if $.Report.Weighted}}<td>{{.Weight}}</td>{{end}}
+          <td>{{.Group}}</td>
+        </tr>
+      {{end}}
+    </table>
+    {{if .Groups}}
+      Making the election will also change your voter groups:
+      <ul>
+        {{range .Groups}}
+          <li>
+            {{if .Existing}}
+              {{if .Added}}
+                Adds {{range $i, $email := .Added}}{{if $i}}, {{end}}{{$email}}{{end}} to your existing group {{.Name}}.
+              {{else}}
+                Leaves your existing group {{.Name}} as it is, since everyone is already in it.
+              {{end}}
+            {{else}}
+              Makes a new group {{.Name}} with {{len .Added}} voters.
+            {{end}}
+          </li>
+        {{end}}
+      </ul>
+    {{end}}
+    <form action="/make_election" method="post">
+      {{range .Fields}}
+        <input type="hidden" name="{{.Name}}" value="{{.Value}}"/>
+      {{end}}
+      <input type="hidden" name="voters_csv_data" value="{{.Data}}"/>
+      <input type="hidden" name="voters_confirmed" value="yes"/>
+      <input type="submit" value="Begin the Election with these voters"/>
+    </form>
+    If this isn't right, go back to fix the file and upload it again.
+  </body>
+`
+
+// Returns the voters imported from a CSV file on the election form.  If a
+// file was just uploaded then a report of what was found in it is written
+// out instead, along with a form that makes the election once the user
+// confirms it, and done is true.  The report says which of u's groups will
+// be changed.  The candidates' images have already been stored by then, so
+// they are passed along as existing images.
+func importVoters(w http.ResponseWriter, r *http.Request, c appengine.Context, u *user.User, cands []Candidate) (voters []importedVoter, done bool) {
+  if r.FormValue("voters_confirmed") != "" {
+    return parseVoterCSV(strings.NewReader(r.FormValue("voters_csv_data"))).Voters, false
+  }
+  file, _, err := r.FormFile("voters_csv")
+  if err != nil {
+    return nil, false
+  }
+  defer file.Close()
+  data := importTemplateData{Report: parseVoterCSV(file)}
+  data.Data = formatVoterCSV(data.Report.Voters)
+  data.Groups, err = planGroupImports(c, u, data.Report.Voters)
+  if err != nil {
+    htmlWrapBegin(w)
+    defer htmlWrapEnd(w)
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, true
+  }
+
+  replaced := make(map[string]bool)
+  for _, cand := range cands {
+    name := fmt.Sprintf("existing_image%d", cand.Index)
+    replaced[name] = true
+    if cand.Image != "" {
+      data.Fields = append(data.Fields, formField{name, string(cand.Image)})
+    }
+  }
+  for name, values := range r.MultipartForm.Value {
+    if replaced[name] {
+      continue
+    }
+    for _, value := range values {
+      data.Fields = append(data.Fields, formField{name, value})
+    }
+  }
+
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  importTemplate.Execute(w, data)
+  return nil, true
+}
@@ -0,0 +1,134 @@
+package vote
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestParseVoterCSV(t *testing.T) {
+  tests := []struct {
+    name     string
+    in       string
+    voters   []importedVoter
+    weighted bool
+    errors   int
+    warnings int
+  }{
+    {
+      name:   "email only",
+      in:     "alice@example.com\nbob@example.com\n",
+      voters: []importedVoter{{"alice@example.com", "", 1, ""}, {"bob@example.com", "", 1, ""}},
+    },
+    {
+      name:     "header, every column, and an address to normalize",
+      in:       "email,name,weight,group\nAlice@Example.com , Alice, 2, staff\nbob@example.com\n",
+      voters:   []importedVoter{{"alice@example.com", "Alice", 2, "staff"}, {"bob@example.com", "", 1, ""}},
+      weighted: true,
+      warnings: 1,
+    },
+    {
+      name:     "duplicates keep the first row",
+      in:       "alice@example.com,First\nalice@example.com,Second\n",
+      voters:   []importedVoter{{"alice@example.com", "First", 1, ""}},
+      warnings: 1,
+    },
+    {
+      name:     "duplicates ignoring case",
+      in:       "alice@example.com\nALICE@example.com\n",
+      voters:   []importedVoter{{"alice@example.com", "", 1, ""}},
+      warnings: 2,
+    },
+    {
+      name:   "blank lines are skipped",
+      in:     "alice@example.com\n\n,\nbob@example.com\n",
+      voters: []importedVoter{{"alice@example.com", "", 1, ""}, {"bob@example.com", "", 1, ""}},
+    },
+    {
+      name:   "not an address",
+      in:     "alice\nbob@example.com\n",
+      voters: []importedVoter{{"bob@example.com", "", 1, ""}},
+      errors: 1,
+    },
+    {
+      name:   "weight isn't positive",
+      in:     "alice@example.com,,0\nbob@example.com,,x\n",
+      errors: 2,
+    },
+    {
+      name:   "too many columns",
+      in:     "alice@example.com,Alice,1,staff,extra\n",
+      errors: 1,
+    },
+  }
+  for _, test := range tests {
+    report := parseVoterCSV(strings.NewReader(test.in))
+    if !reflect.DeepEqual(report.Voters, test.voters) {
+      t.Errorf("%s: voters = %v, want %v", test.name, report.Voters, test.voters)
+    }
+    if report.Weighted != test.weighted {
+      t.Errorf("%s: weighted = %v, want %v", test.name, report.Weighted, test.weighted)
+    }
+    if len(report.Errors) != test.errors {
+      t.Errorf("%s: errors = %q, want %d of them", test.name, report.Errors, test.errors)
+    }
+    if len(report.Warnings) != test.warnings {
+      t.Errorf("%s: warnings = %q, want %d of them", test.name, report.Warnings, test.warnings)
+    }
+  }
+}
+
+func TestFormatVoterCSV(t *testing.T) {
+  voters := []importedVoter{{"alice@example.com", "Alice, A.", 2, "staff"}, {"bob@example.com", "", 1, ""}}
+  report := parseVoterCSV(strings.NewReader(formatVoterCSV(voters)))
+  if !reflect.DeepEqual(report.Voters, voters) {
+    t.Errorf("read back %v, want %v", report.Voters, voters)
+  }
+}
+
+func TestMergeVoters(t *testing.T) {
+  tests := []struct {
+    name    string
+    emails  []string
+    weights []int
+    voters  []importedVoter
+
+    want_emails  []string
+    want_weights []int
+    want_names   []string
+  }{
+    {
+      name:        "nothing imported",
+      emails:      []string{"a@example.com"},
+      want_emails: []string{"a@example.com"},
+    },
+    {
+      name:        "typed in voters keep their place",
+      emails:      []string{"A@example.com"},
+      voters:      []importedVoter{{"a@example.com", "Alice", 1, ""}, {"b@example.com", "Bob", 1, ""}},
+      want_emails: []string{"A@example.com", "b@example.com"},
+      want_names:  []string{"", "Bob"},
+    },
+    {
+      name:         "weights are padded",
+      emails:       []string{"a@example.com"},
+      voters:       []importedVoter{{"b@example.com", "", 3, ""}},
+      want_emails:  []string{"a@example.com", "b@example.com"},
+      want_weights: []int{1, 3},
+    },
+    {
+      name:         "typed in weights win",
+      emails:       []string{"a@example.com"},
+      weights:      []int{2},
+      voters:       []importedVoter{{"a@example.com", "", 5, ""}},
+      want_emails:  []string{"a@example.com"},
+      want_weights: []int{2},
+    },
+  }
+  for _, test := range tests {
+    emails, weights, names := mergeVoters(test.emails, test.weights, test.voters)
+    if !reflect.DeepEqual(emails, test.want_emails) || !reflect.DeepEqual(weights, test.want_weights) || !reflect.DeepEqual(names, test.want_names) {
+      t.Errorf("%s: mergeVoters = %v, %v, %v, want %v, %v, %v", test.name, emails, weights, names, test.want_emails, test.want_weights, test.want_names)
+    }
+  }
+}
@@ -0,0 +1,300 @@
+package vote
+
+import (
+  "bytes"
+  "fmt"
+  "html/template"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// Majority Judgment: every voter gives every candidate one of the grades in
+// Election.Grades, which are listed best first.  Ballot.Scores[i] is the index
+// into Grades of the grade given to candidate i, so lower is better.  The
+// candidate with the best median grade wins.
+
+// The grades an election uses if the organizer doesn't give any.
+var defaultGrades = []string{"Excellent", "Very good", "Good", "Acceptable", "Poor", "Reject"}
+
+// Reads the grades typed into the election form, one per line, best first.
+func parseGrades(s string) ([]string, error) {
+  var grades []string
+  for _, line := range strings.Split(s, "\n") {
+    if grade := strings.TrimSpace(line); grade != "" {
+      grades = append(grades, grade)
+    }
+  }
+  if len(grades) == 0 {
+    return defaultGrades, nil
+  }
+  if len(grades) < 2 {
+    return nil, &electionError{"Majority Judgment needs at least two grades."}
+  }
+  return grades, nil
+}
+
+// Returns the grades of e, best first.
+func (e *Election) grades() []string {
+  if len(e.Grades) == 0 {
+    return defaultGrades
+  }
+  return e.Grades
+}
+
+// Reads the score_<i> fields of the request, each of which is the index of a
+// grade.  A candidate that isn't graded gets the worst grade.
+func parseGradeBallot(r *http.Request, e *Election, num_candidates int) (*Ballot, error) {
+  worst := len(e.grades()) - 1
+  grades := make([]int, num_candidates)
+  for i := range grades {
+    grade_str := r.FormValue(fmt.Sprintf("score_%d", i))
+    if grade_str == "" {
+      grades[i] = worst
+      continue
+    }
+    grade, err := strconv.Atoi(grade_str)
+    if err != nil || grade < 0 || grade > worst {
+      return nil, &electionError{fmt.Sprintf("The grade given for candidate %d, '%s', is not one of the grades.", i, grade_str)}
+    }
+    grades[i] = grade
+  }
+  return &Ballot{Scores: grades}, nil
+}
+
+func describeGrades(e *Election, cands []Candidate, b *Ballot) []string {
+  grades := e.grades()
+  var sentences []string
+  for i, grade := range b.Scores {
+    sentences = append(sentences, fmt.Sprintf("You grade %s as %s.", cands[i].Name, grades[grade]))
+  }
+  return sentences
+}
+
+// Counts how much weight gave each grade to each candidate.
+func countGrades(e *Election, num_candidates int, ballots []Ballot) *ballotCounts {
+  num_grades := len(e.grades())
+  dist := make([][]int, num_candidates)
+  for i := range dist {
+    dist[i] = make([]int, num_grades)
+  }
+  for _, b := range ballots {
+    if len(b.Scores) != num_candidates {
+      continue
+    }
+    weight := e.VoterWeight(b.Email)
+    for i, grade := range b.Scores {
+      if grade >= 0 && grade < num_grades {
+        dist[i][grade] += weight
+      }
+    }
+  }
+  return &ballotCounts{Grades: dist}
+}
+
+// Returns the median grade of dist, taking the worse of the two middle grades
+// when there is an even number of them, or -1 if dist is empty.
+func medianGrade(dist []int) int {
+  total := 0
+  for _, n := range dist {
+    total += n
+  }
+  if total == 0 {
+    return -1
+  }
+  // Counting up from the worst grade, the median is the grade that the
+  // (total-1)/2'th vote falls in.
+  position := (total - 1) / 2
+  seen := 0
+  for grade := len(dist) - 1; grade >= 0; grade-- {
+    seen += dist[grade]
+    if seen > position {
+      return grade
+    }
+  }
+  return 0
+}
+
+// Compares two grade distributions the Majority Judgment way.  If their
+// medians differ then the better median wins.  Otherwise one vote of the
+// median grade is taken away from each and the medians are compared again,
+// until they differ or there are no votes left.  Returns a negative number
+// if a is better, positive if b is better, and 0 if they are tied all the way
+// down.
+func compareGrades(a, b []int) int {
+  a = append([]int(nil), a...)
+  b = append([]int(nil), b...)
+  for {
+    ma, mb := medianGrade(a), medianGrade(b)
+    switch {
+    case ma < 0 || mb < 0:
+      return 0
+    case ma != mb:
+      return ma - mb
+    }
+    // Weighted votes can add up to a lot, so rather than taking votes away
+    // one at a time, as many are taken away at once as can be without
+    // either median changing in between.
+    n := 1 + min(steadyMedian(a, ma), steadyMedian(b, mb))
+    a[ma] -= n
+    b[mb] -= n
+  }
+}
+
+// Returns how many more votes of grade g, the median of dist, can be taken
+// away from dist with the median staying g after every one of them.
+func steadyMedian(dist []int, g int) int {
+  worse, total := 0, 0
+  for grade, n := range dist {
+    total += n
+    if grade > g {
+      worse += n
+    }
+  }
+  // After k votes are taken away the median is still g as long as it falls
+  // after the worse votes and before the end of the votes of grade g, both
+  // of which get harder as k grows.
+  steady := func(k int) bool {
+    position := (total - 1 - k) / 2
+    return total-k > 0 && worse <= position && position < worse+dist[g]-k
+  }
+  lo, hi := 0, dist[g]-1
+  for lo < hi {
+    mid := (lo + hi + 1) / 2
+    if steady(mid) {
+      lo = mid
+    } else {
+      hi = mid - 1
+    }
+  }
+  return lo
+}
+
+type byGrades struct {
+  cands []int
+  dist  [][]int
+}
+
+func (g byGrades) Len() int      { return len(g.cands) }
+func (g byGrades) Swap(i, j int) { g.cands[i], g.cands[j] = g.cands[j], g.cands[i] }
+func (g byGrades) Less(i, j int) bool {
+  if c := compareGrades(g.dist[g.cands[i]], g.dist[g.cands[j]]); c != 0 {
+    return c < 0
+  }
+  return g.cands[i] < g.cands[j]
+}
+
+func rankGrades(counts *ballotCounts) ([][]int, *starRunoff) {
+  sorted := allCandidates(len(counts.Grades))
+  sort.Sort(byGrades{sorted, counts.Grades})
+  var ranks [][]int
+  for i, c := range sorted {
+    if i > 0 && compareGrades(counts.Grades[sorted[i-1]], counts.Grades[c]) == 0 {
+      ranks[len(ranks)-1] = append(ranks[len(ranks)-1], c)
+      continue
+    }
+    ranks = append(ranks, []int{c})
+  }
+  return ranks, nil
+}
+
+var judgmentBallotTemplate = template.Must(template.New("judgment_ballot").Parse(judgmentBallotTemplateHTML))
+
+const judgmentBallotTemplateHTML = `
+    Give each candidate a grade.  The candidate with the best median grade
+    wins.
+    <table>
+    {{range $index,$cand := .Scored}}
+      <tr>
+        <td>{{.Name}}</td>
+        <td><img src="/serve/image.jpg?blobKey={{.Image}}"></img></td>
+        <td>
+          {{range .Options}}
+            <input type="radio" name="{{$.Prefix}}score_{{$index}}" value="{{.Score}}" {{if .Selected}}checked{{end}}/>{{.Grade}}
+          {{end}}
+        </td>
+      </tr>
+    {{end}}
+    </table>
+`
+
+// The colors of the grades in the chart, from best to worst.  Scales with
+// a different number of grades pick colors spread out along this one.
+var gradeColors = []string{"#1a9850", "#66bd63", "#a6d96a", "#d9ef8b", "#fee08b", "#fdae61", "#f46d43", "#d73027"}
+
+func gradeColor(grade, num_grades int) string {
+  if num_grades <= 1 {
+    return gradeColors[0]
+  }
+  return gradeColors[grade*(len(gradeColors)-1)/(num_grades-1)]
+}
+
+// Draws the grade distribution of each candidate as a horizontal bar, best
+// grades on the left, with a line down the middle to show where the median
+// falls.  Candidates are drawn in the order they were ranked.
+func gradeChart(e *Election, cands []Candidate, ranks [][]int, dist [][]int) template.HTML {
+  const (
+    label_width = 150
+    bar_width   = 400
+    bar_height  = 24
+    gap         = 8
+  )
+  grades := e.grades()
+  var order []int
+  for _, tier := range ranks {
+    order = append(order, tier...)
+  }
+  legend_y := len(order) * (bar_height + gap)
+  height := legend_y + 2*bar_height
+  var svg bytes.Buffer
+  fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">`, label_width+bar_width+10, height)
+  for row, c := range order {
+    y := row * (bar_height + gap)
+    fmt.Fprintf(&svg, `<text x="0" y="%d">%s</text>`, y+bar_height*2/3, template.HTMLEscapeString(cands[c].Name))
+    total := 0
+    for _, n := range dist[c] {
+      total += n
+    }
+    x := float64(label_width)
+    for grade, n := range dist[c] {
+      if total == 0 || n == 0 {
+        continue
+      }
+      w := float64(bar_width) * float64(n) / float64(total)
+      fmt.Fprintf(&svg, `<rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s"><title>%s: %d</title></rect>`,
+        x, y, w, bar_height, gradeColor(grade, len(grades)), template.HTMLEscapeString(grades[grade]), n)
+      x += w
+    }
+  }
+  mid := label_width + bar_width/2
+  fmt.Fprintf(&svg, `<line x1="%d" y1="0" x2="%d" y2="%d" stroke="#000" stroke-dasharray="4,2"/>`, mid, mid, legend_y-gap)
+  x := label_width
+  for grade, name := range grades {
+    fmt.Fprintf(&svg, `<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`, x, legend_y+4, gradeColor(grade, len(grades)))
+    fmt.Fprintf(&svg, `<text x="%d" y="%d">%s</text>`, x+16, legend_y+14, template.HTMLEscapeString(name))
+    x += 16 + 8*len(name) + 8
+  }
+  svg.WriteString(`</svg>`)
+  return template.HTML(svg.String())
+}
+
+// The median grade of one candidate, for the results page.
+type candidateMedian struct {
+  Candidate Candidate
+  Median    string
+}
+
+func candidateMedians(e *Election, cands []Candidate, ranks [][]int, dist [][]int) []candidateMedian {
+  var medians []candidateMedian
+  for _, tier := range ranks {
+    for _, c := range tier {
+      m := candidateMedian{Candidate: cands[c], Median: "none"}
+      if g := medianGrade(dist[c]); g >= 0 {
+        m.Median = e.grades()[g]
+      }
+      medians = append(medians, m)
+    }
+  }
+  return medians
+}
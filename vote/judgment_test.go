@@ -0,0 +1,160 @@
+package vote
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestMedianGrade(t *testing.T) {
+  tests := []struct {
+    name string
+    dist []int
+    want int
+  }{
+    {"no votes", []int{0, 0, 0}, -1},
+    {"one vote", []int{0, 0, 1}, 2},
+    {"odd count", []int{3, 0, 0, 2}, 0},
+    {"even count takes the worse middle grade", []int{1, 1, 1, 1}, 2},
+    {"even split", []int{2, 2}, 1},
+    {"weighted", []int{0, 5, 1}, 1},
+    {"weighted even split", []int{1000000, 1000000}, 1},
+  }
+  for _, test := range tests {
+    if got := medianGrade(test.dist); got != test.want {
+      t.Errorf("%s: medianGrade(%v) = %d, want %d", test.name, test.dist, got, test.want)
+    }
+  }
+}
+
+func TestSteadyMedian(t *testing.T) {
+  tests := []struct {
+    name string
+    dist []int
+    g    int
+    want int
+  }{
+    {"median changes after one", []int{1, 1, 1, 1}, 2, 0},
+    {"only one grade", []int{0, 10, 0}, 1, 9},
+    {"worse votes catch up", []int{5, 5, 5}, 1, 4},
+    {"weighted even split", []int{1000000, 1000000}, 1, 0},
+  }
+  for _, test := range tests {
+    if got := steadyMedian(test.dist, test.g); got != test.want {
+      t.Errorf("%s: steadyMedian(%v, %d) = %d, want %d", test.name, test.dist, test.g, got, test.want)
+    }
+  }
+}
+
+func sign(x int) int {
+  switch {
+  case x < 0:
+    return -1
+  case x > 0:
+    return 1
+  }
+  return 0
+}
+
+func TestCompareGrades(t *testing.T) {
+  tests := []struct {
+    name string
+    a, b []int
+    want int
+  }{
+    {"better median", []int{3, 0, 0}, []int{0, 3, 0}, -1},
+    {"worse median", []int{0, 3, 0}, []int{3, 0, 0}, 1},
+    {"same median, more above it", []int{2, 3, 1}, []int{1, 3, 2}, -1},
+    {"identical", []int{2, 3, 1}, []int{2, 3, 1}, 0},
+    {"nobody voted", []int{0, 0}, []int{0, 0}, 0},
+    {"even count, decided by the next median", []int{1, 1}, []int{0, 2}, -1},
+    {"even count, decided after removing one", []int{1, 2, 1}, []int{2, 1, 1}, 1},
+    {"weighted tie all the way down", []int{1000000, 1000000}, []int{1000000, 1000000}, 0},
+    {"weighted, same median, more above it", []int{500000, 1000000, 500001}, []int{500001, 1000000, 500000}, 1},
+  }
+  for _, test := range tests {
+    a := append([]int(nil), test.a...)
+    b := append([]int(nil), test.b...)
+    if got := sign(compareGrades(a, b)); got != test.want {
+      t.Errorf("%s: compareGrades(%v, %v) has sign %d, want %d", test.name, test.a, test.b, got, test.want)
+    }
+    if !reflect.DeepEqual(a, test.a) || !reflect.DeepEqual(b, test.b) {
+      t.Errorf("%s: compareGrades changed its arguments", test.name)
+    }
+  }
+}
+
+// Compares a and b by taking away one vote of the median grade at a time,
+// which is what compareGrades does more quickly.
+func compareGradesSlowly(a, b []int) int {
+  a = append([]int(nil), a...)
+  b = append([]int(nil), b...)
+  for {
+    ma, mb := medianGrade(a), medianGrade(b)
+    if ma < 0 || mb < 0 {
+      return 0
+    }
+    if ma != mb {
+      return ma - mb
+    }
+    a[ma]--
+    b[mb]--
+  }
+}
+
+func TestCompareGradesMatchesOneAtATime(t *testing.T) {
+  // A fixed sequence, so that any failure can be reproduced.
+  seed := uint32(1)
+  next := func(n int) int {
+    seed = seed*1103515245 + 12345
+    return int(seed>>16) % n
+  }
+  for trial := 0; trial < 5000; trial++ {
+    num_grades := 2 + next(4)
+    a := make([]int, num_grades)
+    b := make([]int, num_grades)
+    for i := 1 + next(30); i > 0; i-- {
+      a[next(num_grades)] += 1 + next(3)
+      b[next(num_grades)] += 1 + next(3)
+    }
+    if got, want := sign(compareGrades(a, b)), sign(compareGradesSlowly(a, b)); got != want {
+      t.Fatalf("compareGrades(%v, %v) has sign %d, want %d", a, b, got, want)
+    }
+  }
+}
+
+func TestRankGrades(t *testing.T) {
+  tests := []struct {
+    name string
+    dist [][]int
+    want [][]int
+  }{
+    {"different medians", [][]int{{0, 3, 0}, {3, 0, 0}, {0, 0, 3}}, [][]int{{1}, {0}, {2}}},
+    {"tie broken below the median", [][]int{{1, 3, 2}, {2, 3, 1}, {0, 0, 6}}, [][]int{{1}, {0}, {2}}},
+    {"exact tie", [][]int{{1, 1}, {1, 1}, {0, 2}}, [][]int{{0, 1}, {2}}},
+  }
+  for _, test := range tests {
+    got, _ := rankGrades(&ballotCounts{Grades: test.dist})
+    if !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: rankGrades(%v) = %v, want %v", test.name, test.dist, got, test.want)
+    }
+  }
+}
+
+func TestCountGrades(t *testing.T) {
+  e := &Election{
+    Ballot_type: ballotJudgment,
+    Grades:      []string{"Good", "Fair", "Poor"},
+    Emails:      []string{"a@example.com", "b@example.com"},
+    Weights:     []int{3, 1},
+  }
+  ballots := []Ballot{
+    {Email: "a@example.com", Scores: []int{0, 2}},
+    {Email: "b@example.com", Scores: []int{1, 2}},
+    // Ballots that don't grade every candidate aren't counted.
+    {Email: "b@example.com", Scores: []int{0}},
+  }
+  want := [][]int{{3, 1, 0}, {0, 0, 4}}
+  if got := countGrades(e, 2, ballots).Grades; !reflect.DeepEqual(got, want) {
+    t.Errorf("countGrades = %v, want %v", got, want)
+  }
+}
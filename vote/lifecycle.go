@@ -0,0 +1,347 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "fmt"
+  "net/http"
+  "strings"
+  "time"
+)
+
+func init() {
+  http.HandleFunc("/cron/elections", runLifecycle)
+  http.HandleFunc("/tasks/backfill_lifecycle", backfillLifecycle)
+}
+
+// Voters are reminded this long before an election closes, or halfway
+// through if the election is shorter than twice this.
+const reminderLead = 24 * time.Hour
+
+func (e *Election) reminderTime() time.Time {
+  lead := reminderLead
+  if half := e.End.Sub(e.Start) / 2; half < lead {
+    lead = half
+  }
+  return e.End.Add(-lead)
+}
+
+// Returns the voters in e's electorate that haven't cast a Ballot or
+// delegated their vote yet.  Nobody is returned if some of the ballots are
+// too old to say who cast them.
+func votersWithoutBallots(c appengine.Context, key *datastore.Key, e *Election) ([]string, error) {
+  electorate, err := e.Electorate(c)
+  if err != nil {
+    return nil, err
+  }
+  voted := make(map[string]bool)
+  query := datastore.NewQuery("Ballot").Ancestor(key)
+  it := query.Run(c)
+  for {
+    var b Ballot
+    _, err := it.Next(&b)
+    if err == datastore.Done {
+      break
+    }
+    if err != nil {
+      return nil, err
+    }
+    if b.Email == "" {
+      // Ballots cast before Ballot had an Email can't be matched up with
+      // anyone, so there's no telling who hasn't voted.
+      return nil, nil
+    }
+    voted[strings.ToLower(b.Email)] = true
+  }
+  // Someone that has delegated their vote has voted as far as reminders go.
+  var delegations []Delegation
+  _, err = datastore.NewQuery("Delegation").Ancestor(key).GetAll(c, &delegations)
+  if err != nil {
+    return nil, err
+  }
+  for _, d := range delegations {
+    voted[strings.ToLower(d.Email)] = true
+  }
+  var missing []string
+  for _, email := range electorate {
+    if !voted[strings.ToLower(email)] {
+      missing = append(missing, email)
+    }
+  }
+  return missing, nil
+}
+
+// Returns true if any Ballots or Delegations in the Election with the given
+// key became viewable after from and no later than to.
+func ballotsBecameViewable(c appengine.Context, key *datastore.Key, from, to time.Time) (bool, error) {
+  for _, kind := range []string{"Ballot", "Delegation"} {
+    query := datastore.NewQuery(kind).Ancestor(key).
+        Filter("Viewable >", from).
+        Filter("Viewable <=", to).
+        KeysOnly().
+        Limit(1)
+    keys, err := query.GetAll(c, nil)
+    if err != nil || len(keys) > 0 {
+      return len(keys) > 0, err
+    }
+  }
+  return false, nil
+}
+
+// The steps of an Election's lifecycle that one run of advanceLifecycle has
+// marked as done, and so has to carry out.
+type lifecycleSteps struct {
+  open, remind, extend, close, results bool
+
+  // Ballots that became viewable after refresh_from and no later than
+  // refresh_to haven't been announced yet.  Both are zero if there is
+  // nothing to check.
+  refresh_from, refresh_to time.Time
+}
+
+// Works out which steps of e's lifecycle are due as of now, and marks them as
+// done in e.  members are the current members of e's groups, and report is
+// e's quorum, or nil if it couldn't be checked, in which case e closes
+// anyway.  check_quorum is false if the quorum wasn't looked at because e
+// didn't seem to be closing yet.
+func (e *Election) claimLifecycleSteps(now time.Time, members []string, check_quorum bool, report *quorumReport) lifecycleSteps {
+  var steps lifecycleSteps
+  if !e.Opened && !now.Before(e.Start) {
+    e.Group_emails = members
+    e.Snapshot_time = now
+    e.Opened = true
+    steps.open = true
+  }
+  if e.Opened && !e.Reminded && !now.Before(e.reminderTime()) && now.Before(e.End) {
+    e.Reminded = true
+    steps.remind = true
+  }
+  if e.Opened && !e.Closed && e.Refresh_interval > 0 && now.Before(e.End) {
+    boundary := refreshBoundary(e, now)
+    if boundary.After(e.Last_refresh) {
+      steps.refresh_from = e.Last_refresh
+      steps.refresh_to = boundary
+      e.Last_refresh = boundary
+    }
+  }
+  if e.Opened && !e.Closed && !now.Before(e.End) && (!e.hasQuorum() || check_quorum) {
+    if report != nil && e.hasQuorum() && extendForQuorum(e, report) {
+      steps.extend = true
+    } else {
+      e.Closed = true
+      steps.close = true
+    }
+  }
+  // Nobody is told that the results are ready until every ballot cast before
+  // End is in them.
+  if e.Closed && !e.Results_sent && !now.Before(e.finalBoundary()) {
+    e.Results_sent = true
+    steps.results = true
+  }
+  return steps
+}
+
+// Moves the Election with the given key along in its lifecycle as of now,
+// doing whatever needs to be done at each step.  The steps that are due are
+// marked as done in a transaction that gets the Election again, so that
+// nothing else that changed it in the meantime is lost and no step is done
+// twice by runs that overlap.  Only then are the invitations, reminders and
+// webhooks sent out.
+func advanceLifecycle(c appengine.Context, key *datastore.Key, now time.Time) error {
+  var e Election
+  err := datastore.Get(c, key, &e)
+  if err != nil {
+    return err
+  }
+  // The groups and the quorum can't be looked up in the transaction, since
+  // they aren't in the Election's entity group.
+  var members []string
+  if !e.Opened && !now.Before(e.Start) {
+    members, err = groupMembers(c, e.Groups)
+    if err != nil {
+      // Try again next time rather than opening with the wrong voters.
+      return fmt.Errorf("unable to take a snapshot of the groups: %v", err)
+    }
+  }
+  var report *quorumReport
+  check_quorum := !e.Closed && !now.Before(e.End) && e.hasQuorum()
+  if check_quorum {
+    report, err = checkQuorum(c, key, &e)
+    if err != nil {
+      // Better to close on time than to hold the election open forever.
+      c.Errorf("Unable to check the quorum of %s: %v", e.Key_str, err)
+    }
+  }
+  var steps lifecycleSteps
+  err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+    e = Election{}
+    err := datastore.Get(c, key, &e)
+    if err != nil {
+      return err
+    }
+    steps = e.claimLifecycleSteps(now, members, check_quorum, report)
+    if steps == (lifecycleSteps{}) {
+      return nil
+    }
+    _, err = datastore.Put(c, key, &e)
+    return err
+  }, nil)
+  if err != nil {
+    return err
+  }
+
+  if steps.open {
+    // An election that cron first sees after it has ended is opened and
+    // closed in one go, and inviting anyone to it would be pointless.
+    if now.Before(e.End) {
+      sendInvitations(c, &e)
+    }
+    fireWebhooks(c, key, &e, &webhookPayload{Event: eventOpened})
+    recordAudit(c, key, "", "Opened voting and sent the invitations")
+  }
+  if steps.remind {
+    to, err := votersWithoutBallots(c, key, &e)
+    if err != nil {
+      c.Errorf("Unable to find voters to remind for %s: %v", e.Key_str, err)
+    } else {
+      sendReminders(c, &e, to)
+      recordAudit(c, key, "", "Reminded %d voters that haven't voted", len(to))
+    }
+  }
+  if !steps.refresh_to.IsZero() {
+    refreshed, err := ballotsBecameViewable(c, key, steps.refresh_from, steps.refresh_to)
+    if err != nil {
+      c.Errorf("Unable to check for new ballots in %s: %v", e.Key_str, err)
+    } else if refreshed {
+      payload, err := resultsPayload(c, key, &e, eventResultsRefreshed, now)
+      if err != nil {
+        c.Errorf("Unable to count %s: %v", e.Key_str, err)
+      } else {
+        fireWebhooks(c, key, &e, payload)
+      }
+    }
+  }
+  if steps.extend {
+    recordAudit(c, key, "", "Quorum not reached with %d of %d, extended voting until %v", report.Cast, report.Required, e.End)
+    // Voting is open again, so the number of voters is only given roughly,
+    // the same as for results_refreshed events.
+    payload := &webhookPayload{Event: eventExtended}
+    if report.Cast > 0 {
+      payload.Voters = blurNumber(report.Cast)
+    }
+    fireWebhooks(c, key, &e, payload)
+  }
+  if steps.close {
+    if report != nil {
+      recordAudit(c, key, "", "%s", quorumOutcome(report))
+    }
+    payload, err := resultsPayload(c, key, &e, eventClosed, e.finalBoundary())
+    if err != nil {
+      c.Errorf("Unable to count %s: %v", e.Key_str, err)
+      payload = &webhookPayload{Event: eventClosed}
+    }
+    payload.Non_binding = e.Non_binding
+    fireWebhooks(c, key, &e, payload)
+    recordAudit(c, key, "", "Closed voting")
+    err = makeRunoff(c, key, &e)
+    if err != nil {
+      // The election is closed either way, the runoff can be made by hand.
+      c.Errorf("Unable to make a runoff for %s: %v", e.Key_str, err)
+    }
+    if e.Runoff_key != nil {
+      err = setRunoff(c, key, e.Runoff_key)
+      if err != nil {
+        c.Errorf("Unable to store the runoff of %s: %v", e.Key_str, err)
+      }
+    }
+  }
+  if steps.results {
+    sendResultsReady(c, &e)
+  }
+  return nil
+}
+
+// Records that the Election with the given key has the runoff with the key
+// runoff_key.
+func setRunoff(c appengine.Context, key, runoff_key *datastore.Key) error {
+  return datastore.RunInTransaction(c, func(c appengine.Context) error {
+    var e Election
+    err := datastore.Get(c, key, &e)
+    if err != nil {
+      return err
+    }
+    e.Runoff_key = runoff_key
+    _, err = datastore.Put(c, key, &e)
+    return err
+  }, nil)
+}
+
+// Called by cron, checks every Election that hasn't closed yet to see if it
+// has opened, needs its voters reminded, or has closed, and every Election
+// that has closed to see if its results are ready.
+func runLifecycle(w http.ResponseWriter, r *http.Request) {
+  c := appengine.NewContext(r)
+  now := time.Now()
+  keys, err := datastore.NewQuery("Election").Filter("Closed =", false).KeysOnly().GetAll(c, nil)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  closed, err := datastore.NewQuery("Election").Filter("Closed =", true).Filter("Results_sent =", false).KeysOnly().GetAll(c, nil)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  for _, key := range append(keys, closed...) {
+    err := advanceLifecycle(c, key, now)
+    if err != nil {
+      c.Errorf("Unable to update election %s: %v", key.Encode(), err)
+    }
+  }
+}
+
+// Elections stored before Opened, Reminded, Closed and Results_sent existed
+// don't have those properties at all, so the queries in runLifecycle never
+// find them.  Run once by an admin, this stores the properties on every such
+// election, marking each step whose time has already passed as done, so that
+// nobody gets invitations, reminders or results for an old election.
+func backfillLifecycle(w http.ResponseWriter, r *http.Request) {
+  c := appengine.NewContext(r)
+  now := time.Now()
+  current, err := datastore.NewQuery("Election").Filter("Closed =", false).KeysOnly().GetAll(c, nil)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  has_properties := make(map[string]bool)
+  for _, key := range current {
+    has_properties[key.String()] = true
+  }
+  it := datastore.NewQuery("Election").Run(c)
+  count := 0
+  for {
+    var e Election
+    key, err := it.Next(&e)
+    if err == datastore.Done {
+      break
+    }
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    if e.Closed || has_properties[key.String()] {
+      continue
+    }
+    e.Opened = !now.Before(e.Start)
+    e.Reminded = !now.Before(e.reminderTime())
+    e.Closed = !now.Before(e.End)
+    e.Results_sent = e.Closed
+    _, err = datastore.Put(c, key, &e)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    count++
+  }
+  fmt.Fprintf(w, "Updated %d elections.", count)
+}
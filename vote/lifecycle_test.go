@@ -0,0 +1,117 @@
+package vote
+
+import (
+  "testing"
+  "time"
+)
+
+// Returns whether a and b are the same steps, with the refresh times at the
+// same instants.
+func sameSteps(a, b lifecycleSteps) bool {
+  if !a.refresh_from.Equal(b.refresh_from) || !a.refresh_to.Equal(b.refresh_to) {
+    return false
+  }
+  a.refresh_from, a.refresh_to = b.refresh_from, b.refresh_to
+  return a == b
+}
+
+func TestClaimLifecycleSteps(t *testing.T) {
+  start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+  end := start.Add(10 * 24 * time.Hour)
+  refreshed := end.Add(-5 * time.Hour)
+  election := func() *Election {
+    return &Election{Start: start, End: end, Refresh_interval: int64(time.Hour), Last_refresh: refreshed}
+  }
+  opened := func() *Election {
+    e := election()
+    e.Opened = true
+    e.Reminded = true
+    return e
+  }
+  closed := func() *Election {
+    e := opened()
+    e.Closed = true
+    return e
+  }
+  with_quorum := func() *Election {
+    e := opened()
+    e.Quorum_count = 5
+    e.Quorum_extension = int64(24 * time.Hour)
+    e.Max_extensions = 1
+    return e
+  }
+  tests := []struct {
+    name         string
+    e            *Election
+    now          time.Time
+    check_quorum bool
+    report       *quorumReport
+
+    want lifecycleSteps
+  }{
+    {name: "before voting opens", e: election(), now: start.Add(-time.Hour)},
+    {name: "opening", e: election(), now: start.Add(time.Minute), want: lifecycleSteps{open: true}},
+    {
+      name: "reminding",
+      e:    &Election{Start: start, End: end, Opened: true},
+      now:  end.Add(-time.Hour),
+      want: lifecycleSteps{remind: true},
+    },
+    {
+      name: "new ballots might be viewable",
+      e:    opened(),
+      now:  refreshed.Add(90 * time.Minute),
+      want: lifecycleSteps{refresh_from: refreshed, refresh_to: refreshed.Add(time.Hour)},
+    },
+    {name: "closing", e: opened(), now: end.Add(time.Minute), want: lifecycleSteps{close: true}},
+    {name: "results not ready yet", e: closed(), now: end.Add(2 * time.Hour)},
+    {name: "results ready", e: closed(), now: end.Add(3 * time.Hour), want: lifecycleSteps{results: true}},
+    {
+      name: "everything at once",
+      e:    election(),
+      now:  end.Add(3 * time.Hour),
+      want: lifecycleSteps{open: true, close: true, results: true},
+    },
+    {
+      name:         "quorum not reached",
+      e:            with_quorum(),
+      now:          end.Add(time.Minute),
+      check_quorum: true,
+      report:       &quorumReport{Required: 5, Cast: 2},
+      want:         lifecycleSteps{extend: true},
+    },
+    {
+      name:         "quorum reached",
+      e:            with_quorum(),
+      now:          end.Add(time.Minute),
+      check_quorum: true,
+      report:       &quorumReport{Required: 5, Cast: 5, Met: true},
+      want:         lifecycleSteps{close: true},
+    },
+    {
+      name:         "quorum couldn't be checked",
+      e:            with_quorum(),
+      now:          end.Add(time.Minute),
+      check_quorum: true,
+      want:         lifecycleSteps{close: true},
+    },
+    {name: "quorum wasn't looked at", e: with_quorum(), now: end.Add(time.Minute)},
+  }
+  for _, test := range tests {
+    steps := test.e.claimLifecycleSteps(test.now, nil, test.check_quorum, test.report)
+    if !sameSteps(steps, test.want) {
+      t.Errorf("%s: steps %+v, want %+v", test.name, steps, test.want)
+    }
+    // Whatever was claimed is marked as done, so claiming again does nothing,
+    // unless voting was extended, which starts it all over again.
+    if test.want.extend {
+      if test.e.End.Equal(end) || test.e.Reminded {
+        t.Errorf("%s: still ends at %v, reminded = %v", test.name, test.e.End, test.e.Reminded)
+      }
+      continue
+    }
+    if again := test.e.claimLifecycleSteps(test.now, nil, test.check_quorum, test.report); again != (lifecycleSteps{}) {
+      t.Errorf("%s: claimed %+v a second time", test.name, again)
+    }
+  }
+}
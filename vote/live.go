@@ -0,0 +1,229 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+func init() {
+  http.HandleFunc("/results.json", resultsJSONHandler)
+  http.HandleFunc("/results_events", resultsEvents)
+}
+
+// The results of an election as sent to browsers and other programs.
+type resultsSnapshot struct {
+  Num_votes int        `json:"num_votes"`
+  Ranks     [][]string `json:"ranks"`
+
+  // Pairwise[i][j] is the number of votes that preferred the ith candidate
+  // to the jth, in the same order as the candidates on the ballot.
+  Pairwise [][]int `json:"pairwise"`
+
+  // For approval, score and STAR ballots, the approvals or total score of
+  // each candidate, and for STAR, the automatic runoff.
+  Totals []int       `json:"totals,omitempty"`
+  Runoff *starRunoff `json:"runoff,omitempty"`
+
+  // For Majority Judgment, Grades[i][g] is the number of votes that gave
+  // the ith candidate the gth grade, best grade first.
+  Grades [][]int `json:"grades,omitempty"`
+
+  // Left out for kinds of ballot that don't have pairwise counts.
+  Condorcet *condorcetReport `json:"condorcet,omitempty"`
+
+  // See the disclosure policy in disclosure.go.
+  Withheld bool `json:"withheld"`
+  Noisy    bool `json:"noisy"`
+
+  // Left out if the election doesn't have a quorum.
+  Quorum      *quorumReport `json:"quorum,omitempty"`
+  Non_binding bool          `json:"non_binding"`
+
+  // The results of the other questions on the ballot, if there are any,
+  // in order.  The fields above are for the first question.
+  Questions []questionSnapshot `json:"questions,omitempty"`
+
+  // The results can't change before this time.
+  Next_refresh time.Time `json:"next_refresh"`
+
+  // Once an election is closed its results won't ever change again.
+  Closed bool `json:"closed"`
+}
+
+// The results of one of the later questions on the ballot of an election,
+// with the same fields as resultsSnapshot has for the first question.
+type questionSnapshot struct {
+  Title    string      `json:"title"`
+  Ranks    [][]string  `json:"ranks"`
+  Pairwise [][]int     `json:"pairwise"`
+  Totals   []int       `json:"totals,omitempty"`
+  Runoff   *starRunoff `json:"runoff,omitempty"`
+  Grades   [][]int     `json:"grades,omitempty"`
+  Withheld bool        `json:"withheld"`
+  Noisy    bool        `json:"noisy"`
+
+  Condorcet *condorcetReport `json:"condorcet,omitempty"`
+}
+
+// Returns the start of the Refresh_interval that now is in, which is the
+// last time that any ballot could have become viewable.
+func refreshBoundary(e *Election, now time.Time) time.Time {
+  if e.Refresh_interval <= 0 {
+    return now
+  }
+  return time.Unix(0, now.UnixNano()-now.UnixNano()%e.Refresh_interval)
+}
+
+// Returns the time by which every Ballot cast before e.End is viewable.
+// Ballots cast right before End aren't viewable until a couple of
+// Refresh_intervals later, and a final count has to include all of them.
+func (e *Election) finalBoundary() time.Time {
+  return e.End.Add(2*time.Duration(e.Refresh_interval) + time.Second)
+}
+
+// Returns whether voting in e is over as of now.  An election with a quorum
+// might still be extended once End has passed, so it isn't over until the
+// lifecycle has closed it.
+func (e *Election) votingClosed(now time.Time) bool {
+  return e.Closed || (!now.Before(e.End) && !e.hasQuorum())
+}
+
+// Loads the Election specified by the key in the request, making sure that
+// its results can be shown to the current user right now.
+func getElectionWithResults(w http.ResponseWriter, r *http.Request, c appengine.Context) (*datastore.Key, *Election, bool) {
+  key, err := datastore.DecodeKey(r.FormValue("key"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, nil, false
+  }
+  var e Election
+  err = datastore.Get(c, key, &e)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, nil, false
+  }
+  if !checkCanView(w, c, key, &e) {
+    return nil, nil, false
+  }
+  if e.Hide_results && e.End.After(time.Now()) {
+    http.Error(w, "Results of this election will not be available until voting is closed.", http.StatusInternalServerError)
+    return nil, nil, false
+  }
+  return key, &e, true
+}
+
+func takeSnapshot(c appengine.Context, key *datastore.Key, e *Election, now time.Time) (*resultsSnapshot, error) {
+  tallies, err := tallyQuestions(c, key, e, now)
+  if err != nil {
+    return nil, err
+  }
+  t := tallies[0]
+  snapshot := &resultsSnapshot{
+    Num_votes:    blurNumber(t.Num_votes),
+    Ranks:        rankNames(t),
+    Pairwise:     t.Pairwise,
+    Totals:       t.Totals,
+    Runoff:       t.Runoff,
+    Grades:       t.Grades,
+    Condorcet:    condorcetAnalysis(t.Candidates, t.Pairwise),
+    Withheld:     t.Withheld,
+    Noisy:        t.Noisy,
+    Non_binding:  e.Non_binding,
+    Next_refresh: refreshBoundary(e, now).Add(time.Duration(e.Refresh_interval)),
+    Closed:       e.votingClosed(now),
+  }
+  for _, t := range tallies[1:] {
+    snapshot.Questions = append(snapshot.Questions, questionSnapshot{
+      Title:    t.Title,
+      Ranks:    rankNames(t),
+      Pairwise: t.Pairwise,
+      Totals:   t.Totals,
+      Runoff:   t.Runoff,
+      Grades:   t.Grades,
+      Withheld: t.Withheld,
+      Noisy:    t.Noisy,
+
+      Condorcet: condorcetAnalysis(t.Candidates, t.Pairwise),
+    })
+  }
+  if e.hasQuorum() {
+    snapshot.Quorum, err = publishedQuorum(c, key, e, now)
+    if err != nil {
+      return nil, err
+    }
+  }
+  return snapshot, nil
+}
+
+func resultsJSONHandler(w http.ResponseWriter, r *http.Request) {
+  c := appengine.NewContext(r)
+  key, e, ok := getElectionWithResults(w, r, c)
+  if !ok {
+    return
+  }
+  snapshot, err := takeSnapshot(c, key, e, time.Now())
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(snapshot)
+}
+
+// Server-Sent Events stream of the results of an election.
+//
+// App Engine buffers the whole response before sending any of it, so rather
+// than holding the connection open we send the current results and close it,
+// telling the browser to reconnect right after the next Refresh_interval
+// boundary.  The id of each event is the boundary it was computed at, which
+// the browser sends back as Last-Event-ID, so that nothing is sent if no
+// ballots have become viewable since then.
+func resultsEvents(w http.ResponseWriter, r *http.Request) {
+  c := appengine.NewContext(r)
+  key, e, ok := getElectionWithResults(w, r, c)
+  if !ok {
+    return
+  }
+  now := time.Now()
+  boundary := refreshBoundary(e, now)
+
+  // Give the browser an extra second so that it doesn't show up just before
+  // the boundary.
+  retry := boundary.Add(time.Duration(e.Refresh_interval) + time.Second).Sub(now)
+  if retry < time.Second {
+    retry = time.Second
+  }
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  fmt.Fprintf(w, "retry: %d\n", retry/time.Millisecond)
+
+  if last, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+    changed, err := ballotsBecameViewable(c, key, time.Unix(0, last), boundary)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    if !changed && now.Before(e.End) {
+      fmt.Fprintf(w, "id: %d\n\n", last)
+      return
+    }
+  }
+
+  snapshot, err := takeSnapshot(c, key, e, now)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  data, err := json.Marshal(snapshot)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  fmt.Fprintf(w, "id: %d\ndata: %s\n\n", boundary.UnixNano(), data)
+}
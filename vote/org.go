@@ -0,0 +1,350 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "appengine/user"
+  "fmt"
+  "html/template"
+  "net/http"
+  "strings"
+  "time"
+)
+
+func init() {
+  http.HandleFunc("/orgs", viewOrgs)
+  http.HandleFunc("/org", viewOrg)
+  http.HandleFunc("/save_org", saveOrg)
+}
+
+// An Organization is a team of people that share elections and voter groups.
+// Elections and VoterGroups that belong to an Organization can only be seen
+// by its members, and by anyone that has been given a role in the election.
+type Organization struct {
+  // key.Encode() for the key representing this Organization.
+  Key_str string
+
+  // User.ID of the user that made this organization.  Only they can change
+  // who its members are.
+  User_id string
+
+  Name string
+
+  // Email addresses of everyone in the organization, including whoever made
+  // it.
+  Members []string
+
+  Created time.Time
+}
+
+func (o *Organization) hasMember(u *user.User) bool {
+  if u == nil {
+    return false
+  }
+  for _, email := range o.Members {
+    if strings.EqualFold(email, u.Email) {
+      return true
+    }
+  }
+  return false
+}
+
+// Returns every Organization that u is a member of, by name.  Members are
+// stored in lower case, but organizations saved before that may still have
+// u's address as it was typed, so those are looked up too.
+func userOrgs(c appengine.Context, u *user.User) ([]Organization, []*datastore.Key, error) {
+  var orgs []Organization
+  email := strings.ToLower(u.Email)
+  keys, err := datastore.NewQuery("Organization").Filter("Members =", email).Order("Name").GetAll(c, &orgs)
+  if err != nil || email == u.Email {
+    return orgs, keys, err
+  }
+  var typed []Organization
+  typed_keys, err := datastore.NewQuery("Organization").Filter("Members =", u.Email).Order("Name").GetAll(c, &typed)
+  if err != nil {
+    return nil, nil, err
+  }
+  for i := range typed {
+    found := false
+    for j := range keys {
+      if keys[j].Equal(typed_keys[i]) {
+        found = true
+        break
+      }
+    }
+    if !found {
+      orgs = append(orgs, typed[i])
+      keys = append(keys, typed_keys[i])
+    }
+  }
+  return orgs, keys, nil
+}
+
+// Returns true if u is a member of the Organization with the given key.
+func isOrgMember(c appengine.Context, key *datastore.Key, u *user.User) (bool, error) {
+  var o Organization
+  err := datastore.Get(c, key, &o)
+  if err != nil {
+    return false, err
+  }
+  return o.hasMember(u), nil
+}
+
+// Returns true if the current user is allowed to know that the Election e,
+// which has the given key, exists.  Public and unlisted elections that don't
+// belong to an organization can be seen by anyone.  The rest can only be seen
+// by the election's voters, by anyone with a role in it, and by the members of
+// its organization.
+func canView(c appengine.Context, key *datastore.Key, e *Election) bool {
+  if e.Org_key == nil && e.Visibility != visibilityPrivate {
+    return true
+  }
+  u := user.Current(c)
+  if u == nil {
+    return false
+  }
+  a, err := electionAccess(c, key, e, u)
+  if err != nil {
+    c.Errorf("Unable to check access to %s: %v", e.Key_str, err)
+    return false
+  }
+  return a.Member || a.Owner || a.Co_organizer || a.Observer || a.Voter
+}
+
+// Writes out an error and returns false if the current user isn't allowed to
+// see the Election e.
+func checkCanView(w http.ResponseWriter, c appengine.Context, key *datastore.Key, e *Election) bool {
+  if !canView(c, key, e) {
+    http.Error(w, "You are not allowed to see this election.", http.StatusInternalServerError)
+    return false
+  }
+  return true
+}
+
+// Decodes the organization picked on a form, making sure that u is a member
+// of it.  An empty string means no organization.
+func parseOrg(c appengine.Context, u *user.User, key_str string) (*datastore.Key, error) {
+  if key_str == "" {
+    return nil, nil
+  }
+  key, err := datastore.DecodeKey(key_str)
+  if err != nil {
+    return nil, err
+  }
+  member, err := isOrgMember(c, key, u)
+  if err != nil {
+    return nil, err
+  }
+  if !member {
+    return nil, &electionError{"You are not a member of that organization."}
+  }
+  return key, nil
+}
+
+// One of the organizations that can be picked on a form.
+type orgChoice struct {
+  Organization
+  Selected bool
+}
+
+func orgChoices(orgs []Organization, selected *datastore.Key) []orgChoice {
+  var choices []orgChoice
+  for _, o := range orgs {
+    choices = append(choices, orgChoice{o, selected != nil && selected.Encode() == o.Key_str})
+  }
+  return choices
+}
+
+var orgsTemplate = template.Must(template.New("orgs").Parse(orgsTemplateHTML))
+
+const orgsTemplateHTML = `
+  <body>
+    Organizations you are a member of:<br/>
+    <table>
+      {{range .}}
+        <tr>
+          <td><a href="/org?key={{.Key_str}}">{{.Name}}</a></td>
+          <td>{{len .Members}} members</td>
+        </tr>
+      {{end}}
+    </table>
+    <br/>
+    <form action="/save_org" method="post">
+      Make a new organization named <input type="text" name="name"/>
+      <input type="submit" value="Make"/>
+    </form>
+  </body>
+`
+
+func viewOrgs(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  orgs, _, err := userOrgs(c, u)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  orgsTemplate.Execute(w, orgs)
+}
+
+type orgTemplateData struct {
+  Org       Organization
+  Members   string
+  Is_owner  bool
+  Elections []Election
+  Groups    []VoterGroup
+}
+
+var orgTemplate = template.Must(template.New("org").Parse(orgTemplateHTML))
+
+const orgTemplateHTML = `
+  <body>
+    {{.Org.Name}}<br/>
+    <br/>
+    Elections:<br/>
+    <table>
+      {{range .Elections}}
+        <tr>
+          <td>{{.Title}}</td>
+          <td><a href="/ballot?key={{.Key_str}}">vote</a></td>
+          <td><a href="/view_results?key={{.Key_str}}">results</a></td>
+          <td><a href="/status?key={{.Key_str}}">status</a></td>
+        </tr>
+      {{end}}
+    </table>
+    <br/>
+    Voter groups:<br/>
+    {{range .Groups}}
+      <a href="/group?key={{.Key_str}}">{{.Name}}</a><br/>
+    {{end}}
+    <br/>
+    {{if .Is_owner}}
+      <form action="/save_org" method="post">
+        <input type="hidden" name="key" value="{{.Org.Key_str}}"/>
+        Name: <input type="text" name="name" value="{{.Org.Name}}"/><br/>
+        Email addresses of the members:<br/>
+        <textarea name="members" cols="70" rows="10">{{.Members}}</textarea><br/>
+        <input type="submit" value="Save"/>
+      </form>
+    {{else}}
+      Members:<br/>
+      {{range .Org.Members}}{{.}}<br/>{{end}}
+    {{end}}
+  </body>
+`
+
+// Loads the Organization specified by the key in the request, making sure
+// that u is a member of it.
+func getOrg(w http.ResponseWriter, r *http.Request, c appengine.Context, u *user.User) (*datastore.Key, *Organization, bool) {
+  key, err := datastore.DecodeKey(r.FormValue("key"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, nil, false
+  }
+  var o Organization
+  err = datastore.Get(c, key, &o)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, nil, false
+  }
+  if !o.hasMember(u) {
+    http.Error(w, "You are not a member of that organization.", http.StatusInternalServerError)
+    return nil, nil, false
+  }
+  return key, &o, true
+}
+
+// Shows the elections and voter groups of an organization, and lets the
+// user that made it change its members.
+func viewOrg(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  key, o, ok := getOrg(w, r, c, u)
+  if !ok {
+    return
+  }
+  data := orgTemplateData{
+    Org:      *o,
+    Members:  strings.Join(o.Members, "\n"),
+    Is_owner: o.User_id == u.ID,
+  }
+  _, err := datastore.NewQuery("Election").Filter("Org_key =", key).Order("-Start").GetAll(c, &data.Elections)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  _, err = datastore.NewQuery("VoterGroup").Filter("Org_key =", key).Order("Name").GetAll(c, &data.Groups)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  orgTemplate.Execute(w, data)
+}
+
+// Makes a new organization, or changes the name and members of an existing
+// one.
+func saveOrg(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  name := strings.TrimSpace(r.FormValue("name"))
+  if name == "" {
+    http.Error(w, "An organization needs a name.", http.StatusInternalServerError)
+    return
+  }
+  key := datastore.NewIncompleteKey(c, "Organization", nil)
+  owner := strings.ToLower(u.Email)
+  o := &Organization{User_id: u.ID, Members: []string{owner}, Created: time.Now()}
+  if r.FormValue("key") != "" {
+    var ok bool
+    key, o, ok = getOrg(w, r, c, u)
+    if !ok {
+      return
+    }
+    if o.User_id != u.ID {
+      http.Error(w, "Only the user that made an organization can change it.", http.StatusInternalServerError)
+      return
+    }
+    // Whoever made the organization can't take themselves out of it.
+    // Addresses are kept in lower case so that userOrgs can find them no
+    // matter how they were typed.
+    o.Members = []string{owner}
+    listed := map[string]bool{owner: true}
+    for _, email := range strings.Fields(r.FormValue("members")) {
+      email = strings.ToLower(email)
+      if !listed[email] {
+        listed[email] = true
+        o.Members = append(o.Members, email)
+      }
+    }
+  }
+  o.Name = name
+  key, err := datastore.Put(c, key, o)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if o.Key_str == "" {
+    o.Key_str = key.Encode()
+    _, err = datastore.Put(c, key, o)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+  }
+  fmt.Fprintf(w, `Saved %s with %d members.  <a href="/org?key=%s">Go to the organization</a>.`, template.HTMLEscapeString(o.Name), len(o.Members), o.Key_str)
+}
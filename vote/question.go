@@ -0,0 +1,340 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "appengine/user"
+  "fmt"
+  "html/template"
+  "net/http"
+  "net/url"
+  "strings"
+  "time"
+)
+
+func init() {
+  http.HandleFunc("/add_question", addQuestion)
+  http.HandleFunc("/save_question", saveQuestion)
+}
+
+// The ballot of an Election starts with one question, which is made up of
+// the Election's own Candidates and Ballot_type.  Any further questions, each
+// with their own candidates and kind of ballot, are Questions, which are
+// children of the Election.  The Candidates of a Question are its children,
+// and have their Question set to its Index.  A voter answers every question in
+// one submission, which is stored as one Ballot for each question.
+type Question struct {
+  // Position of this question on the ballot.  The Election's own question is
+  // 0, so Questions start from 1.
+  Index int
+
+  Title string
+
+  // The same as the fields of an Election with the same names.
+  Ballot_type    string
+  Max_score      int
+  Grades         []string
+  Num_candidates int
+}
+
+// Copies the Questions that are children of from, along with their
+// Candidates, to be children of to, and returns how many there were.  from
+// and to can each be an Election or an ElectionTemplate.
+func copyQuestions(c appengine.Context, from, to *datastore.Key) (int, error) {
+  var qs []Question
+  keys, err := datastore.NewQuery("Question").Ancestor(from).Order("Index").GetAll(c, &qs)
+  if err != nil {
+    return 0, err
+  }
+  for i := range qs {
+    cands, err := loadCandidates(c, keys[i], qs[i].Index, qs[i].Num_candidates)
+    if err != nil {
+      return 0, err
+    }
+    q_key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Question", to), &qs[i])
+    if err != nil {
+      return 0, err
+    }
+    for j := range cands {
+      _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Candidate", q_key), &cands[j])
+      if err != nil {
+        return 0, err
+      }
+    }
+  }
+  return len(qs), nil
+}
+
+// One of the questions on the ballot of an election, including the first.
+type electionQuestion struct {
+  Index int
+  Title string
+
+  // A copy of the Election with its ballot settings replaced by those of
+  // the question, so that it can be handed to the question's ballotKind.
+  Election   *Election
+  Candidates []Candidate
+}
+
+// Returns every question on the ballot of e, which has the given key, in
+// order.  cands are e's own Candidates.
+func getQuestions(c appengine.Context, key *datastore.Key, e *Election, cands []Candidate) ([]electionQuestion, error) {
+  questions := []electionQuestion{{Title: e.Title, Election: e, Candidates: cands}}
+  if e.Num_questions == 0 {
+    return questions, nil
+  }
+  var qs []Question
+  keys, err := datastore.NewQuery("Question").Ancestor(key).Order("Index").GetAll(c, &qs)
+  if err != nil {
+    return nil, err
+  }
+  for i, q := range qs {
+    q_cands, err := loadCandidates(c, keys[i], q.Index, q.Num_candidates)
+    if err != nil {
+      return nil, err
+    }
+    qe := *e
+    qe.Ballot_type = q.Ballot_type
+    qe.Max_score = q.Max_score
+    qe.Grades = q.Grades
+    qe.Num_candidates = q.Num_candidates
+    questions = append(questions, electionQuestion{q.Index, q.Title, &qe, q_cands})
+  }
+  return questions, nil
+}
+
+// Returns the prefix of the names of the fields of question q on the ballot
+// form.  The first question doesn't have one, so the ballots of elections
+// with only one question are the same as they have always been.
+func questionPrefix(q int) string {
+  if q == 0 {
+    return ""
+  }
+  return fmt.Sprintf("q%d_", q)
+}
+
+// Returns a request that has just the fields of question q in r, without
+// their prefix, so that they can be read by the question's ballotKind.
+func questionRequest(r *http.Request, q int) *http.Request {
+  if q == 0 {
+    return r
+  }
+  r.ParseForm()
+  prefix := questionPrefix(q)
+  form := make(url.Values)
+  for name, values := range r.Form {
+    if strings.HasPrefix(name, prefix) {
+      form[name[len(prefix):]] = values
+    }
+  }
+  return &http.Request{Form: form}
+}
+
+// Reads the answer to every question from the ballot form, one Ballot for
+// each question.
+func parseBallots(r *http.Request, questions []electionQuestion) ([]*Ballot, error) {
+  var ballots []*Ballot
+  for _, q := range questions {
+    b, err := q.Election.ballotKind().Parse(questionRequest(r, q.Index), q.Election, len(q.Candidates))
+    if err != nil {
+      if len(questions) > 1 {
+        err = &electionError{fmt.Sprintf("%s: %v", q.Title, err)}
+      }
+      return nil, err
+    }
+    b.Question = q.Index
+    ballots = append(ballots, b)
+  }
+  return ballots, nil
+}
+
+// Writes out the fields of every question on the ballot form, filled in the
+// way the Ballots in prev are.  prev is indexed by question, and questions
+// that aren't in it are left blank.
+func questionFields(questions []electionQuestion, prev map[int]*Ballot) (template.HTML, error) {
+  var html string
+  for _, q := range questions {
+    fields, err := ballotFields(q.Election, q.Candidates, prev[q.Index], questionPrefix(q.Index))
+    if err != nil {
+      return "", err
+    }
+    if len(questions) == 1 {
+      return fields, nil
+    }
+    html += fmt.Sprintf("<fieldset><legend>%s</legend>%s</fieldset>", template.HTMLEscapeString(q.Title), fields)
+  }
+  return template.HTML(html), nil
+}
+
+// Returns the fields that ballots would be submitted with, with the prefix of
+// each question.
+func questionFormFields(questions []electionQuestion, ballots []*Ballot) []formField {
+  var fields []formField
+  for i, q := range questions {
+    for _, field := range q.Election.ballotKind().Fields(ballots[i]) {
+      fields = append(fields, formField{questionPrefix(q.Index) + field.Name, field.Value})
+    }
+  }
+  return fields
+}
+
+// Returns the Ballots in ballots that answer question q.
+func questionBallots(ballots []Ballot, q int) []Ballot {
+  var answers []Ballot
+  for _, b := range ballots {
+    if b.Question == q {
+      answers = append(answers, b)
+    }
+  }
+  return answers
+}
+
+type addQuestionTemplateData struct {
+  Election     Election
+  Questions    []electionQuestion
+  Ballot_types []ballotTypeChoice
+}
+
+var addQuestionTemplate = template.Must(template.New("add_question").Parse(addQuestionTemplateHTML))
+
+const addQuestionTemplateHTML = `
+  <body>
+    Questions on the ballot of {{.Election.Title}}:<br/>
+    <ol>
+      {{range .Questions}}
+        <li>{{.Title}} ({{if .Election.Ballot_type}}{{.Election.Ballot_type}}{{else}}ranked{{end}}):
+          {{range $i,$cand := .Candidates}}{{if $i}}, {{end}}{{$cand.Name}}{{end}}</li>
+      {{end}}
+    </ol>
+    <form action="/save_question" method="post">
+      <input type="hidden" name="key" value="{{.Election.Key_str}}"/>
+      Question: <input type="text" name="title" size="60"/><br/>
+      Kind of ballot:<br/>
+      {{range .Ballot_types}}
+      <input type="radio" name="ballot_type" value="{{.Value}}" {{if .Selected}}checked{{end}}/>{{.Label}}<br/>
+      {{end}}
+      Highest score on a score or STAR ballot: <input type="text" name="max_score" size="2" value="5"/><br/>
+      Grades on a Majority Judgment ballot, best first, one per line (leave blank for Excellent, Very good, Good, Acceptable, Poor, Reject):<br/>
+      <textarea name="grades" cols="30" rows="6"></textarea><br/>
+      Candidates, one per line (a referendum is always Yes or No):<br/>
+      <textarea name="candidates" cols="40" rows="10"></textarea><br/>
+      <input type="submit" value="Add this question"/>
+    </form>
+  </body>
+`
+
+// Loads the Election specified by the key in the request, along with its
+// questions, making sure that u can still add questions to it.  Questions
+// can only be added before voting begins, so that every ballot answers the
+// same questions.
+func getElectionForQuestions(w http.ResponseWriter, r *http.Request, c appengine.Context, u *user.User) (*datastore.Key, *Election, []electionQuestion, bool) {
+  key, e, cands, ok := getElectionFor(w, r, c, u, permManage)
+  if !ok {
+    return nil, nil, nil, false
+  }
+  if !time.Now().Before(e.Start) {
+    http.Error(w, "Questions can only be added before voting begins.", http.StatusInternalServerError)
+    return nil, nil, nil, false
+  }
+  questions, err := getQuestions(c, key, e, cands)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, nil, nil, false
+  }
+  return key, e, questions, true
+}
+
+func addQuestion(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  _, e, questions, ok := getElectionForQuestions(w, r, c, u)
+  if !ok {
+    return
+  }
+  addQuestionTemplate.Execute(w, addQuestionTemplateData{
+    Election:     *e,
+    Questions:    questions,
+    Ballot_types: ballotTypeChoices(""),
+  })
+}
+
+func saveQuestion(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  key, e, _, ok := getElectionForQuestions(w, r, c, u)
+  if !ok {
+    return
+  }
+  title := strings.TrimSpace(r.FormValue("title"))
+  if title == "" {
+    http.Error(w, "A question needs a title.", http.StatusInternalServerError)
+    return
+  }
+  ballot_type, max_score, grades, err := parseBallotSettings(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  q := Question{
+    Title:       title,
+    Ballot_type: ballot_type,
+    Max_score:   max_score,
+    Grades:      grades,
+  }
+  var cands []Candidate
+  if ballot_type == ballotReferendum {
+    cands = referendumCandidates()
+  } else {
+    for _, line := range strings.Split(r.FormValue("candidates"), "\n") {
+      if name := strings.TrimSpace(line); name != "" {
+        cands = append(cands, Candidate{Name: name, Index: len(cands)})
+      }
+    }
+  }
+  if len(cands) < 2 {
+    http.Error(w, "A question needs at least two candidates.", http.StatusInternalServerError)
+    return
+  }
+  q.Num_candidates = len(cands)
+
+  // The question gets the next Index, which is only given out inside a
+  // transaction so that two questions added at once can't get the same one.
+  err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+    err := datastore.Get(c, key, e)
+    if err != nil {
+      return err
+    }
+    q.Index = e.Num_questions + 1
+    q_key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Question", key), &q)
+    if err != nil {
+      return err
+    }
+    for i := range cands {
+      cands[i].Question = q.Index
+      _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Candidate", q_key), &cands[i])
+      if err != nil {
+        return err
+      }
+    }
+    e.Num_questions = q.Index
+    _, err = datastore.Put(c, key, e)
+    return err
+  }, nil)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  recordAudit(c, key, u.Email, "Added the question %q with %d candidates", title, len(cands))
+  fmt.Fprintf(w, `Added %s to the ballot.  <a href="/add_question?key=%s">Add another question</a>.`, template.HTMLEscapeString(title), e.Key_str)
+}
@@ -0,0 +1,168 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "fmt"
+  "math"
+  "strings"
+  "time"
+)
+
+// Whether enough voters have taken part in an election for its result to
+// count.
+type quorumReport struct {
+  // Number of voters, or total weight of the voters if they are weighted,
+  // that is needed and that has voted so far.
+  Required int  `json:"required"`
+  Cast     int  `json:"cast,omitempty"`
+  Weighted bool `json:"weighted"`
+  Met      bool `json:"met"`
+
+  // Set while voting is open, when Cast isn't published and Met only counts
+  // the ballots that are in the results.  Withheld is set if too few ballots
+  // have been cast to say even that much, see Election.Min_ballots.
+  Open     bool `json:"open"`
+  Withheld bool `json:"withheld"`
+}
+
+func (e *Election) hasQuorum() bool {
+  return e.Quorum_count > 0 || e.Quorum_fraction > 0
+}
+
+// Works out whether e, which has the given key, has reached its quorum.
+// Anyone that has cast a ballot or delegated their vote has taken part.  A
+// quorum given as a fraction is a fraction of everyone that is eligible, so
+// it is ignored for elections that are open to everyone.
+func checkQuorum(c appengine.Context, key *datastore.Key, e *Election) (*quorumReport, error) {
+  return quorumAsOf(c, key, e, time.Time{})
+}
+
+// Returns the quorum of e as it can be shown to anyone that can see the
+// results as of now.  Until voting closes, exactly how many voters have taken
+// part would show when each of them voted, so only whether the quorum has
+// been reached is given, going by the ballots that are in the results.
+func publishedQuorum(c appengine.Context, key *datastore.Key, e *Election, now time.Time) (*quorumReport, error) {
+  if e.votingClosed(now) {
+    return checkQuorum(c, key, e)
+  }
+  report, err := quorumAsOf(c, key, e, refreshBoundary(e, now))
+  if err != nil {
+    return nil, err
+  }
+  report.Open = true
+  if e.Min_ballots > 0 && report.Cast < e.Min_ballots {
+    report.Withheld = true
+    report.Met = false
+  }
+  report.Cast = 0
+  return report, nil
+}
+
+// Works out the quorum of e counting only the ballots and delegations that
+// are viewable as of now, or all of them if now is zero.
+func quorumAsOf(c appengine.Context, key *datastore.Key, e *Election, now time.Time) (*quorumReport, error) {
+  electorate, err := e.Electorate(c)
+  if err != nil {
+    return nil, err
+  }
+  eligible, err := e.eligibleVoters(c)
+  if err != nil {
+    return nil, err
+  }
+  var ballots []Ballot
+  _, err = datastore.NewQuery("Ballot").Ancestor(key).GetAll(c, &ballots)
+  if err != nil {
+    return nil, err
+  }
+  var delegations []Delegation
+  _, err = datastore.NewQuery("Delegation").Ancestor(key).GetAll(c, &delegations)
+  if err != nil {
+    return nil, err
+  }
+  return countQuorum(e, electorate, eligible, ballots, delegations, now), nil
+}
+
+// Works out the quorum of e, which has the given electorate and eligible
+// voters, from its ballots and delegations, counting only the ones that are
+// viewable as of now, or all of them if now is zero.  Voters that have been
+// taken off the list since they voted don't count.
+func countQuorum(e *Election, electorate []string, eligible map[string]bool, ballots []Ballot, delegations []Delegation, now time.Time) *quorumReport {
+  report := &quorumReport{
+    Required: e.Quorum_count,
+    Weighted: len(e.Weights) > 0 && len(e.Weights) == len(e.Emails),
+  }
+  total := len(electorate)
+  if report.Weighted {
+    total = e.TotalWeight(electorate)
+  }
+  if e.Quorum_fraction > 0 && total > 0 {
+    needed := int(math.Ceil(e.Quorum_fraction * float64(total)))
+    if needed > report.Required {
+      report.Required = needed
+    }
+  }
+
+  var viewable []Ballot
+  for _, b := range ballots {
+    if now.IsZero() || b.Viewable.Before(now) {
+      viewable = append(viewable, b)
+    }
+  }
+  var viewable_delegations []Delegation
+  for _, d := range delegations {
+    if now.IsZero() || d.Viewable.Before(now) {
+      viewable_delegations = append(viewable_delegations, d)
+    }
+  }
+  viewable, viewable_delegations = filterEligible(eligible, viewable, viewable_delegations)
+
+  // Voters are told apart by Ballot.voter, while their weight goes by their
+  // email.
+  var voters, emails []string
+  for _, b := range viewable {
+    voters = append(voters, b.voter())
+    emails = append(emails, b.Email)
+  }
+  for _, d := range viewable_delegations {
+    voters = append(voters, strings.ToLower(d.Email))
+    emails = append(emails, d.Email)
+  }
+  participated := make(map[string]bool)
+  for i, voter := range voters {
+    if participated[voter] {
+      continue
+    }
+    participated[voter] = true
+    if report.Weighted {
+      report.Cast += e.VoterWeight(emails[i])
+    } else {
+      report.Cast++
+    }
+  }
+  report.Met = report.Cast >= report.Required
+  return report
+}
+
+// Called as e is about to close, with the quorum that checkQuorum found.  If
+// it hasn't reached its quorum and it may still be extended, End is pushed
+// back and true is returned, in which case e should stay open.  Otherwise the
+// outcome is recorded in e.
+func extendForQuorum(e *Election, report *quorumReport) bool {
+  if !report.Met && e.Quorum_extension > 0 && e.Extensions < e.Max_extensions {
+    e.End = e.End.Add(time.Duration(e.Quorum_extension))
+    e.Extensions++
+    // Everyone that hasn't voted yet is reminded again before the new End.
+    e.Reminded = false
+    return true
+  }
+  e.Non_binding = !report.Met
+  return false
+}
+
+func quorumOutcome(report *quorumReport) string {
+  if report.Met {
+    return fmt.Sprintf("Quorum reached with %d of %d", report.Cast, report.Required)
+  }
+  return fmt.Sprintf("Quorum not reached with %d of %d, the result is not binding", report.Cast, report.Required)
+}
@@ -0,0 +1,133 @@
+package vote
+
+import (
+  "testing"
+  "time"
+)
+
+func TestCountQuorum(t *testing.T) {
+  now := time.Unix(1000, 0)
+  before := now.Add(-time.Minute)
+  after := now.Add(time.Minute)
+  ballot := func(user_id, email string, viewable time.Time) Ballot {
+    return Ballot{User_id: user_id, Email: email, Viewable: viewable}
+  }
+  listed := &Election{Emails: []string{"a@x", "b@x", "c@x", "d@x"}, Quorum_fraction: 0.5}
+  weighted := &Election{Emails: []string{"a@x", "b@x", "c@x"}, Weights: []int{5, 1, 1}, Quorum_fraction: 0.5}
+  eligible := func(e *Election) map[string]bool {
+    voters := make(map[string]bool)
+    for _, email := range e.Emails {
+      voters[email] = true
+    }
+    return voters
+  }
+  tests := []struct {
+    name        string
+    e           *Election
+    ballots     []Ballot
+    delegations []Delegation
+    now         time.Time
+
+    required, cast int
+    met            bool
+  }{
+    {
+      name:     "fraction of the listed voters",
+      e:        listed,
+      ballots:  []Ballot{ballot("1", "a@x", before), ballot("2", "b@x", before)},
+      now:      now,
+      required: 2, cast: 2, met: true,
+    },
+    {
+      name:     "a voter that voted twice and in different case counts once",
+      e:        listed,
+      ballots:  []Ballot{ballot("1", "a@x", before), ballot("1", "A@x", before)},
+      now:      now,
+      required: 2, cast: 1,
+    },
+    {
+      name:        "delegating counts as taking part",
+      e:           listed,
+      ballots:     []Ballot{ballot("1", "a@x", before)},
+      delegations: []Delegation{{User_id: "2", Email: "B@x", Delegate_email: "a@x", Viewable: before}},
+      now:         now,
+      required:    2, cast: 2, met: true,
+    },
+    {
+      name:     "ballots that aren't viewable yet",
+      e:        listed,
+      ballots:  []Ballot{ballot("1", "a@x", before), ballot("2", "b@x", after)},
+      now:      now,
+      required: 2, cast: 1,
+    },
+    {
+      name:     "every ballot once voting is over",
+      e:        listed,
+      ballots:  []Ballot{ballot("1", "a@x", before), ballot("2", "b@x", after)},
+      required: 2, cast: 2, met: true,
+    },
+    {
+      name:     "voters taken off the list don't count",
+      e:        listed,
+      ballots:  []Ballot{ballot("1", "a@x", before), ballot("9", "gone@x", before)},
+      now:      now,
+      required: 2, cast: 1,
+    },
+    {
+      name:     "ballots from before ballots had an email count once each",
+      e:        listed,
+      ballots:  []Ballot{ballot("1", "", before), ballot("2", "", before)},
+      now:      now,
+      required: 2, cast: 2, met: true,
+    },
+    {
+      name:     "weighted voters",
+      e:        weighted,
+      ballots:  []Ballot{ballot("1", "A@x", before)},
+      now:      now,
+      required: 4, cast: 5, met: true,
+    },
+    {
+      name:     "a count of voters when anyone can vote",
+      e:        &Election{Quorum_count: 3, Quorum_fraction: 0.5},
+      ballots:  []Ballot{ballot("1", "a@x", before), ballot("2", "b@x", before)},
+      now:      now,
+      required: 3, cast: 2,
+    },
+  }
+  for _, test := range tests {
+    var voters map[string]bool
+    if len(test.e.Emails) > 0 {
+      voters = eligible(test.e)
+    }
+    report := countQuorum(test.e, test.e.Emails, voters, test.ballots, test.delegations, test.now)
+    if report.Required != test.required || report.Cast != test.cast || report.Met != test.met {
+      t.Errorf("%s: %d of %d, met = %v, want %d of %d, met = %v", test.name, report.Cast, report.Required, report.Met, test.cast, test.required, test.met)
+    }
+  }
+}
+
+func TestExtendForQuorum(t *testing.T) {
+  end := time.Unix(1000, 0)
+  tests := []struct {
+    name       string
+    extensions int
+    met        bool
+
+    extended, non_binding bool
+  }{
+    {"quorum reached", 0, true, false, false},
+    {"extended", 0, false, true, false},
+    {"out of extensions", 2, false, false, true},
+  }
+  for _, test := range tests {
+    e := &Election{End: end, Reminded: true, Quorum_extension: int64(time.Hour), Max_extensions: 2, Extensions: test.extensions}
+    extended := extendForQuorum(e, &quorumReport{Met: test.met})
+    if extended != test.extended || e.Non_binding != test.non_binding {
+      t.Errorf("%s: extended = %v and non-binding = %v, want %v and %v", test.name, extended, e.Non_binding, test.extended, test.non_binding)
+    }
+    if extended && (!e.End.Equal(end.Add(time.Hour)) || e.Extensions != test.extensions+1 || e.Reminded) {
+      t.Errorf("%s: extended to %v after %d extensions, reminded = %v", test.name, e.End, e.Extensions, e.Reminded)
+    }
+  }
+}
@@ -0,0 +1,476 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "appengine/user"
+  "fmt"
+  "html/template"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+func init() {
+  http.HandleFunc("/recurrences", viewRecurrences)
+  http.HandleFunc("/make_recurrence", makeRecurrence)
+  http.HandleFunc("/stop_recurrence", stopRecurrence)
+  http.HandleFunc("/recurrence", viewRecurrence)
+  http.HandleFunc("/cron/recurrences", runRecurrences)
+}
+
+// A Recurrence makes a new Election from an ElectionTemplate at the same time
+// every day or every week.
+type Recurrence struct {
+  // key.Encode() for the key representing this Recurrence.
+  Key_str string
+
+  // User.ID and User.Email of the user that set up this Recurrence.
+  User_id    string
+  User_email string
+
+  // The template that every Election is made from.
+  Template_key *datastore.Key
+  Name         string
+
+  // Day of the week, as a time.Weekday, that elections start on.  A negative
+  // value means that an election starts every day.
+  Weekday int
+
+  // Time of day, in UTC, that elections start at.
+  Hour   int
+  Minute int
+
+  // How long each election is open for, in nanoseconds.
+  Duration int64
+
+  // When the next Election will be made.
+  Next time.Time
+
+  // The most recent Election made by this Recurrence, so that the next one
+  // can link back to it.
+  Last_election *datastore.Key
+
+  // Stopped Recurrences don't make any more Elections, but are kept around so
+  // that the Elections they made can still be compared.
+  Active bool
+}
+
+// Returns the first time after t that is on the given weekday (or any day if
+// weekday is negative) at hour:minute UTC.
+func nextOccurrence(t time.Time, weekday, hour, minute int) time.Time {
+  t = t.UTC()
+  next := time.Date(t.Year(), t.Month(), t.Day(), hour, minute, 0, 0, time.UTC)
+  for !next.After(t) || (weekday >= 0 && next.Weekday() != time.Weekday(weekday)) {
+    next = next.AddDate(0, 0, 1)
+  }
+  return next
+}
+
+// Returned by makeOccurrence when rec can never make another Election.
+type recurrenceEnded struct {
+  reason string
+}
+
+func (re *recurrenceEnded) Error() string {
+  return re.reason
+}
+
+// Makes the Election for the occurrence of rec that starts at rec.Next.  An
+// error means that no Election was made.  Once the Election has been stored
+// anything else that goes wrong is only logged, so that the caller always
+// finds out about an Election that was made.
+//
+// The Election's key is named after rec and rec.Next, so if rec wasn't
+// updated after the occurrence was made, because storing it failed or two
+// runs of runRecurrences overlapped, the occurrence isn't made again and the
+// key of the one that was made is returned.
+func makeOccurrence(c appengine.Context, rec *Recurrence, rec_key *datastore.Key) (*datastore.Key, error) {
+  var t ElectionTemplate
+  err := datastore.Get(c, rec.Template_key, &t)
+  if err == datastore.ErrNoSuchEntity {
+    return nil, &recurrenceEnded{"its template has been deleted"}
+  }
+  if err != nil {
+    return nil, err
+  }
+  cands, err := getCandidates(c, rec.Template_key, t.Num_candidates)
+  if err != nil {
+    return nil, err
+  }
+  // The election only goes to the organization if the user that set up the
+  // recurrence is still a member of it.
+  var org_key *datastore.Key
+  if t.Org_key != nil {
+    org_key, err = parseOrg(c, &user.User{ID: rec.User_id, Email: rec.User_email}, t.Org_key.Encode())
+    if _, ok := err.(*electionError); ok {
+      return nil, &recurrenceEnded{err.Error()}
+    }
+    if err != nil {
+      return nil, err
+    }
+  }
+  e := Election{
+    User_id:          rec.User_id,
+    User_email:       rec.User_email,
+    Org_key:          org_key,
+    Title:            fmt.Sprintf("%s (%s)", t.Title, rec.Next.Format("2006-01-02")),
+    Start:            rec.Next,
+    End:              rec.Next.Add(time.Duration(rec.Duration)),
+    Hide_results:     t.Hide_results,
+    Visibility:       t.Visibility,
+    Ballot_type:      t.Ballot_type,
+    Max_score:        t.Max_score,
+    Grades:           t.Grades,
+    Num_candidates:   len(cands),
+    Refresh_interval: t.Refresh_interval,
+    Emails:           t.Emails,
+    Weights:          t.Weights,
+    Groups:           t.Groups,
+    Min_ballots:      t.Min_ballots,
+    Noise_epsilon:    t.Noise_epsilon,
+    Quorum_count:     t.Quorum_count,
+    Quorum_fraction:  t.Quorum_fraction,
+    Quorum_extension: t.Quorum_extension,
+    Max_extensions:   t.Max_extensions,
+    Secret_ballots:   t.Secret_ballots,
+    Allow_delegation: t.Allow_delegation,
+    Auto_runoff:      t.Auto_runoff,
+    Runoff_duration:  t.Runoff_duration,
+    Recurrence_key:   rec_key,
+    Previous_key:     rec.Last_election,
+  }
+  key := datastore.NewKey(c, "Election", fmt.Sprintf("%s@%d", rec_key.Encode(), rec.Next.Unix()), 0, nil)
+  var made bool
+  err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+    made = false
+    var existing Election
+    err := datastore.Get(c, key, &existing)
+    if err == nil {
+      return nil
+    }
+    if err != datastore.ErrNoSuchEntity {
+      return err
+    }
+    _, err = putElectionAt(c, key, &e, cands)
+    made = err == nil
+    return err
+  }, nil)
+  if err != nil {
+    return nil, err
+  }
+  if !made {
+    return key, nil
+  }
+  recordAudit(c, key, "", "Created the election from the recurrence %s", rec.Name)
+  if t.Num_questions > 0 {
+    e.Num_questions, err = copyQuestions(c, rec.Template_key, key)
+    if err == nil {
+      _, err = datastore.Put(c, key, &e)
+    }
+    if err != nil {
+      c.Errorf("Unable to copy the questions of %s to %s: %v", rec.Template_key.Encode(), e.Key_str, err)
+    }
+  }
+  // Each occurrence is sent to the same webhooks, and is run by the same
+  // people, as the one before it.
+  if rec.Last_election != nil {
+    err = copyWebhooks(c, rec.Last_election, key)
+    if err != nil {
+      c.Errorf("Unable to copy the webhooks of %s to %s: %v", rec.Last_election.Encode(), e.Key_str, err)
+    }
+    err = copyRoles(c, rec.Last_election, key)
+    if err != nil {
+      c.Errorf("Unable to copy the roles of %s to %s: %v", rec.Last_election.Encode(), e.Key_str, err)
+    }
+    fireWebhooks(c, key, &e, &webhookPayload{Event: eventCreated})
+  }
+  return key, nil
+}
+
+// Called by cron, makes an Election for every Recurrence that is due.  If
+// more than one occurrence was missed only the most recent one is made.
+func runRecurrences(w http.ResponseWriter, r *http.Request) {
+  c := appengine.NewContext(r)
+  now := time.Now()
+  query := datastore.NewQuery("Recurrence").Filter("Active =", true).Filter("Next <=", now)
+  var recs []Recurrence
+  keys, err := query.GetAll(c, &recs)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  for i := range recs {
+    rec := &recs[i]
+    for {
+      following := nextOccurrence(rec.Next, rec.Weekday, rec.Hour, rec.Minute)
+      if following.After(now) {
+        break
+      }
+      rec.Next = following
+    }
+    key, err := makeOccurrence(c, rec, keys[i])
+    if ended, ok := err.(*recurrenceEnded); ok {
+      c.Errorf("Stopping recurrence %s because %v", rec.Key_str, ended)
+      rec.Active = false
+      _, err = datastore.Put(c, keys[i], rec)
+      if err != nil {
+        c.Errorf("Unable to update recurrence %s: %v", rec.Key_str, err)
+      }
+      continue
+    }
+    if err != nil {
+      c.Errorf("Unable to make election for recurrence %s: %v", rec.Key_str, err)
+      continue
+    }
+    rec.Last_election = key
+    rec.Next = nextOccurrence(rec.Next, rec.Weekday, rec.Hour, rec.Minute)
+    _, err = datastore.Put(c, keys[i], rec)
+    if err != nil {
+      c.Errorf("Unable to update recurrence %s: %v", rec.Key_str, err)
+    }
+  }
+}
+
+type recurrencesTemplateData struct {
+  Recurrences []Recurrence
+  Templates   []ElectionTemplate
+}
+
+var recurrencesTemplate = template.Must(template.New("recurrences").Funcs(template.FuncMap{"weekday": weekdayName}).Parse(recurrencesTemplateHTML))
+
+const recurrencesTemplateHTML = `
+  <body>
+    Your recurring elections:<br/>
+    <table>
+      {{range .Recurrences}}
+        <tr>
+          <td><a href="/recurrence?key={{.Key_str}}">{{.Name}}</a></td>
+          <td>{{weekday .Weekday}} at {{printf "%02d:%02d" .Hour .Minute}} UTC</td>
+          {{if .Active}}
+            <td>Next: {{.Next}}</td>
+            <td>
+              <form action="/stop_recurrence" method="post">
+                <input type="hidden" name="key" value="{{.Key_str}}"/>
+                <input type="submit" value="Stop"/>
+              </form>
+            </td>
+          {{else}}
+            <td>Stopped</td>
+          {{end}}
+        </tr>
+      {{end}}
+    </table>
+    <br/>
+    {{if .Templates}}
+    <form action="/make_recurrence" method="post">
+      Make an election from
+      <select name="template">
+        {{range .Templates}}
+        <option value="{{.Key_str}}">{{.Name}}</option>
+        {{end}}
+      </select>
+      every
+      <select name="weekday">
+        <option value="-1">day</option>
+        <option value="1">Monday</option>
+        <option value="2">Tuesday</option>
+        <option value="3">Wednesday</option>
+        <option value="4">Thursday</option>
+        <option value="5">Friday</option>
+        <option value="6">Saturday</option>
+        <option value="0">Sunday</option>
+      </select>
+      at (HH:MM UTC) <input type="text" name="time" value="09:00" size="5"/>
+      open for (DD:HH:MM) <input type="text" name="duration" value="02:00:00" size="8"/>
+      <input type="submit" value="Start"/>
+    </form>
+    {{else}}
+    Save an election as a template to be able to make it recur.
+    {{end}}
+  </body>
+`
+
+func weekdayName(weekday int) string {
+  if weekday < 0 {
+    return "Every day"
+  }
+  return "Every " + time.Weekday(weekday).String()
+}
+
+func viewRecurrences(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  var data recurrencesTemplateData
+  _, err := datastore.NewQuery("Recurrence").Filter("User_id =", u.ID).Order("Name").GetAll(c, &data.Recurrences)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  _, err = datastore.NewQuery("ElectionTemplate").Filter("User_id =", u.ID).Order("Name").GetAll(c, &data.Templates)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  recurrencesTemplate.Execute(w, data)
+}
+
+func makeRecurrence(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  template_key, err := datastore.DecodeKey(r.FormValue("template"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  var t ElectionTemplate
+  err = datastore.Get(c, template_key, &t)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if t.User_id != u.ID {
+    http.Error(w, "You can only use templates that you have saved.", http.StatusInternalServerError)
+    return
+  }
+  weekday, err := strconv.Atoi(r.FormValue("weekday"))
+  if err != nil || weekday > 6 {
+    http.Error(w, fmt.Sprintf("Unknown weekday: '%s'", r.FormValue("weekday")), http.StatusInternalServerError)
+    return
+  }
+  var hour, minute int
+  n, err := fmt.Sscanf(r.FormValue("time"), "%d:%d", &hour, &minute)
+  if n != 2 || err != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+    http.Error(w, fmt.Sprintf("Expected a time of the form HH:MM, got '%s'.", r.FormValue("time")), http.StatusInternalServerError)
+    return
+  }
+  duration, err := parseDuration(r.FormValue("duration"))
+  if err != nil || duration <= 0 {
+    http.Error(w, fmt.Sprintf("Expected a duration of the form DD:HH:MM, got '%s'.", r.FormValue("duration")), http.StatusInternalServerError)
+    return
+  }
+  rec := Recurrence{
+    User_id:      u.ID,
+    User_email:   u.Email,
+    Template_key: template_key,
+    Name:         t.Name,
+    Weekday:      weekday,
+    Hour:         hour,
+    Minute:       minute,
+    Duration:     int64(duration),
+    Next:         nextOccurrence(time.Now(), weekday, hour, minute),
+    Active:       true,
+  }
+  key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Recurrence", nil), &rec)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  rec.Key_str = key.Encode()
+  _, err = datastore.Put(c, key, &rec)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  fmt.Fprintf(w, `The first election will start at %v.  <a href="/recurrences">Back to your recurring elections</a>.`, rec.Next)
+}
+
+func stopRecurrence(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  key, err := datastore.DecodeKey(r.FormValue("key"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  var rec Recurrence
+  err = datastore.Get(c, key, &rec)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if rec.User_id != u.ID {
+    http.Error(w, "Only the creator of a recurring election can stop it.", http.StatusInternalServerError)
+    return
+  }
+  rec.Active = false
+  _, err = datastore.Put(c, key, &rec)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  fmt.Fprintf(w, `Stopped.  <a href="/recurrences">Back to your recurring elections</a>.`)
+}
+
+type recurrenceTemplateData struct {
+  Recurrence Recurrence
+  Elections  []Election
+}
+
+var recurrenceTemplate = template.Must(template.New("recurrence").Parse(recurrenceTemplateHTML))
+
+const recurrenceTemplateHTML = `
+  <body>
+    Elections made from {{.Recurrence.Name}}:<br/>
+    <table>
+      {{range .Elections}}
+        <tr>
+          <td>{{.Title}}</td>
+          <td>{{.Start}}</td>
+          <td><a href="/view_results?key={{.Key_str}}">results</a></td>
+        </tr>
+      {{end}}
+    </table>
+  </body>
+`
+
+// Lists every Election a Recurrence has made, oldest first, so that their
+// results can be compared.
+func viewRecurrence(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  key, err := datastore.DecodeKey(r.FormValue("key"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  var data recurrenceTemplateData
+  err = datastore.Get(c, key, &data.Recurrence)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if data.Recurrence.User_id != u.ID {
+    http.Error(w, "Only the creator of a recurring election can see its history.", http.StatusInternalServerError)
+    return
+  }
+  query := datastore.NewQuery("Election").Filter("Recurrence_key =", key).Order("Start")
+  _, err = query.GetAll(c, &data.Elections)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  recurrenceTemplate.Execute(w, data)
+}
@@ -0,0 +1,32 @@
+package vote
+
+import (
+  "testing"
+  "time"
+)
+
+func TestNextOccurrence(t *testing.T) {
+  // A Wednesday.
+  wednesday := time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC)
+  tests := []struct {
+    name                  string
+    after                 time.Time
+    weekday, hour, minute int
+    want                  time.Time
+  }{
+    {"daily, later today", wednesday, -1, 11, 30, time.Date(2024, 1, 3, 11, 30, 0, 0, time.UTC)},
+    {"daily, already passed today", wednesday, -1, 9, 0, time.Date(2024, 1, 4, 9, 0, 0, 0, time.UTC)},
+    {"daily, right now", wednesday, -1, 10, 0, time.Date(2024, 1, 4, 10, 0, 0, 0, time.UTC)},
+    {"weekly, later this week", wednesday, int(time.Friday), 9, 0, time.Date(2024, 1, 5, 9, 0, 0, 0, time.UTC)},
+    {"weekly, next week", wednesday, int(time.Monday), 9, 0, time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC)},
+    {"weekly, same day but passed", wednesday, int(time.Wednesday), 9, 0, time.Date(2024, 1, 10, 9, 0, 0, 0, time.UTC)},
+    {"weekly, same day and later", wednesday, int(time.Wednesday), 12, 0, time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC)},
+    {"end of the year", time.Date(2024, 12, 31, 23, 0, 0, 0, time.UTC), -1, 8, 0, time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)},
+    {"times are in UTC", time.Date(2024, 1, 3, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60)), -1, 23, 30, time.Date(2024, 1, 2, 23, 30, 0, 0, time.UTC)},
+  }
+  for _, test := range tests {
+    if got := nextOccurrence(test.after, test.weekday, test.hour, test.minute); !got.Equal(test.want) {
+      t.Errorf("%s: nextOccurrence = %v, want %v", test.name, got, test.want)
+    }
+  }
+}
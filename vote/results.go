@@ -6,6 +6,7 @@ import (
   "fmt"
   "html/template"
   "net/http"
+  "strings"
   "time"
 )
 
@@ -55,10 +56,128 @@ func max(a, b int) int {
 }
 
 type resultsContainer struct {
-  Election   Election
-  Candidates []Candidate
-  Ranks      [][]int
-  Num_votes  int
+  Election  Election
+  Questions []questionResults
+  Num_votes int
+
+  // Set if there is more than one question on the ballot.
+  Multiple bool
+
+  // Of the first question.  Delegations apply to every question alike.
+  Delegation delegationSummary
+
+  // Nil if the election doesn't have a quorum.
+  Quorum *quorumReport
+
+  // For recurring elections, the key of the next occurrence, if it has been
+  // made yet.
+  Next_key *datastore.Key
+}
+
+// The results of one question on the ballot.
+type questionResults struct {
+  Index        int
+  Title        string
+  Candidates   []Candidate
+  Ranks        [][]int
+  Pairwise     []pairwiseRow
+  Totals       []candidateTotal
+  Totals_label string
+  Runoff       string
+  Withheld     bool
+  Noisy        bool
+
+  // Nil for kinds of ballot that don't have pairwise counts.
+  Condorcet *condorcetReport
+
+  // For Majority Judgment, the median grade of each candidate and a chart of
+  // how they were graded.
+  Medians      []candidateMedian
+  Grades_chart template.HTML
+
+  // Once voting has closed, how close a Schulze result was.
+  Sensitivity *sensitivityReport
+
+  // For Schulze results, a drawing of the chains of defeats behind the
+  // ranking, see beatpath.go.
+  Beatpath template.HTML
+}
+
+func makeQuestionResults(index int, t *tally) questionResults {
+  qr := questionResults{
+    Index:        index,
+    Title:        t.Title,
+    Candidates:   t.Candidates,
+    Ranks:        t.Ranks,
+    Pairwise:     pairwiseRows(t.Candidates, t.Pairwise),
+    Totals:       candidateTotals(t.Candidates, t.Totals),
+    Totals_label: t.Election.ballotKind().Totals_label,
+    Runoff:       describeRunoff(t.Candidates, t.Runoff),
+    Withheld:     t.Withheld,
+    Noisy:        t.Noisy,
+    Condorcet:    condorcetAnalysis(t.Candidates, t.Pairwise),
+  }
+  if t.Pairwise != nil && t.Election.ballotKind().Method == methodSchulze {
+    qr.Beatpath = beatpathSVG(t.Candidates, t.Ranks, t.Pairwise)
+  }
+  if t.Grades != nil {
+    qr.Medians = candidateMedians(t.Election, t.Candidates, t.Ranks, t.Grades)
+    qr.Grades_chart = gradeChart(t.Election, t.Candidates, t.Ranks, t.Grades)
+  }
+  return qr
+}
+
+// One row of the pairwise table on the results page.  Counts[j] is how many
+// votes preferred Candidate to candidate j, and is blank for Candidate itself.
+type pairwiseRow struct {
+  Candidate Candidate
+  Counts    []string
+}
+
+// The approvals or total score of one candidate.
+type candidateTotal struct {
+  Candidate Candidate
+  Total     int
+}
+
+func candidateTotals(cands []Candidate, totals []int) []candidateTotal {
+  var ct []candidateTotal
+  for i, total := range totals {
+    ct = append(ct, candidateTotal{cands[i], total})
+  }
+  return ct
+}
+
+// Describes the runoff of a STAR election, or returns "" if there wasn't one.
+func describeRunoff(cands []Candidate, runoff *starRunoff) string {
+  if runoff == nil {
+    return ""
+  }
+  a, b := cands[runoff.Finalists[0]].Name, cands[runoff.Finalists[1]].Name
+  va, vb := runoff.Votes[0], runoff.Votes[1]
+  switch {
+  case va > vb:
+    return fmt.Sprintf("In the runoff, %s beat %s, preferred on %d ballots to %d.", a, b, va, vb)
+  case vb > va:
+    return fmt.Sprintf("In the runoff, %s beat %s, preferred on %d ballots to %d.", b, a, vb, va)
+  }
+  return fmt.Sprintf("The runoff between %s and %s was tied, %d to %d, so the higher total score decides.", a, b, va, vb)
+}
+
+func pairwiseRows(cands []Candidate, pairwise [][]int) []pairwiseRow {
+  var rows []pairwiseRow
+  for i := range pairwise {
+    row := pairwiseRow{Candidate: cands[i]}
+    for j, count := range pairwise[i] {
+      if i == j {
+        row.Counts = append(row.Counts, "")
+      } else {
+        row.Counts = append(row.Counts, fmt.Sprintf("%d", count))
+      }
+    }
+    rows = append(rows, row)
+  }
+  return rows
 }
 
 var resultsTemplate = template.Must(template.New("results").Parse(resultsTemplateHTML))
@@ -66,18 +185,207 @@ const resultsTemplateHTML = `
   <html><body>
     {{ $data := . }}
     {{$data.Election.Title}}<br/>
-    Roughly {{$data.Num_votes}} votes cast.<br/>
-    <table border="1">
-    {{range $index,$element := $data.Ranks}}
-      <tr>
-        <td>Rank {{$index}}</td>
-        {{range $inner_index,$inner_element := $element}}
-          {{$cand := index $data.Candidates $inner_element}}
-          <td>{{$cand.Name}}</td>
+    Roughly <span id="num_votes">{{$data.Num_votes}}</span> votes cast.<br/>
+    {{range $data.Questions}}
+      {{ $q := . }}
+      {{if $data.Multiple}}<h3>{{$q.Title}}</h3>{{end}}
+      <div id="withheld_{{$q.Index}}" {{if not $q.Withheld}}style="display:none"{{end}}>
+        The results will be shown once at least {{$data.Election.Min_ballots}} ballots have been cast.
+      </div>
+      <table border="1" id="ranks_{{$q.Index}}">
+      {{range $index,$element := $q.Ranks}}
+        <tr>
+          <td>Rank {{$index}}</td>
+          {{range $inner_index,$inner_element := $element}}
+            {{$cand := index $q.Candidates $inner_element}}
+            <td>{{$cand.Name}}</td>
+          {{end}}
+        </tr>
+      {{end}}
+      </table>
+      {{if $q.Pairwise}}
+        <br/>
+        Number of votes that preferred each candidate on the left to each candidate along the top:
+        <table border="1">
+          <tr>
+            <td></td>
+            {{range $q.Candidates}}<td>{{.Name}}</td>{{end}}
+          </tr>
+          {{range $q.Pairwise}}
+            <tr>
+              <td>{{.Candidate.Name}}</td>
+              {{range .Counts}}<td>{{.}}</td>{{end}}
+            </tr>
+          {{end}}
+        </table>
+        {{if $q.Noisy}}
+          To protect the privacy of voters, these counts and the ranking have
+          random noise added to them until voting closes.
+        {{end}}
+        <br/>
+      {{end}}
+      {{if $q.Beatpath}}
+        The strongest chain of defeats from each candidate to each candidate
+        they are ranked above.  Dashed arrows are defeats that only happen
+        through other candidates.<br/>
+        {{$q.Beatpath}}<br/>
+        <a href="/results.dot?key={{$data.Election.Key_str}}&question={{$q.Index}}">Download as a Graphviz file</a><br/>
+      {{end}}
+      {{with $q.Condorcet}}
+        <p>
+        {{range .Explanation}}
+          {{.}}<br/>
         {{end}}
-      </tr>
+        </p>
+      {{end}}
+      {{with $q.Sensitivity}}
+        {{if .Challengers}}
+          How many ballots it would take to change who is in the top tier:
+          <table border="1">
+            <tr><td>Candidate</td><td>Extra ballots ranking them first</td><td>Ballots changed to rank them first</td></tr>
+            {{range .Challengers}}
+              <tr>
+                <td>{{.Candidate.Name}}</td>
+                <td>{{.Additions}}</td>
+                <td>{{if .Changes}}{{.Changes}}{{else}}not enough ballots{{end}}</td>
+              </tr>
+            {{end}}
+          </table>
+        {{end}}
+        {{if .Frequencies}}
+          How often each candidate wins outright when the counted ballots are
+          drawn again at random, {{.Rounds}} times:
+          <table border="1">
+            <tr><td>Candidate</td><td>Wins</td></tr>
+            {{range .Frequencies}}
+              <tr><td>{{.Candidate.Name}}</td><td>{{.Wins}} ({{printf "%.1f" .Percent}}%)</td></tr>
+            {{end}}
+            {{if .Ties}}<tr><td>Tie for first</td><td>{{.Ties}}</td></tr>{{end}}
+          </table>
+        {{end}}
+        <br/>
+      {{end}}
+      {{if $q.Totals}}
+        <br/>
+        <table border="1">
+          <tr><td>Candidate</td><td>{{$q.Totals_label}}</td></tr>
+          {{range $q.Totals}}
+            <tr><td>{{.Candidate.Name}}</td><td>{{.Total}}</td></tr>
+          {{end}}
+        </table>
+        {{if $q.Runoff}}{{$q.Runoff}}<br/>{{end}}
+        {{if and $q.Noisy (not $q.Pairwise)}}
+          To protect the privacy of voters, these totals and the ranking have
+          random noise added to them until voting closes.<br/>
+        {{end}}
+      {{end}}
+      {{if $q.Medians}}
+        <br/>
+        <table border="1">
+          <tr><td>Candidate</td><td>Median grade</td></tr>
+          {{range $q.Medians}}
+            <tr><td>{{.Candidate.Name}}</td><td>{{.Median}}</td></tr>
+          {{end}}
+        </table>
+        {{$q.Grades_chart}}<br/>
+        {{if $q.Noisy}}
+          To protect the privacy of voters, these grades and the ranking have
+          random noise added to them until voting closes.<br/>
+        {{end}}
+      {{end}}
+    {{end}}
+    {{with $data.Quorum}}
+      {{if .Open}}
+        Quorum: {{.Required}} {{if .Weighted}}votes, by weight,{{else}}voters{{end}} need to take part.
+        {{if .Withheld}}
+          Whether the quorum has been reached will be shown once at least {{$data.Election.Min_ballots}} ballots have been cast.
+        {{else}}
+          {{if .Met}}The quorum has been reached.{{else}}The quorum has not been reached yet.{{end}}
+        {{end}}
+        <br/>
+      {{else}}
+        Quorum: {{.Cast}} of the {{.Required}} {{if .Weighted}}votes, by weight,{{else}}voters{{end}}
+        needed have taken part{{if .Met}}, so the quorum has been reached{{end}}.<br/>
+      {{end}}
+    {{end}}
+    {{if $data.Election.Extensions}}
+      Voting was extended {{$data.Election.Extensions}} times because the quorum hadn't been reached.<br/>
+    {{end}}
+    {{if $data.Election.Non_binding}}
+      <b>The quorum was not reached, so this result is not binding.</b><br/>
+    {{end}}
+    {{if $data.Election.Allow_delegation}}{{with $data.Delegation}}
+      {{if .Withheld}}
+        How votes were delegated will be shown once at least {{$data.Election.Min_ballots}} ballots have been cast.<br/>
+      {{else}}
+        {{if .Blurred}}About{{end}} {{.Delegated}} of these votes were delegated.
+        {{if .Unresolved}}
+          Another {{if .Blurred}}roughly{{end}} {{.Unresolved}} delegated votes weren't counted
+          because their chain of delegates went around in a circle or ended at
+          someone who didn't vote.
+        {{end}}
+        <br/>
+        {{if .Delegates}}
+          <table border="1">
+            <tr><td>Delegate</td><td>Votes, including their own{{if .Blurred}}, roughly{{end}}</td></tr>
+            {{range .Delegates}}
+              <tr><td>{{.Name}}</td><td>{{.Votes}}</td></tr>
+            {{end}}
+          </table>
+        {{end}}
+        {{if .Blurred}}
+          These numbers are rounded until voting closes.<br/>
+        {{end}}
+      {{end}}
+    {{end}}{{end}}
+    <script>
+      // Redraw the results whenever the server says they've changed.
+      if (window.EventSource) {
+        var source = new EventSource("/results_events?key={{$data.Election.Key_str}}");
+        source.onmessage = function(event) {
+          var results = JSON.parse(event.data);
+          document.getElementById("num_votes").textContent = results.num_votes;
+          // The first question is at the top level of the results, and any
+          // others are in results.questions.
+          var questions = [results].concat(results.questions || []);
+          for (var q = 0; q < questions.length; q++) {
+            var ranks = questions[q].ranks;
+            document.getElementById("withheld_" + q).style.display = questions[q].withheld ? "" : "none";
+            var table = document.getElementById("ranks_" + q);
+            while (table.rows.length > 0) {
+              table.deleteRow(0);
+            }
+            for (var i = 0; ranks && i < ranks.length; i++) {
+              var row = table.insertRow(-1);
+              row.insertCell(-1).textContent = "Rank " + i;
+              for (var j = 0; j < ranks[i].length; j++) {
+                row.insertCell(-1).textContent = ranks[i][j];
+              }
+            }
+          }
+          if (results.closed) {
+            source.close();
+          }
+        };
+      }
+    </script>
+    <a href="/compare_results?key={{$data.Election.Key_str}}">Compare counting methods</a><br/>
+    {{if $data.Election.Runoff_key}}
+      There was no clear winner, so there is a
+      <a href="/view_results?key={{$data.Election.Runoff_key.Encode}}">runoff</a>.<br/>
+    {{end}}
+    {{if $data.Election.Runoff_of}}
+      This is a runoff of <a href="/view_results?key={{$data.Election.Runoff_of.Encode}}">an earlier election</a>.<br/>
+    {{end}}
+    {{if $data.Election.Previous_key}}
+      <a href="/view_results?key={{$data.Election.Previous_key.Encode}}">Previous occurrence</a>
+    {{end}}
+    {{if $data.Next_key}}
+      <a href="/view_results?key={{$data.Next_key.Encode}}">Next occurrence</a>
+    {{end}}
+    {{if $data.Election.Recurrence_key}}
+      <a href="/recurrence?key={{$data.Election.Recurrence_key.Encode}}">All occurrences</a>
     {{end}}
-    </table>
   <body/></html>
 `
 
@@ -98,7 +406,7 @@ func blurNumber(n int) int {
   return c
 }
 
-func updateGraph(graph [][]int, b *Ballot) {
+func updateGraph(graph [][]int, b *Ballot, weight int) {
   // To make things easy on ourselves we go through and replace any ranks
   // that are non-positive with one higher than the maximum rank.  This
   // indicates that the voter preferred all ranked candidates to this one.
@@ -111,83 +419,79 @@ func updateGraph(graph [][]int, b *Ballot) {
     for j := range b.Ordering {
       // Lower is better - like 1st place is better than 2nd place
       if b.Ordering[i] < b.Ordering[j] {
-        graph[i][j]++
+        graph[i][j] += weight
       }
     }
   }
 }
 
-func viewResults(w http.ResponseWriter, r *http.Request) {
-  key, err := datastore.DecodeKey(r.FormValue("key"))
-  if err != nil {
-    http.Error(w, err.Error(), http.StatusInternalServerError)
-    return
-  }
-
-  var e Election
-  c := appengine.NewContext(r)
-  err = datastore.Get(c, key, &e)
-  if err != nil {
-    http.Error(w, err.Error(), http.StatusInternalServerError)
-    return
-  }
-
-  if e.Hide_results && e.End.UnixNano() > time.Now().UnixNano() {
-    fmt.Fprintf(w, "Results of this election will not be available until voting is closed.")
-    return
-  }
-
-  cands, err := e.GetCandidates(c)
-  if err != nil {
-    http.Error(w, err.Error(), http.StatusInternalServerError)
-    return
-  }
-
-  graph := make([][]int, len(cands))
-  for i := range graph {
-    graph[i] = make([]int, len(cands))
-  }
-
+// Returns the most recent Ballot cast by each user for each question in the
+// Election with the given key, ignoring any Ballots that aren't viewable as
+// of now.
+func latestBallots(c appengine.Context, key *datastore.Key, now time.Time) ([]Ballot, error) {
   query := datastore.NewQuery("Ballot")
   query = query.Ancestor(key).Order("User_id")
-    
+
+  var ballots []Ballot
+  // Index in ballots of the first ballot of the user being looked at.
+  user_start := 0
   it := query.Run(c)
-  var b, latest Ballot
-  var prev_user_id string
-  count := 0
-  now := time.Now().UnixNano()
-  for _, err := it.Next(&b); err == nil; _, err = it.Next(&b) {
-    if b.User_id == prev_user_id || prev_user_id == "" {
-      prev_user_id = b.User_id
-      // Unviewable ballots should have no effect on anything
-      if b.Viewable.UnixNano() < now {
-        if latest.User_id == "" || b.Time.UnixNano() > latest.Time.UnixNano() {
-          latest = b
-        }
-      }
-      b = Ballot{}
-      continue // Don't count more than one ballot from any one user
+  for {
+    var b Ballot
+    _, err := it.Next(&b)
+    if err == datastore.Done {
+      break
+    }
+    if err != nil {
+      return nil, err
     }
-    // We only set the user id if the ballot was viewable, so this is
-    // sufficient to check its validity.
-    if latest.User_id != "" {
-      count++
-      updateGraph(graph, &latest)
+    // Unviewable ballots should have no effect on anything
+    if !b.Viewable.Before(now) {
+      continue
     }
-    prev_user_id = b.User_id
-    latest = Ballot{}
-    if b.Viewable.UnixNano() < now {
-      if latest.User_id == "" || b.Time.UnixNano() > latest.Time.UnixNano() {
-        latest = b
+    // Ballots come back ordered by user, so we only need to compare against
+    // the ballots of the last user to only count one ballot from any one
+    // user for each question.
+    if len(ballots) > user_start && ballots[user_start].User_id != b.User_id {
+      user_start = len(ballots)
+    }
+    found := false
+    for i := user_start; i < len(ballots); i++ {
+      if ballots[i].Question == b.Question {
+        if b.Time.After(ballots[i].Time) {
+          ballots[i] = b
+        }
+        found = true
       }
     }
-    b = Ballot{}
+    if !found {
+      ballots = append(ballots, b)
+    }
+  }
+  return ballots, nil
+}
+
+// Returns the pairwise matrix for ballots, graph[i][j] is the total weight of
+// the ballots that prefer candidate i to candidate j.
+func pairwiseGraph(e *Election, num_candidates int, ballots []Ballot) [][]int {
+  graph := make([][]int, num_candidates)
+  for i := range graph {
+    graph[i] = make([]int, num_candidates)
+  }
+  for i := range ballots {
+    updateGraph(graph, &ballots[i], e.VoterWeight(ballots[i].Email))
   }
-  // The last one won't be checked in the loop above so we need to check for
-  // it separately.
-  if latest.Viewable.UnixNano() < now {
-    count++
-    updateGraph(graph, &latest)
+  return graph
+}
+
+// Returns the strengths of the strongest paths of the Schulze method,
+// paths[i][j] is the strength of the strongest chain of defeats that leads
+// from candidate i to candidate j, and 0 if there is no such chain.
+// pairwise is left unchanged.
+func strongestPaths(pairwise [][]int) [][]int {
+  graph := make([][]int, len(pairwise))
+  for i := range graph {
+    graph[i] = append([]int(nil), pairwise[i]...)
   }
 
   for i := range graph {
@@ -208,7 +512,14 @@ func viewResults(w http.ResponseWriter, r *http.Request) {
       }
     }
   }
+  return graph
+}
 
+// Ranks the candidates using the Schulze method on the pairwise matrix
+// graph.  Each element of the result is a tier of candidates that are tied
+// with each other, best tier first.  pairwise is left unchanged.
+func schulzeRanking(pairwise [][]int) [][]int {
+  graph := strongestPaths(pairwise)
   var rankings [][]int
   var used []int
   prev := -1
@@ -241,11 +552,225 @@ func viewResults(w http.ResponseWriter, r *http.Request) {
       graph[c][c] = -1 // signals that a candidate's rank has been calculated
     }
   }
+  return rankings
+}
+
+// The outcome of counting one question of an Election at some point in
+// time, after its disclosure policy has been applied.
+type tally struct {
+  Title string
+
+  // The Election with the ballot settings of the question, see
+  // electionQuestion.
+  Election *Election
+
+  Candidates []Candidate
+  Ranks      [][]int
+  Pairwise   [][]int
+  Totals     []int
+  Grades     [][]int
+  Runoff     *starRunoff
+  Num_votes  int
+  Delegation delegationSummary
+
+  // Withheld is set if too few ballots have been cast to show anything but
+  // Num_votes, and Noisy is set if Pairwise and Ranks have had noise added.
+  // Pairwise is also left out while voting is open if there is no noise.
+  Withheld bool
+  Noisy    bool
+}
+
+// Counts all of the Ballots for the first question in e that are viewable as
+// of now.
+func tallyElection(c appengine.Context, key *datastore.Key, e *Election, now time.Time) (*tally, error) {
+  tallies, err := tallyQuestions(c, key, e, now)
+  if err != nil {
+    return nil, err
+  }
+  return tallies[0], nil
+}
+
+// One question of an Election along with the Ballots that count for it.
+type countedQuestion struct {
+  electionQuestion
+  Ballots    []Ballot
+  Delegation delegationSummary
+}
+
+// Returns every question of e along with the Ballots for it that are
+// viewable as of now, with delegated votes resolved.
+func countedQuestions(c appengine.Context, key *datastore.Key, e *Election, now time.Time) ([]countedQuestion, error) {
+  cands, err := e.GetCandidates(c)
+  if err != nil {
+    return nil, err
+  }
+  questions, err := getQuestions(c, key, e, cands)
+  if err != nil {
+    return nil, err
+  }
+  ballots, err := latestBallots(c, key, now)
+  if err != nil {
+    return nil, err
+  }
+  var delegations []Delegation
+  if e.Allow_delegation {
+    delegations, err = latestDelegations(c, key, now)
+    if err != nil {
+      return nil, err
+    }
+  }
+  // Voters can be taken off the list after they have voted, in which case
+  // their ballots and delegations don't count any more.
+  eligible, err := e.eligibleVoters(c)
+  if err != nil {
+    return nil, err
+  }
+  ballots, delegations = filterEligible(eligible, ballots, delegations)
+  var counted []countedQuestion
+  for _, q := range questions {
+    cq := countedQuestion{electionQuestion: q, Ballots: questionBallots(ballots, q.Index)}
+    if e.Allow_delegation {
+      cq.Ballots, cq.Delegation = resolveDelegations(cq.Ballots, delegations)
+    }
+    counted = append(counted, cq)
+  }
+  return counted, nil
+}
+
+// Returns the ballots and delegations in the given ones that come from voters
+// in eligible, as returned by Election.eligibleVoters.  Ballots cast before
+// Ballot had an Email can't be checked, but they could only have been cast by
+// an eligible voter, so they are kept.
+func filterEligible(eligible map[string]bool, ballots []Ballot, delegations []Delegation) ([]Ballot, []Delegation) {
+  if eligible == nil {
+    return ballots, delegations
+  }
+  var kept []Ballot
+  for _, b := range ballots {
+    if b.Email == "" || eligible[strings.ToLower(b.Email)] {
+      kept = append(kept, b)
+    }
+  }
+  var kept_delegations []Delegation
+  for _, d := range delegations {
+    if eligible[strings.ToLower(d.Email)] {
+      kept_delegations = append(kept_delegations, d)
+    }
+  }
+  return kept, kept_delegations
+}
+
+// Counts all of the Ballots in e that are viewable as of now, one tally for
+// each question.  Everything that publishes results goes through here, so it
+// is where e's disclosure policy is applied.
+func tallyQuestions(c appengine.Context, key *datastore.Key, e *Election, now time.Time) ([]*tally, error) {
+  counted_at := now
+  if e.Noise_epsilon > 0 && now.Before(e.End) {
+    err := ensureNoiseSecret(c, key, e)
+    if err != nil {
+      return nil, err
+    }
+    counted_at = e.noisyRelease(now)
+  }
+  questions, err := countedQuestions(c, key, e, counted_at)
+  if err != nil {
+    return nil, err
+  }
+  var tallies []*tally
+  for _, q := range questions {
+    kind := q.Election.ballotKind()
+    counts := kind.Count(q.Election, len(q.Candidates), q.Ballots)
+    t := &tally{
+      Title:      q.Title,
+      Election:   q.Election,
+      Candidates: q.Candidates,
+      Pairwise:   counts.Pairwise,
+      Totals:     counts.Totals,
+      Grades:     counts.Grades,
+      Num_votes:  len(q.Ballots),
+      Delegation: q.Delegation,
+    }
+    t.Ranks, t.Runoff = kind.Rank(counts)
+    applyDisclosure(q.Election, t, q.Ballots, now)
+    tallies = append(tallies, t)
+  }
+  return tallies, nil
+}
+
+func viewResults(w http.ResponseWriter, r *http.Request) {
+  key, err := datastore.DecodeKey(r.FormValue("key"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  var e Election
+  c := appengine.NewContext(r)
+  err = datastore.Get(c, key, &e)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if !checkCanView(w, c, key, &e) {
+    return
+  }
+
+  if e.Hide_results && e.End.UnixNano() > time.Now().UnixNano() {
+    fmt.Fprintf(w, "Results of this election will not be available until voting is closed.")
+    return
+  }
+
+  tallies, err := tallyQuestions(c, key, &e, time.Now())
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
   container := resultsContainer{
     Election:   e,
-    Candidates: cands,
-    Ranks:      rankings,
-    Num_votes:  blurNumber(count),
+    Num_votes:  blurNumber(tallies[0].Num_votes),
+    Multiple:   len(tallies) > 1,
+    Delegation: tallies[0].Delegation,
+  }
+  for i, t := range tallies {
+    container.Questions = append(container.Questions, makeQuestionResults(i, t))
+  }
+  if now := time.Now(); e.votingClosed(now) {
+    // The ballots are only loaded again if some question's analysis hasn't
+    // been stored yet.
+    var questions []countedQuestion
+    for i, t := range tallies {
+      if t.Withheld || t.Election.ballotKind().Method != methodSchulze {
+        continue
+      }
+      container.Questions[i].Sensitivity, err = cachedSensitivity(c, key, &e, i, t.Num_votes, now, func() (*sensitivityReport, error) {
+        if questions == nil {
+          var err error
+          questions, err = countedQuestions(c, key, &e, now)
+          if err != nil {
+            return nil, err
+          }
+        }
+        return analyzeSensitivity(key, &questions[i], t.Ranks), nil
+      })
+      if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+      }
+    }
+  }
+  if e.hasQuorum() {
+    container.Quorum, err = publishedQuorum(c, key, &e, time.Now())
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+  }
+  if e.Recurrence_key != nil {
+    next_keys, err := datastore.NewQuery("Election").Filter("Previous_key =", key).KeysOnly().Limit(1).GetAll(c, nil)
+    if err == nil && len(next_keys) > 0 {
+      container.Next_key = next_keys[0]
+    }
   }
   err = resultsTemplate.Execute(w, container)
   if err != nil {
@@ -0,0 +1,117 @@
+package vote
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestSchulzeRanking(t *testing.T) {
+  tests := []struct {
+    name     string
+    pairwise [][]int
+    want     [][]int
+  }{
+    {
+      // The example from Schulze's paper, with 45 voters.
+      name: "five candidates",
+      pairwise: [][]int{
+        {0, 20, 26, 30, 22},
+        {25, 0, 16, 33, 18},
+        {19, 29, 0, 17, 24},
+        {15, 12, 28, 0, 14},
+        {23, 27, 21, 31, 0},
+      },
+      want: [][]int{{4}, {0}, {2}, {1}, {3}},
+    },
+    {
+      name:     "head to head tie",
+      pairwise: [][]int{{0, 5}, {5, 0}},
+      want:     [][]int{{0, 1}},
+    },
+    {
+      name: "cycle of equal strength",
+      pairwise: [][]int{
+        {0, 6, 4},
+        {4, 0, 6},
+        {6, 4, 0},
+      },
+      want: [][]int{{0, 1, 2}},
+    },
+    {
+      name: "cycle broken at its weakest defeat",
+      pairwise: [][]int{
+        {0, 6, 4},
+        {4, 0, 7},
+        {6, 3, 0},
+      },
+      want: [][]int{{0, 1}, {2}},
+    },
+  }
+  for _, test := range tests {
+    if got := schulzeRanking(test.pairwise); !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: schulzeRanking = %v, want %v", test.name, got, test.want)
+    }
+  }
+}
+
+func TestBlurNumber(t *testing.T) {
+  tests := []struct {
+    n, want int
+  }{
+    {3, 2},
+    {4, 5},
+    {7, 5},
+    {8, 10},
+    {16, 10},
+    {30, 50},
+    {74, 50},
+    {76, 100},
+    {1000, 1000},
+  }
+  for _, test := range tests {
+    if got := blurNumber(test.n); got != test.want {
+      t.Errorf("blurNumber(%d) = %d, want %d", test.n, got, test.want)
+    }
+  }
+}
+
+func TestFilterEligible(t *testing.T) {
+  ballots := []Ballot{
+    {User_id: "1", Email: "a@x"},
+    {User_id: "2", Email: "B@x"},
+    {User_id: "3", Email: "c@x"},
+    // Cast before ballots had an Email.
+    {User_id: "4"},
+  }
+  delegations := []Delegation{
+    {User_id: "5", Email: "D@x", Delegate_email: "a@x"},
+    {User_id: "6", Email: "e@x", Delegate_email: "a@x"},
+  }
+  tests := []struct {
+    name        string
+    eligible    map[string]bool
+    ballots     []string
+    delegations []string
+  }{
+    {"everyone can vote", nil, []string{"1", "2", "3", "4"}, []string{"5", "6"}},
+    {"addresses match ignoring case", map[string]bool{"a@x": true, "b@x": true, "d@x": true}, []string{"1", "2", "4"}, []string{"5"}},
+    {"nobody listed any more", map[string]bool{}, []string{"4"}, nil},
+  }
+  for _, test := range tests {
+    kept, kept_delegations := filterEligible(test.eligible, ballots, delegations)
+    var got []string
+    for _, b := range kept {
+      got = append(got, b.User_id)
+    }
+    if !reflect.DeepEqual(got, test.ballots) {
+      t.Errorf("%s: kept the ballots of %v, want %v", test.name, got, test.ballots)
+    }
+    got = nil
+    for _, d := range kept_delegations {
+      got = append(got, d.User_id)
+    }
+    if !reflect.DeepEqual(got, test.delegations) {
+      t.Errorf("%s: kept the delegations of %v, want %v", test.name, got, test.delegations)
+    }
+  }
+}
@@ -0,0 +1,518 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "appengine/user"
+  "fmt"
+  "html/template"
+  "net/http"
+  "strings"
+  "time"
+)
+
+func init() {
+  http.HandleFunc("/roles", viewRoles)
+  http.HandleFunc("/grant_role", grantRole)
+  http.HandleFunc("/revoke_role", revokeRole)
+  http.HandleFunc("/audit", viewAudit)
+}
+
+// The roles that a user can have in an election.  The owner is always the
+// user that made the election, voters are the people in its electorate, and
+// co-organizers and observers are given their roles by the owner with a Role.
+const (
+  roleOwner       = "owner"
+  roleCoOrganizer = "co-organizer"
+  roleObserver    = "observer"
+  roleVoter       = "voter"
+)
+
+// The roles that the owner can grant and revoke on the roles page.
+var grantableRoles = []string{roleCoOrganizer, roleObserver, roleVoter}
+
+// The parent of a Role is the Election it is for.
+type Role struct {
+  // In lower case, see roleEmails.
+  Email string
+  Role  string
+
+  // User.Email of whoever granted the role, and when.
+  Granted_by string
+  Granted    time.Time
+}
+
+// Returns the addresses that the Roles of the user with the given email could
+// be stored under.  Roles are stored with the address in lower case, but
+// ones granted before that have it as it was typed.
+func roleEmails(email string) []string {
+  lower := strings.ToLower(email)
+  if lower == email {
+    return []string{email}
+  }
+  return []string{lower, email}
+}
+
+// The parent of an AuditEntry is the Election it is about.  Everything that
+// organizers do to an election, and every step of its lifecycle, is recorded
+// so that observers can see what happened and when.
+type AuditEntry struct {
+  Time time.Time
+
+  // User.Email of whoever did this, or empty if votastic did it on its own.
+  Actor string
+
+  Action string
+}
+
+// Records an AuditEntry for the Election with the given key.  Failures are
+// logged rather than returned, the same as for notifications, so that the
+// audit log can't get in the way of running an election.
+func recordAudit(c appengine.Context, key *datastore.Key, actor string, format string, args ...interface{}) {
+  entry := AuditEntry{
+    Time:   time.Now(),
+    Actor:  actor,
+    Action: fmt.Sprintf(format, args...),
+  }
+  _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "AuditEntry", key), &entry)
+  if err != nil {
+    c.Errorf("Unable to record '%s' for %s: %v", entry.Action, key.Encode(), err)
+  }
+}
+
+// Gives everyone that has a Role in the Election with the key from the same
+// Role in the Election with the key to.
+func copyRoles(c appengine.Context, from, to *datastore.Key) error {
+  var roles []Role
+  _, err := datastore.NewQuery("Role").Ancestor(from).GetAll(c, &roles)
+  if err != nil {
+    return err
+  }
+  for i := range roles {
+    roles[i].Email = strings.ToLower(roles[i].Email)
+    _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Role", to), &roles[i])
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Things that a user can do with an election.
+type permission int
+
+const (
+  // Cast a ballot or delegate a vote.
+  permVote permission = iota
+
+  // See turnout, the list of voters and the audit log, but not anything
+  // that would say how someone voted.
+  permObserve
+
+  // Change how an election is run, like its webhooks, and copy it.
+  permManage
+
+  // Grant and revoke roles.
+  permGrant
+)
+
+// Every role that one user has in one election.  Members of the
+// organization that an election belongs to can do everything a co-organizer
+// can.
+type access struct {
+  Owner        bool
+  Co_organizer bool
+  Observer     bool
+  Voter        bool
+  Member       bool
+}
+
+func (a access) can(p permission) bool {
+  switch p {
+  case permVote:
+    return a.Voter
+  case permObserve:
+    return a.Owner || a.Co_organizer || a.Observer || a.Member
+  case permManage:
+    return a.Owner || a.Co_organizer || a.Member
+  case permGrant:
+    return a.Owner
+  }
+  return false
+}
+
+// Works out what roles u has in the Election e, which has the given key.
+func electionAccess(c appengine.Context, key *datastore.Key, e *Election, u *user.User) (access, error) {
+  a := access{
+    Owner: e.User_id == u.ID,
+    Voter: e.IsUserAllowedToVote(c, u),
+  }
+  if e.Org_key != nil {
+    var err error
+    a.Member, err = isOrgMember(c, e.Org_key, u)
+    if err != nil {
+      return a, err
+    }
+    // An election that isn't limited to a list of voters is only open to
+    // everyone in its organization.
+    if len(e.Emails) == 0 && len(e.Groups) == 0 {
+      a.Voter = a.Member
+    }
+  }
+  var roles []Role
+  for _, email := range roleEmails(u.Email) {
+    _, err := datastore.NewQuery("Role").Ancestor(key).Filter("Email =", email).GetAll(c, &roles)
+    if err != nil {
+      return a, err
+    }
+  }
+  for _, role := range roles {
+    switch role.Role {
+    case roleCoOrganizer:
+      a.Co_organizer = true
+    case roleObserver:
+      a.Observer = true
+    }
+  }
+  return a, nil
+}
+
+var permissionErrors = map[permission]string{
+  permVote:    "You have not been listed as a participant in this election.",
+  permObserve: "Only the organizers and observers of an election can see that.",
+  permManage:  "Only the organizers of an election can do that.",
+  permGrant:   "Only the creator of an election can do that.",
+}
+
+// Makes sure that u is allowed to do p in the Election e, which has the given
+// key, writing out an error if they aren't.
+func checkElectionAccess(w http.ResponseWriter, c appengine.Context, key *datastore.Key, e *Election, u *user.User, p permission) (access, bool) {
+  a, err := electionAccess(c, key, e, u)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return a, false
+  }
+  if !a.can(p) {
+    http.Error(w, permissionErrors[p], http.StatusInternalServerError)
+    return a, false
+  }
+  return a, true
+}
+
+// Loads the Election specified by the key in the request, along with its
+// Candidates, making sure that u is allowed to do p in it.
+func getElectionFor(w http.ResponseWriter, r *http.Request, c appengine.Context, u *user.User, p permission) (*datastore.Key, *Election, []Candidate, bool) {
+  key, err := datastore.DecodeKey(r.FormValue("key"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, nil, nil, false
+  }
+  var e Election
+  err = datastore.Get(c, key, &e)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, nil, nil, false
+  }
+  _, ok := checkElectionAccess(w, c, key, &e, u, p)
+  if !ok {
+    return nil, nil, nil, false
+  }
+  cands, err := e.GetCandidates(c)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return nil, nil, nil, false
+  }
+  return key, &e, cands, true
+}
+
+type rolesTemplateData struct {
+  Election Election
+  Roles    []Role
+  Roles_to []string
+}
+
+var rolesTemplate = template.Must(template.New("roles").Parse(rolesTemplateHTML))
+
+const rolesTemplateHTML = `
+  <body>
+    Roles in {{.Election.Title}}:<br/>
+    <table border="1">
+      <tr><td>{{.Election.User_email}}</td><td>owner</td><td></td></tr>
+      {{range .Roles}}
+        <tr>
+          <td>{{.Email}}</td>
+          <td>{{.Role}}</td>
+          <td>
+            <form action="/revoke_role" method="post">
+              <input type="hidden" name="key" value="{{$.Election.Key_str}}"/>
+              <input type="hidden" name="email" value="{{.Email}}"/>
+              <input type="hidden" name="role" value="{{.Role}}"/>
+              <input type="submit" value="Revoke"/>
+            </form>
+          </td>
+        </tr>
+      {{end}}
+      {{range .Election.Emails}}
+        <tr>
+          <td>{{.}}</td>
+          <td>voter</td>
+          <td>
+            <form action="/revoke_role" method="post">
+              <input type="hidden" name="key" value="{{$.Election.Key_str}}"/>
+              <input type="hidden" name="email" value="{{.}}"/>
+              <input type="hidden" name="role" value="voter"/>
+              <input type="submit" value="Revoke"/>
+            </form>
+          </td>
+        </tr>
+      {{end}}
+    </table>
+    Taking a voter off the list also takes any ballot they have already cast
+    out of the results.<br/>
+    {{if .Election.Groups}}
+      Members of the election's voter groups may also vote.  They can only be
+      removed from the groups themselves.<br/>
+    {{end}}
+    Co-organizers can manage the election, observers can see turnout and the
+    <a href="/audit?key={{.Election.Key_str}}">audit log</a>.  Neither can see
+    how anyone voted.<br/>
+    <form action="/grant_role" method="post">
+      <input type="hidden" name="key" value="{{.Election.Key_str}}"/>
+      Give <input type="text" name="email" size="40"/> the role
+      <select name="role">
+        {{range .Roles_to}}<option value="{{.}}">{{.}}</option>{{end}}
+      </select>
+      <input type="submit" value="Grant"/>
+    </form>
+  </body>
+`
+
+func viewRoles(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  key, e, _, ok := getElectionFor(w, r, c, u, permGrant)
+  if !ok {
+    return
+  }
+  data := rolesTemplateData{Election: *e, Roles_to: grantableRoles}
+  _, err := datastore.NewQuery("Role").Ancestor(key).Order("Email").GetAll(c, &data.Roles)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  rolesTemplate.Execute(w, data)
+}
+
+// Removes the voter with the given email from e, along with their weight and
+// name.  Returns false if they weren't listed.
+func (e *Election) removeVoter(address string) bool {
+  for i, email := range e.Emails {
+    if !strings.EqualFold(email, address) {
+      continue
+    }
+    e.Emails = append(e.Emails[:i], e.Emails[i+1:]...)
+    if len(e.Weights) > i {
+      e.Weights = append(e.Weights[:i], e.Weights[i+1:]...)
+    }
+    if len(e.Voter_names) > i {
+      e.Voter_names = append(e.Voter_names[:i], e.Voter_names[i+1:]...)
+    }
+    return true
+  }
+  return false
+}
+
+type confirmRestrictTemplateData struct {
+  Election Election
+  Email    string
+}
+
+var confirmRestrictTemplate = template.Must(template.New("confirm_restrict").Parse(confirmRestrictTemplateHTML))
+
+const confirmRestrictTemplateHTML = `
+  <body>
+    {{.Election.Title}} is open to everyone right now.  If {{.Email}} is made
+    a voter then only the voters on the list will be able to vote.
+    <form action="/grant_role" method="post">
+      <input type="hidden" name="key" value="{{.Election.Key_str}}"/>
+      <input type="hidden" name="email" value="{{.Email}}"/>
+      <input type="hidden" name="role" value="voter"/>
+      <input type="hidden" name="restrict" value="restrict"/>
+      <input type="submit" value="Only let listed voters vote"/>
+    </form>
+    <a href="/roles?key={{.Election.Key_str}}">Back to the roles</a>
+  </body>
+`
+
+func grantRole(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  key, e, _, ok := getElectionFor(w, r, c, u, permGrant)
+  if !ok {
+    return
+  }
+  email := strings.TrimSpace(r.FormValue("email"))
+  if email == "" {
+    http.Error(w, "Enter the email address of the person to give a role to.", http.StatusInternalServerError)
+    return
+  }
+  role := r.FormValue("role")
+  switch role {
+  case roleVoter:
+    // Listing even one voter closes an election that is open to everyone,
+    // so the owner has to say that that's what they want.
+    if len(e.Emails) == 0 && len(e.Groups) == 0 && r.FormValue("restrict") != "restrict" {
+      confirmRestrictTemplate.Execute(w, confirmRestrictTemplateData{*e, email})
+      return
+    }
+    for _, listed := range e.Emails {
+      if strings.EqualFold(listed, email) {
+        http.Error(w, email+" is already a voter.", http.StatusInternalServerError)
+        return
+      }
+    }
+    e.Emails = append(e.Emails, email)
+    if len(e.Weights) > 0 {
+      e.Weights = append(e.Weights, 1)
+    }
+    if len(e.Voter_names) > 0 {
+      e.Voter_names = append(e.Voter_names, "")
+    }
+    _, err := datastore.Put(c, key, e)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+
+  case roleCoOrganizer, roleObserver:
+    var existing []Role
+    for _, listed := range roleEmails(email) {
+      _, err := datastore.NewQuery("Role").Ancestor(key).Filter("Email =", listed).Filter("Role =", role).GetAll(c, &existing)
+      if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+      }
+    }
+    if len(existing) > 0 {
+      http.Error(w, fmt.Sprintf("%s is already a %s.", email, role), http.StatusInternalServerError)
+      return
+    }
+    grant := Role{Email: strings.ToLower(email), Role: role, Granted_by: u.Email, Granted: time.Now()}
+    _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Role", key), &grant)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+
+  default:
+    http.Error(w, fmt.Sprintf("Unknown role: '%s'", role), http.StatusInternalServerError)
+    return
+  }
+  recordAudit(c, key, u.Email, "Gave %s the role %s", email, role)
+  fmt.Fprintf(w, `%s is now a %s.  <a href="/roles?key=%s">Back to the roles</a>.`, template.HTMLEscapeString(email), role, e.Key_str)
+}
+
+func revokeRole(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  key, e, _, ok := getElectionFor(w, r, c, u, permGrant)
+  if !ok {
+    return
+  }
+  email := r.FormValue("email")
+  role := r.FormValue("role")
+  switch role {
+  case roleVoter:
+    if !e.removeVoter(email) {
+      http.Error(w, email+" is not a voter.", http.StatusInternalServerError)
+      return
+    }
+    _, err := datastore.Put(c, key, e)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+
+  default:
+    var keys []*datastore.Key
+    for _, listed := range roleEmails(email) {
+      listed_keys, err := datastore.NewQuery("Role").Ancestor(key).Filter("Email =", listed).Filter("Role =", role).KeysOnly().GetAll(c, nil)
+      if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+      }
+      keys = append(keys, listed_keys...)
+    }
+    if len(keys) == 0 {
+      http.Error(w, fmt.Sprintf("%s is not a %s.", email, role), http.StatusInternalServerError)
+      return
+    }
+    err := datastore.DeleteMulti(c, keys)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+  }
+  recordAudit(c, key, u.Email, "Took the role %s away from %s", role, email)
+  fmt.Fprintf(w, `%s is no longer a %s.  <a href="/roles?key=%s">Back to the roles</a>.`, template.HTMLEscapeString(email), template.HTMLEscapeString(role), e.Key_str)
+}
+
+type auditTemplateData struct {
+  Election Election
+  Entries  []AuditEntry
+}
+
+var auditTemplate = template.Must(template.New("audit").Parse(auditTemplateHTML))
+
+const auditTemplateHTML = `
+  <body>
+    Everything that has happened in {{.Election.Title}}, newest first:<br/>
+    <table border="1">
+      {{range .Entries}}
+        <tr>
+          <td>{{.Time}}</td>
+          <td>{{if .Actor}}{{.Actor}}{{else}}votastic{{end}}</td>
+          <td>{{.Action}}</td>
+        </tr>
+      {{end}}
+    </table>
+  </body>
+`
+
+func viewAudit(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  key, e, _, ok := getElectionFor(w, r, c, u, permObserve)
+  if !ok {
+    return
+  }
+  data := auditTemplateData{Election: *e}
+  _, err := datastore.NewQuery("AuditEntry").Ancestor(key).Order("-Time").GetAll(c, &data.Entries)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  auditTemplate.Execute(w, data)
+}
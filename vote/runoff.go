@@ -0,0 +1,129 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "fmt"
+  "time"
+)
+
+// An Election with Auto_runoff set gets a runoff when it closes with a tie in
+// the top tier of its first question.  The runoff is a new Election between
+// just those candidates, with the same voters and settings, which starts when
+// the original ends.
+
+// Returns the indices of the candidates in t that should go to a runoff, or
+// nil if t has a clear winner or nobody voted.
+func runoffCandidates(t *tally) []int {
+  if t.Num_votes == 0 || len(t.Ranks) == 0 || len(t.Ranks[0]) < 2 {
+    return nil
+  }
+  return t.Ranks[0]
+}
+
+// Returns the list of voters for a runoff of e, with their weights and names,
+// which is everyone that was eligible to vote in e.  Members of e's groups
+// are listed by their address, so that the runoff has the same voters even if
+// the groups have changed since.
+func runoffVoters(c appengine.Context, e *Election) ([]string, []int, []string, error) {
+  electorate, err := e.Electorate(c)
+  if err != nil {
+    return nil, nil, nil, err
+  }
+  var weights []int
+  var names []string
+  weighted := len(e.Weights) > 0 && len(e.Weights) == len(e.Emails)
+  named := len(e.Voter_names) > 0 && len(e.Voter_names) == len(e.Emails)
+  for i, email := range electorate {
+    if weighted {
+      weights = append(weights, e.VoterWeight(email))
+    }
+    if named {
+      name := ""
+      if i < len(e.Emails) {
+        name = e.Voter_names[i]
+      }
+      names = append(names, name)
+    }
+  }
+  return electorate, weights, names, nil
+}
+
+// Called once e, which has the given key, has closed.  If e needs a runoff
+// then one is made and e.Runoff_key is set, in which case e needs to be put
+// back into the datastore.  A result that isn't binding doesn't get a runoff.
+// Only the first question on the ballot can have a runoff, so the runoff
+// doesn't have any of e's other questions, which were settled by e.
+func makeRunoff(c appengine.Context, key *datastore.Key, e *Election) error {
+  if !e.Auto_runoff || e.Runoff_key != nil || e.Non_binding {
+    return nil
+  }
+  t, err := tallyElection(c, key, e, e.finalBoundary())
+  if err != nil {
+    return err
+  }
+  finalists := runoffCandidates(t)
+  if finalists == nil {
+    return nil
+  }
+  var cands []Candidate
+  for _, i := range finalists {
+    cand := t.Candidates[i]
+    cand.Index = len(cands)
+    cands = append(cands, cand)
+  }
+  emails, weights, names, err := runoffVoters(c, e)
+  if err != nil {
+    return err
+  }
+  duration := time.Duration(e.Runoff_duration)
+  if duration <= 0 {
+    duration = e.End.Sub(e.Start)
+  }
+  runoff := Election{
+    User_id:          e.User_id,
+    User_email:       e.User_email,
+    Org_key:          e.Org_key,
+    Title:            fmt.Sprintf("Runoff: %s", e.Title),
+    Text:             e.Text,
+    Start:            e.End,
+    End:              e.End.Add(duration),
+    Hide_results:     e.Hide_results,
+    Visibility:       e.Visibility,
+    Ballot_type:      e.Ballot_type,
+    Max_score:        e.Max_score,
+    Grades:           e.Grades,
+    Min_ballots:      e.Min_ballots,
+    Noise_epsilon:    e.Noise_epsilon,
+    Quorum_count:     e.Quorum_count,
+    Quorum_fraction:  e.Quorum_fraction,
+    Quorum_extension: e.Quorum_extension,
+    Max_extensions:   e.Max_extensions,
+    Secret_ballots:   e.Secret_ballots,
+    Allow_delegation: e.Allow_delegation,
+    Num_candidates:   len(cands),
+    Refresh_interval: e.Refresh_interval,
+    Emails:           emails,
+    Weights:          weights,
+    Voter_names:      names,
+    Runoff_of:        key,
+  }
+  runoff_key, err := putElection(c, &runoff, cands)
+  if err != nil {
+    return err
+  }
+  recordAudit(c, runoff_key, "", "Created the election as a runoff between %s", joinNames(cands))
+  err = copyRoles(c, key, runoff_key)
+  if err != nil {
+    return err
+  }
+  err = copyWebhooks(c, key, runoff_key)
+  if err != nil {
+    return err
+  }
+  fireWebhooks(c, runoff_key, &runoff, &webhookPayload{Event: eventCreated})
+  e.Runoff_key = runoff_key
+  recordAudit(c, key, "", "No clear winner, so a runoff between %s was scheduled", joinNames(cands))
+  fireWebhooks(c, key, e, &webhookPayload{Event: eventRunoff, Runoff: runoff_key.Encode()})
+  return nil
+}
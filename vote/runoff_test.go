@@ -0,0 +1,26 @@
+package vote
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestRunoffCandidates(t *testing.T) {
+  tests := []struct {
+    name      string
+    num_votes int
+    ranks     [][]int
+    want      []int
+  }{
+    {"clear winner", 3, [][]int{{0}, {1, 2}}, nil},
+    {"tie for first", 3, [][]int{{0, 2}, {1}}, []int{0, 2}},
+    {"nobody voted", 0, [][]int{{0, 1, 2}}, nil},
+    {"results withheld", 3, nil, nil},
+  }
+  for _, test := range tests {
+    tally := &tally{Election: &Election{}, Num_votes: test.num_votes, Ranks: test.ranks}
+    if got := runoffCandidates(tally); !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: runoffCandidates = %v, want %v", test.name, got, test.want)
+    }
+  }
+}
@@ -0,0 +1,312 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "encoding/json"
+  "hash/fnv"
+  "math/rand"
+  "sort"
+  "time"
+)
+
+// Once voting has closed, the results page says how close a Schulze result
+// was: how few ballots it would have taken to change who is in the top tier,
+// and how often each candidate comes out on top when the counted ballots are
+// resampled.
+
+// How many times the ballots are resampled.
+const bootstrapRounds = 500
+
+// What it would take for one candidate to change the top tier.
+type challengerMargin struct {
+  Candidate Candidate
+
+  // The fewest extra ballots, each of weight 1, that put Candidate first and
+  // everyone else tied below them, that change the top tier.
+  Additions int
+
+  // The number of counted ballots, taking the ones that rank Candidate
+  // lowest first, that would change the top tier if they were changed to put
+  // Candidate first.  0 if changing every ballot wouldn't be enough.
+  Changes int
+}
+
+// How often a candidate was alone in the top tier of the resampled ballots.
+type winFrequency struct {
+  Candidate Candidate
+  Wins      int
+  Percent   float64
+}
+
+// Challengers sorted by how few extra ballots they need, fewest first.
+type byAdditions []challengerMargin
+
+func (m byAdditions) Len() int           { return len(m) }
+func (m byAdditions) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byAdditions) Less(i, j int) bool {
+  if m[i].Additions != m[j].Additions {
+    return m[i].Additions < m[j].Additions
+  }
+  return m[i].Candidate.Index < m[j].Candidate.Index
+}
+
+// What changing one ballot to put a challenger first does to the pairwise
+// counts: the challenger moves ahead of the candidates in beaten, which the
+// ballot ranked higher, and in tied, which it ranked the same.
+type ballotChange struct {
+  weight int
+  beaten []int
+  tied   []int
+}
+
+// Changes sorted so that the ballots that rank the challenger lowest, and so
+// change the most when they are changed, come first.
+type byBeaten []ballotChange
+
+func (b byBeaten) Len() int           { return len(b) }
+func (b byBeaten) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byBeaten) Less(i, j int) bool { return len(b[i].beaten) > len(b[j].beaten) }
+
+type sensitivityReport struct {
+  // Every candidate that could change the top tier, closest first.
+  Challengers []challengerMargin
+
+  Rounds      int
+  Frequencies []winFrequency
+
+  // The number of rounds where the top tier was a tie.
+  Ties int
+}
+
+// Returns whether the top tier of the Schulze ranking of pairwise isn't top.
+func topChanged(pairwise [][]int, top []int) bool {
+  ranks := schulzeRanking(pairwise)
+  return len(ranks) == 0 || rankingKey(ranks[:1]) != rankingKey([][]int{top})
+}
+
+// Returns the smallest k in [1, high] for which changed(k) is true, given
+// that changed(high) is, and that changed stays true as k grows.
+func fewestToChange(high int, changed func(k int) bool) int {
+  low := 1
+  for low < high {
+    mid := (low + high) / 2
+    if changed(mid) {
+      high = mid
+    } else {
+      low = mid + 1
+    }
+  }
+  return high
+}
+
+func copyPairwise(pairwise [][]int) [][]int {
+  graph := make([][]int, len(pairwise))
+  for i := range graph {
+    graph[i] = append([]int(nil), pairwise[i]...)
+  }
+  return graph
+}
+
+// Works out how many ballots added for, or changed to, candidate c would
+// change the top tier.  The Schulze method is monotonic, so ranking c higher
+// on more ballots never hurts c, which is what makes a binary search work.
+func challengeMargin(e *Election, n int, ballots []Ballot, pairwise [][]int, top []int, c int) challengerMargin {
+  total := 0
+  for _, b := range ballots {
+    total += e.VoterWeight(b.Email)
+  }
+  // With more ballots than have been counted, c beats everyone head to head
+  // and so wins outright.
+  additions := fewestToChange(total+1, func(k int) bool {
+    graph := copyPairwise(pairwise)
+    for x := range graph {
+      if x != c {
+        graph[c][x] += k
+      }
+    }
+    return topChanged(graph, top)
+  })
+
+  // Every ballot that doesn't already have c alone in first place.
+  var changes []ballotChange
+  for i := range ballots {
+    ordering := impliedOrdering(e, n, &ballots[i])
+    if ordering == nil {
+      continue
+    }
+    ch := ballotChange{weight: e.VoterWeight(ballots[i].Email)}
+    for x, rank := range ordering {
+      switch {
+      case x == c:
+      case rank < ordering[c]:
+        ch.beaten = append(ch.beaten, x)
+      case rank == ordering[c]:
+        ch.tied = append(ch.tied, x)
+      }
+    }
+    if len(ch.beaten) == 0 && len(ch.tied) == 0 {
+      continue
+    }
+    changes = append(changes, ch)
+  }
+  sort.Sort(byBeaten(changes))
+  changed := func(k int) bool {
+    graph := copyPairwise(pairwise)
+    for _, ch := range changes[:k] {
+      for _, x := range ch.beaten {
+        graph[x][c] -= ch.weight
+        graph[c][x] += ch.weight
+      }
+      for _, x := range ch.tied {
+        graph[c][x] += ch.weight
+      }
+    }
+    return topChanged(graph, top)
+  }
+  margin := challengerMargin{Additions: additions}
+  if len(changes) > 0 && changed(len(changes)) {
+    margin.Changes = fewestToChange(len(changes), changed)
+  }
+  return margin
+}
+
+// Returns a source of randomness that only depends on the Election's key, so
+// that the resampled results don't change from one look to the next.
+func bootstrapRand(key *datastore.Key) *rand.Rand {
+  h := fnv.New64a()
+  h.Write([]byte(key.Encode()))
+  return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// Analyzes how close ranks, the Schulze ranking of q, is.  Returns nil if
+// there is nothing to analyze.
+func analyzeSensitivity(key *datastore.Key, q *countedQuestion, ranks [][]int) *sensitivityReport {
+  e := q.Election
+  n := len(q.Candidates)
+  if len(ranks) == 0 || len(q.Ballots) == 0 {
+    return nil
+  }
+  pairwise := impliedPairwise(e, n, q.Ballots)
+  top := ranks[0]
+  report := &sensitivityReport{Rounds: bootstrapRounds}
+  for c := 0; c < n; c++ {
+    // Ranking the only winner higher can't change anything.
+    if len(top) == 1 && top[0] == c {
+      continue
+    }
+    margin := challengeMargin(e, n, q.Ballots, pairwise, top, c)
+    margin.Candidate = q.Candidates[c]
+    report.Challengers = append(report.Challengers, margin)
+  }
+  sort.Sort(byAdditions(report.Challengers))
+
+  // The pairwise counts of each ballot are worked out once, and each round
+  // adds up a sample of them, drawn with replacement.
+  var contributions [][][2]int
+  var weights []int
+  for i := range q.Ballots {
+    ordering := impliedOrdering(e, n, &q.Ballots[i])
+    if ordering == nil {
+      continue
+    }
+    var pairs [][2]int
+    for a := range ordering {
+      for b := range ordering {
+        if ordering[a] < ordering[b] {
+          pairs = append(pairs, [2]int{a, b})
+        }
+      }
+    }
+    contributions = append(contributions, pairs)
+    weights = append(weights, e.VoterWeight(q.Ballots[i].Email))
+  }
+  if len(contributions) == 0 {
+    return report
+  }
+  wins := make([]int, n)
+  rng := bootstrapRand(key)
+  for round := 0; round < bootstrapRounds; round++ {
+    graph := make([][]int, n)
+    for i := range graph {
+      graph[i] = make([]int, n)
+    }
+    for k := 0; k < len(contributions); k++ {
+      i := rng.Intn(len(contributions))
+      for _, pair := range contributions[i] {
+        graph[pair[0]][pair[1]] += weights[i]
+      }
+    }
+    sample := schulzeRanking(graph)
+    if len(sample) > 0 && len(sample[0]) == 1 {
+      wins[sample[0][0]]++
+    } else {
+      report.Ties++
+    }
+  }
+  for _, c := range rankByTotals(allCandidates(n), wins) {
+    for _, i := range c {
+      report.Frequencies = append(report.Frequencies, winFrequency{
+        Candidate: q.Candidates[i],
+        Wins:      wins[i],
+        Percent:   100 * float64(wins[i]) / bootstrapRounds,
+      })
+    }
+  }
+  return report
+}
+
+// The parent of a SensitivityCache is the Election it was worked out for, and
+// its ID is one more than the position of the question on the ballot.  The
+// analysis takes a while and can't change once every ballot has been counted,
+// so it is only done once.
+type SensitivityCache struct {
+  // The number of ballots that were counted, in case the results change
+  // anyway, for instance because a voter was removed from the election.
+  Num_votes int
+
+  // A sensitivityReport as JSON, or empty if there was nothing to analyze.
+  Report []byte
+}
+
+// Returns the sensitivityReport of question q of e, which has the given key,
+// working it out with analyze unless it has been worked out already.  Until
+// every ballot is viewable, as of e.finalBoundary, the results can still
+// change, so nothing is stored before then.
+func cachedSensitivity(c appengine.Context, key *datastore.Key, e *Election, q int, num_votes int, now time.Time, analyze func() (*sensitivityReport, error)) (*sensitivityReport, error) {
+  if now.Before(e.finalBoundary()) {
+    return analyze()
+  }
+  cache_key := datastore.NewKey(c, "SensitivityCache", "", int64(q+1), key)
+  var cache SensitivityCache
+  err := datastore.Get(c, cache_key, &cache)
+  if err == nil && cache.Num_votes == num_votes {
+    if len(cache.Report) == 0 {
+      return nil, nil
+    }
+    var report sensitivityReport
+    err = json.Unmarshal(cache.Report, &report)
+    if err == nil {
+      return &report, nil
+    }
+  }
+  if err != nil && err != datastore.ErrNoSuchEntity {
+    c.Errorf("Unable to load the sensitivity analysis of %s: %v", e.Key_str, err)
+  }
+  report, err := analyze()
+  if err != nil {
+    return nil, err
+  }
+  cache = SensitivityCache{Num_votes: num_votes}
+  if report != nil {
+    cache.Report, err = json.Marshal(report)
+    if err != nil {
+      return nil, err
+    }
+  }
+  _, err = datastore.Put(c, cache_key, &cache)
+  if err != nil {
+    c.Errorf("Unable to store the sensitivity analysis of %s: %v", e.Key_str, err)
+  }
+  return report, nil
+}
@@ -0,0 +1,115 @@
+package vote
+
+import (
+  "appengine/datastore"
+  "reflect"
+  "testing"
+)
+
+func TestFewestToChange(t *testing.T) {
+  for high := 1; high <= 20; high++ {
+    for want := 1; want <= high; want++ {
+      calls := 0
+      got := fewestToChange(high, func(k int) bool {
+        calls++
+        return k >= want
+      })
+      if got != want {
+        t.Errorf("fewestToChange(%d) with the change at %d = %d", high, want, got)
+      }
+      if calls > 5 {
+        t.Errorf("fewestToChange(%d) tried %d times", high, calls)
+      }
+    }
+  }
+}
+
+func TestChallengeMargin(t *testing.T) {
+  var close_race []Ballot
+  close_race = append(close_race, rankedBallots(6, "", 0, 1, 2)...)
+  close_race = append(close_race, rankedBallots(4, "", 1, 0, 2)...)
+
+  weighted := &Election{Emails: []string{"heavy@x", "light@x"}, Weights: []int{3, 1}}
+  var heavy []Ballot
+  heavy = append(heavy, rankedBallots(1, "heavy@x", 0, 1)...)
+  heavy = append(heavy, rankedBallots(2, "light@x", 1, 0)...)
+
+  tests := []struct {
+    name       string
+    e          *Election
+    n          int
+    ballots    []Ballot
+    challenger int
+
+    additions, changes int
+  }{
+    {"runner up", &Election{}, 3, close_race, 1, 2, 1},
+    {"last place", &Election{}, 3, close_race, 2, 10, 5},
+    {"weighted voter", weighted, 2, heavy, 1, 1, 1},
+  }
+  for _, test := range tests {
+    pairwise := impliedPairwise(test.e, test.n, test.ballots)
+    top := schulzeRanking(pairwise)[0]
+    margin := challengeMargin(test.e, test.n, test.ballots, pairwise, top, test.challenger)
+    if margin.Additions != test.additions || margin.Changes != test.changes {
+      t.Errorf("%s: %d additions and %d changes, want %d and %d", test.name, margin.Additions, margin.Changes, test.additions, test.changes)
+    }
+  }
+}
+
+func TestAnalyzeSensitivity(t *testing.T) {
+  cands := []Candidate{{Name: "A", Index: 0}, {Name: "B", Index: 1}, {Name: "C", Index: 2}}
+  question := func(ballots []Ballot) *countedQuestion {
+    return &countedQuestion{
+      electionQuestion: electionQuestion{Election: &Election{}, Candidates: cands},
+      Ballots:          ballots,
+    }
+  }
+  var landslide, close_race []Ballot
+  landslide = append(landslide, rankedBallots(20, "", 0, 1, 2)...)
+  close_race = append(close_race, rankedBallots(6, "", 0, 1, 2)...)
+  close_race = append(close_race, rankedBallots(5, "", 1, 0, 2)...)
+  tests := []struct {
+    name    string
+    ballots []Ballot
+    ranks   [][]int
+
+    challengers []string
+    sure        bool
+  }{
+    {"nobody voted", nil, [][]int{{0, 1, 2}}, nil, false},
+    {"results withheld", landslide, nil, nil, false},
+    {"landslide", landslide, [][]int{{0}, {1}, {2}}, []string{"B", "C"}, true},
+    {"close race", close_race, [][]int{{0}, {1}, {2}}, []string{"B", "C"}, false},
+  }
+  for _, test := range tests {
+    report := analyzeSensitivity(&datastore.Key{}, question(test.ballots), test.ranks)
+    if test.challengers == nil {
+      if report != nil {
+        t.Errorf("%s: analyzeSensitivity = %+v, want nil", test.name, report)
+      }
+      continue
+    }
+    var challengers []string
+    for _, margin := range report.Challengers {
+      challengers = append(challengers, margin.Candidate.Name)
+    }
+    if !reflect.DeepEqual(challengers, test.challengers) {
+      t.Errorf("%s: challengers %v, want %v", test.name, challengers, test.challengers)
+    }
+    rounds := report.Ties
+    for _, f := range report.Frequencies {
+      rounds += f.Wins
+    }
+    if rounds != report.Rounds {
+      t.Errorf("%s: %d wins and ties in %d rounds", test.name, rounds, report.Rounds)
+    }
+    if sure := report.Frequencies[0].Wins == report.Rounds; sure != test.sure {
+      t.Errorf("%s: %s won %d of %d rounds", test.name, report.Frequencies[0].Candidate.Name, report.Frequencies[0].Wins, report.Rounds)
+    }
+    again := analyzeSensitivity(&datastore.Key{}, question(test.ballots), test.ranks)
+    if !reflect.DeepEqual(report, again) {
+      t.Errorf("%s: analyzed as %+v and then %+v", test.name, report, again)
+    }
+  }
+}
@@ -14,6 +14,7 @@ func init() {
 
 type statusTemplateData struct {
   Created []Election
+  Helping []Election
   Voted   []Election
 }
 
@@ -29,6 +30,17 @@ const statusTemplateHTML = `
       {{end}}
     </table>
     <br/>
+    {{if .Helping}}
+    Elections you are an organizer or observer of:<br/>
+    <table>
+      {{range .Helping}}
+        <tr>
+          <td><a href="/status?key={{.Key_str}}">{{.Title}}</a></td>
+        </tr>
+      {{end}}
+    </table>
+    <br/>
+    {{end}}
     Elections you have voted in:<br/>
     <table>
       {{range $index,$election := .Voted}}
@@ -45,9 +57,30 @@ const statusTemplateHTML = `
   </body>
 `
 
+type voterWeight struct {
+  Email  string
+  Weight int
+}
+
 type electionStatusTemplateData struct {
   Election  Election
   Num_votes int
+
+  // The roles of the user looking at the status, which decide which links
+  // they're shown.
+  Access     access
+  Can_manage bool
+
+  // Only filled in for elections where voters have different weights.
+  Weighted     bool
+  Weight_cast  int
+  Total_weight int
+  Percent_cast int
+  Voters       []voterWeight
+
+  // Everyone who is eligible because they're in one of the election's
+  // groups, either as of right now or as of when the election opened.
+  Group_emails []string
 }
 
 var electionStatusTemplate = template.Must(template.New("election_status").Parse(electionStatusTemplateHTML))
@@ -57,11 +90,56 @@ const electionStatusTemplateHTML = `
   Created: {{.Election.Start}}<br/>
   End: {{.Election.End}}<br/>
   Refresh: {{.Election.Refresh_interval}}<br/>
+  Ballot: {{if .Election.Ballot_type}}{{.Election.Ballot_type}}{{else}}ranked{{end}}{{if .Election.Max_score}}, scores from 0 to {{.Election.Max_score}}{{end}}{{if .Election.Grades}}, graded {{range $i, $g := .Election.Grades}}{{if $i}}, {{end}}{{$g}}{{end}}{{end}}<br/>
+  {{if .Election.Num_questions}}Questions after the first: {{.Election.Num_questions}}<br/>{{end}}
+  Visibility: {{if .Election.Visibility}}{{.Election.Visibility}}{{else}}public{{end}}<br/>
+  {{if .Election.Min_ballots}}Results hidden until {{.Election.Min_ballots}} ballots are cast<br/>{{end}}
+  {{if .Election.Quorum_count}}Quorum: {{.Election.Quorum_count}} voters<br/>{{end}}
+  {{if .Election.Quorum_fraction}}Quorum: {{.Election.Quorum_fraction}} of the eligible voters<br/>{{end}}
+  {{if .Election.Extensions}}Extended {{.Election.Extensions}} times for lack of a quorum<br/>{{end}}
+  {{if .Election.Non_binding}}The result is not binding<br/>{{end}}
+  {{if .Election.Auto_runoff}}A runoff is made if there is no clear winner<br/>{{end}}
+  {{if .Election.Runoff_key}}<a href="/status?key={{.Election.Runoff_key.Encode}}">Runoff</a><br/>{{end}}
+  {{if .Election.Runoff_of}}Runoff of <a href="/status?key={{.Election.Runoff_of.Encode}}">an earlier election</a><br/>{{end}}
+  {{if .Election.Noise_epsilon}}Noise added to live results with privacy budget {{.Election.Noise_epsilon}}<br/>{{end}}
   Total votes: {{.Num_votes}}<br/>
+  {{if .Weighted}}
+  Weighted turnout: {{.Weight_cast}} of {{.Total_weight}} ({{.Percent_cast}}%)<br/>
+  Emails:<br/>
+  {{range .Voters}}
+  {{.Email}} (weight {{.Weight}})<br/>
+  {{end}}
+  {{else}}
   Emails:<br/>
   {{range $index,$email := .Election.Emails}}
   {{$email}}<br/>
   {{end}}
+  {{end}}
+  {{if .Election.Groups}}
+  {{if .Election.Snapshot_time.IsZero}}
+  Members of the election's voter groups, as of now:<br/>
+  {{else}}
+  Members of the election's voter groups when it opened at {{.Election.Snapshot_time}}:<br/>
+  {{end}}
+  {{range .Group_emails}}
+  {{.}}<br/>
+  {{end}}
+  {{end}}
+  <br/>
+  <a href="/audit?key={{.Election.Key_str}}">Audit log</a><br/>
+  {{if .Access.Owner}}
+  <a href="/roles?key={{.Election.Key_str}}">Roles</a><br/>
+  {{end}}
+  {{if .Can_manage}}
+  <a href="/clone_election?key={{.Election.Key_str}}">Clone this election</a><br/>
+  <a href="/webhooks?key={{.Election.Key_str}}">Webhooks</a><br/>
+  <a href="/add_question?key={{.Election.Key_str}}">Add a question to the ballot</a> (before voting begins)<br/>
+  <form action="/save_template" method="post">
+    <input type="hidden" name="key" value="{{.Election.Key_str}}"/>
+    Save as a template named <input type="text" name="name" value="{{.Election.Title}}"/>
+    <input type="submit" value="Save"/>
+  </form>
+  {{end}}
   </body>
 `
 
@@ -94,10 +172,39 @@ func viewOverallStatus(w http.ResponseWriter, r *http.Request, c appengine.Conte
     data.Created = append(data.Created, e)
   }
 
+  var roles []Role
+  var role_keys []*datastore.Key
+  for _, email := range roleEmails(u.Email) {
+    keys, err := datastore.NewQuery("Role").Filter("Email =", email).GetAll(c, &roles)
+    if err != nil {
+      break
+    }
+    role_keys = append(role_keys, keys...)
+  }
+  if len(role_keys) > 0 {
+    seen := make(map[string]bool)
+    for _, role_key := range role_keys {
+      parent := role_key.Parent()
+      if seen[parent.Encode()] {
+        continue
+      }
+      seen[parent.Encode()] = true
+      var helping Election
+      if datastore.Get(c, parent, &helping) == nil {
+        data.Helping = append(data.Helping, helping)
+      }
+    }
+  }
+
   query = datastore.NewQuery("Ballot").Filter("User_id =", u.ID).Order("Time")
   it = query.Run(c)
   var b Ballot
   for _, err := it.Next(&b); err == nil; _, err = it.Next(&b) {
+    // Every question is answered at once, so one Ballot per submission is
+    // enough.
+    if b.Question != 0 {
+      continue
+    }
     datastore.Get(c, b.Election_key, &e)
     data.Voted = append(data.Voted, e)
   }
@@ -105,17 +212,14 @@ func viewOverallStatus(w http.ResponseWriter, r *http.Request, c appengine.Conte
   statusTemplate.Execute(w, data)
 }
 
-func viewElectionStatus(w http.ResponseWriter, r *http.Request, c appengine.Context, u *user.User, key *datastore.Key) {
-  var e Election
-  err := datastore.Get(c, key, &e)
-  if err != nil {
-    viewOverallStatus(w, r, c, u)
-    return
-  }
-
+// Returns the number of different users that have cast a Ballot in the
+// Election with the given key, and the total weight of their votes in e.  If
+// e is nil then the weight isn't counted.
+func turnout(c appengine.Context, key *datastore.Key, e *Election) (int, int) {
   query := datastore.NewQuery("Ballot")
   query = query.Ancestor(key).Order("User_id")
   count := 0
+  weight := 0
   var b Ballot
   it := query.Run(c)
   var prev_user_id string
@@ -123,18 +227,57 @@ func viewElectionStatus(w http.ResponseWriter, r *http.Request, c appengine.Cont
     if b.User_id != prev_user_id {
       prev_user_id = b.User_id
       count++
+      if e != nil {
+        weight += e.VoterWeight(b.Email)
+      }
     }
   }
+  return count, weight
+}
+
+func viewElectionStatus(w http.ResponseWriter, r *http.Request, c appengine.Context, u *user.User, key *datastore.Key) {
+  var e Election
+  err := datastore.Get(c, key, &e)
+  if err != nil {
+    viewOverallStatus(w, r, c, u)
+    return
+  }
+  a, ok := checkElectionAccess(w, c, key, &e, u, permObserve)
+  if !ok {
+    return
+  }
+
+  count, weight := turnout(c, key, &e)
 
   data := electionStatusTemplateData{
-    Election:  e,
-    Num_votes: count,
+    Election:   e,
+    Num_votes:  count,
+    Access:     a,
+    Can_manage: a.can(permManage),
+  }
+  data.Group_emails = e.Group_emails
+  if e.Snapshot_time.IsZero() && len(e.Groups) > 0 {
+    data.Group_emails, err = groupMembers(c, e.Groups)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+  }
+  if len(e.Weights) > 0 && len(e.Weights) == len(e.Emails) {
+    electorate, err := e.Electorate(c)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    data.Weighted = true
+    data.Weight_cast = weight
+    data.Total_weight = e.TotalWeight(electorate)
+    if data.Total_weight > 0 {
+      data.Percent_cast = 100 * weight / data.Total_weight
+    }
+    for i := range e.Emails {
+      data.Voters = append(data.Voters, voterWeight{e.Emails[i], e.Weights[i]})
+    }
   }
   electionStatusTemplate.Execute(w, data)
 }
-
-
-
-
-
-
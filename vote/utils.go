@@ -13,3 +13,14 @@ func htmlWrapBegin(w http.ResponseWriter) {
 func htmlWrapEnd(w http.ResponseWriter) {
   fmt.Fprintf(w, "</html>")
 }
+
+// Writes out an error and returns false unless r was a POST.  Anything that
+// changes or deletes data has to be submitted from a form, so that a link on
+// some other site can't do it on a user's behalf.
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+  if r.Method != "POST" {
+    http.Error(w, "This can only be done by submitting a form.", http.StatusInternalServerError)
+    return false
+  }
+  return true
+}
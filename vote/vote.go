@@ -15,9 +15,19 @@ func init() {
   http.HandleFunc("/show", show)
 }
 
+type orgElections struct {
+  Org       Organization
+  Elections []Election
+}
+
 type allElectionsData struct {
+  // Public elections that don't belong to any organization.
   Elections []Election
-  Now       time.Time
+
+  // The elections of each organization the user is a member of.
+  Orgs []orgElections
+
+  Now time.Time
 }
 
 var availableElectionTemplate = template.Must(template.New("available_elections").Parse(availableElectionTemplateHTML))
@@ -25,6 +35,21 @@ var availableElectionTemplate = template.Must(template.New("available_elections"
 const availableElectionTemplateHTML = `
   <html><body>
   <a href="/election">Create a new Election</a>
+  <a href="/recurrences">Recurring elections</a>
+  <a href="/groups">Voter groups</a>
+  <a href="/orgs">Organizations</a>
+  {{range .Orgs}}
+  <br/><a href="/org?key={{.Org.Key_str}}">{{.Org.Name}}</a>:
+  <table>
+    {{range .Elections}}
+      <tr>
+        <td>{{.Title}}</td>
+        <td><a href="/ballot?key={{.Key_str}}">vote</a></td>
+        <td><a href="/view_results?key={{.Key_str}}">results</a></td>
+      </tr>
+    {{end}}
+  </table>
+  {{end}}
   <table>
     {{range .Elections}}
       <tr>
@@ -40,6 +65,8 @@ const availableElectionTemplateHTML = `
   </body></html>
 `
 
+// Lists the public elections that don't belong to any organization, and if the
+// user is logged in, the elections of each of their organizations.
 func root(w http.ResponseWriter, r *http.Request) {
   c := appengine.NewContext(r)
   q := datastore.NewQuery("Election")
@@ -50,7 +77,29 @@ func root(w http.ResponseWriter, r *http.Request) {
     http.Error(w, err.Error(), http.StatusInternalServerError)
     return
   }
-  err := availableElectionTemplate.Execute(w, allElectionsData{elections, time.Now()})
+  data := allElectionsData{Now: time.Now()}
+  for _, e := range elections {
+    if e.Org_key == nil && (e.Visibility == "" || e.Visibility == visibilityPublic) {
+      data.Elections = append(data.Elections, e)
+    }
+  }
+  if u := user.Current(c); u != nil {
+    orgs, keys, err := userOrgs(c, u)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    for i := range orgs {
+      oe := orgElections{Org: orgs[i]}
+      _, err := datastore.NewQuery("Election").Filter("Org_key =", keys[i]).Order("-Start").GetAll(c, &oe.Elections)
+      if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+      }
+      data.Orgs = append(data.Orgs, oe)
+    }
+  }
+  err := availableElectionTemplate.Execute(w, data)
   if err != nil {
     fmt.Fprintf(w, "Error: %s<br>", err.Error())
     return
@@ -59,8 +108,14 @@ func root(w http.ResponseWriter, r *http.Request) {
   }
 }
 
+// Dumps every election, for debugging.  Since that includes the elections of
+// every organization it is only for administrators of the app.
 func show(w http.ResponseWriter, r *http.Request) {
   c := appengine.NewContext(r)
+  if !user.IsAdmin(c) {
+    http.Error(w, "Only administrators can see this.", http.StatusInternalServerError)
+    return
+  }
   query := datastore.NewQuery("Election")
   it := query.Run(c)
   fmt.Fprintf(w, "<html>")
@@ -0,0 +1,552 @@
+package vote
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "appengine/taskqueue"
+  "appengine/urlfetch"
+  "bytes"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "html/template"
+  "net"
+  "net/http"
+  "net/url"
+  "strings"
+  "time"
+)
+
+func init() {
+  http.HandleFunc("/webhooks", viewWebhooks)
+  http.HandleFunc("/add_webhook", addWebhook)
+  http.HandleFunc("/delete_webhook", deleteWebhook)
+  http.HandleFunc("/tasks/webhook", deliverWebhook)
+}
+
+// The events that a Webhook can be told about.
+const (
+  eventCreated          = "created"
+  eventOpened           = "opened"
+  eventBallotCast       = "ballot_cast"
+  eventResultsRefreshed = "results_refreshed"
+  eventExtended         = "extended"
+  eventClosed           = "closed"
+  eventRunoff           = "runoff"
+)
+
+var webhookEvents = []string{eventCreated, eventOpened, eventBallotCast, eventResultsRefreshed, eventExtended, eventClosed, eventRunoff}
+
+// The parent of a Webhook is the Election whose events it is sent.
+type Webhook struct {
+  // key.Encode() for the key representing this Webhook.
+  Key_str string
+
+  URL string
+
+  // Every payload is signed with an HMAC-SHA256 using this as the key, so
+  // that the receiver can tell that it came from us.
+  Secret string
+
+  // Which of the webhookEvents this Webhook is sent.
+  Events []string
+
+  Created time.Time
+}
+
+func (wh *Webhook) wants(event string) bool {
+  for _, e := range wh.Events {
+    if e == event {
+      return true
+    }
+  }
+  return false
+}
+
+// The parent of a WebhookDelivery is the Webhook it is being sent to.  One is
+// made for every event, and it is updated with every attempt to deliver it.
+type WebhookDelivery struct {
+  Event   string
+  Payload []byte
+  Created time.Time
+
+  Attempts     int
+  Last_attempt time.Time
+
+  // HTTP status code of the last attempt, or 0 if we couldn't get one, in
+  // which case Error says why.
+  Status int
+  Error  string
+
+  Delivered bool
+}
+
+// This is what gets POSTed, as JSON, to a Webhook.  Nothing about what any
+// individual voter did is ever included.
+type webhookPayload struct {
+  Event    string    `json:"event"`
+  Election string    `json:"election"`
+  Title    string    `json:"title"`
+  Time     time.Time `json:"time"`
+
+  // Number of voters that were counted, roughly, for results_refreshed,
+  // extended and closed events.  ballot_cast events leave it out, since it would say when each
+  // voter voted.
+  Voters int `json:"voters,omitempty"`
+
+  // Names of the candidates in each tier of the results, best first.  This is
+  // left out while the results of the election are hidden.
+  Ranks [][]string `json:"ranks,omitempty"`
+
+  // Set on closed events if the election didn't reach its quorum.
+  Non_binding bool `json:"non_binding,omitempty"`
+
+  // The key of the runoff election, for runoff events.
+  Runoff string `json:"runoff,omitempty"`
+}
+
+func newSecret() (string, error) {
+  b := make([]byte, 16)
+  _, err := rand.Read(b)
+  if err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(b), nil
+}
+
+func putWebhook(c appengine.Context, election_key *datastore.Key, wh *Webhook) error {
+  key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Webhook", election_key), wh)
+  if err != nil {
+    return err
+  }
+  wh.Key_str = key.Encode()
+  _, err = datastore.Put(c, key, wh)
+  return err
+}
+
+// Webhooks can't be sent to addresses in these ranges: loopback, private
+// networks, link-local (which is where metadata servers live) and their IPv6
+// equivalents.
+var internalNetworks = []string{
+  "0.0.0.0/8",
+  "10.0.0.0/8",
+  "100.64.0.0/10",
+  "127.0.0.0/8",
+  "169.254.0.0/16",
+  "172.16.0.0/12",
+  "192.168.0.0/16",
+  "::1/128",
+  "::/128",
+  "fc00::/7",
+  "fe80::/10",
+}
+
+// Host names that only mean something from inside the network we run on.
+var internalHosts = []string{"localhost", "metadata", "metadata.google.internal"}
+
+// Returns whether host, the host part of a URL, names somewhere that
+// shouldn't be reachable from outside.  Names are only checked against
+// internalHosts, since we can't resolve them here.
+func isInternalHost(host string) bool {
+  if h, _, err := net.SplitHostPort(host); err == nil {
+    host = h
+  }
+  host = strings.TrimRight(strings.ToLower(strings.Trim(host, "[]")), ".")
+  if host == "" {
+    return true
+  }
+  for _, name := range internalHosts {
+    if host == name || strings.HasSuffix(host, "."+name) {
+      return true
+    }
+  }
+  ip := net.ParseIP(host)
+  if ip == nil {
+    return false
+  }
+  for _, cidr := range internalNetworks {
+    _, network, err := net.ParseCIDR(cidr)
+    if err == nil && network.Contains(ip) {
+      return true
+    }
+  }
+  return false
+}
+
+// Checks that s is a URL that we can POST to.
+func parseWebhookURL(s string) (string, error) {
+  u, err := url.Parse(s)
+  if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+    return "", &electionError{fmt.Sprintf("Expected an http or https URL, got '%s'.", s)}
+  }
+  if isInternalHost(u.Host) {
+    return "", &electionError{fmt.Sprintf("Webhooks can't be sent to '%s'.", u.Host)}
+  }
+  return u.String(), nil
+}
+
+// Checks that every one of events is one of the webhookEvents, and that
+// there is at least one.
+func parseWebhookEvents(events []string) ([]string, error) {
+  if len(events) == 0 {
+    return nil, &electionError{"Pick at least one event to send to the webhook."}
+  }
+  for _, event := range events {
+    known := false
+    for _, e := range webhookEvents {
+      if event == e {
+        known = true
+      }
+    }
+    if !known {
+      return nil, &electionError{fmt.Sprintf("There is no event called '%s'.", event)}
+    }
+  }
+  return events, nil
+}
+
+// Registers a Webhook on the Election with the given key that is sent every
+// event.
+func registerWebhook(c appengine.Context, election_key *datastore.Key, hook_url string) error {
+  hook_url, err := parseWebhookURL(hook_url)
+  if err != nil {
+    return err
+  }
+  secret, err := newSecret()
+  if err != nil {
+    return err
+  }
+  wh := Webhook{
+    URL:     hook_url,
+    Secret:  secret,
+    Events:  webhookEvents,
+    Created: time.Now(),
+  }
+  return putWebhook(c, election_key, &wh)
+}
+
+// Gives the Election with key to all of the Webhooks registered on the
+// Election with key from, with the same secrets.
+func copyWebhooks(c appengine.Context, from, to *datastore.Key) error {
+  var hooks []Webhook
+  _, err := datastore.NewQuery("Webhook").Ancestor(from).GetAll(c, &hooks)
+  if err != nil {
+    return err
+  }
+  for i := range hooks {
+    hooks[i].Created = time.Now()
+    err := putWebhook(c, to, &hooks[i])
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Returns the names of the candidates in each tier of t.
+func rankNames(t *tally) [][]string {
+  var names [][]string
+  for _, tier := range t.Ranks {
+    var tier_names []string
+    for _, i := range tier {
+      tier_names = append(tier_names, t.Candidates[i].Name)
+    }
+    names = append(names, tier_names)
+  }
+  return names
+}
+
+// Builds the payload for an event that reports results, leaving out the
+// results themselves if they're still hidden.
+func resultsPayload(c appengine.Context, key *datastore.Key, e *Election, event string, now time.Time) (*webhookPayload, error) {
+  t, err := tallyElection(c, key, e, now)
+  if err != nil {
+    return nil, err
+  }
+  payload := &webhookPayload{Event: event, Voters: blurNumber(t.Num_votes)}
+  if !e.Hide_results || !now.Before(e.End) {
+    payload.Ranks = rankNames(t)
+  }
+  return payload, nil
+}
+
+// Queues up payload to be sent to every Webhook on the Election with the
+// given key that wants to hear about it.  Failures are logged, since nothing
+// that fires an event should fail just because a webhook couldn't be told.
+func fireWebhooks(c appengine.Context, key *datastore.Key, e *Election, payload *webhookPayload) {
+  var hooks []Webhook
+  hook_keys, err := datastore.NewQuery("Webhook").Ancestor(key).GetAll(c, &hooks)
+  if err != nil {
+    c.Errorf("Unable to find webhooks for %s: %v", e.Key_str, err)
+    return
+  }
+  if len(hooks) == 0 {
+    return
+  }
+  payload.Election = e.Key_str
+  payload.Title = e.Title
+  payload.Time = time.Now()
+  data, err := json.Marshal(payload)
+  if err != nil {
+    c.Errorf("Unable to encode webhook payload: %v", err)
+    return
+  }
+  for i := range hooks {
+    if !hooks[i].wants(payload.Event) {
+      continue
+    }
+    d := WebhookDelivery{
+      Event:   payload.Event,
+      Payload: data,
+      Created: payload.Time,
+    }
+    d_key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "WebhookDelivery", hook_keys[i]), &d)
+    if err != nil {
+      c.Errorf("Unable to store webhook delivery: %v", err)
+      continue
+    }
+    task := taskqueue.NewPOSTTask("/tasks/webhook", url.Values{"key": {d_key.Encode()}})
+    _, err = taskqueue.Add(c, task, "webhooks")
+    if err != nil {
+      c.Errorf("Unable to queue webhook delivery: %v", err)
+    }
+  }
+}
+
+func signPayload(secret string, payload []byte) string {
+  mac := hmac.New(sha256.New, []byte(secret))
+  mac.Write(payload)
+  return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Run from the webhooks task queue, makes one attempt at sending a
+// WebhookDelivery.  If it fails we return an error status so that the task
+// queue will try again later, backing off as configured in queue.yaml.
+func deliverWebhook(w http.ResponseWriter, r *http.Request) {
+  c := appengine.NewContext(r)
+  key, err := datastore.DecodeKey(r.FormValue("key"))
+  if err != nil {
+    // Retrying won't make the key any better.
+    c.Errorf("Bad webhook delivery key: %v", err)
+    return
+  }
+  var d WebhookDelivery
+  err = datastore.Get(c, key, &d)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  if d.Delivered {
+    return
+  }
+  var wh Webhook
+  err = datastore.Get(c, key.Parent(), &wh)
+  if err == datastore.ErrNoSuchEntity {
+    // The webhook was deleted since this was queued.
+    return
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  d.Attempts++
+  d.Last_attempt = time.Now()
+  d.Status = 0
+  d.Error = ""
+  req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(d.Payload))
+  if err == nil {
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Votastic-Event", d.Event)
+    req.Header.Set("X-Votastic-Signature", signPayload(wh.Secret, d.Payload))
+    var resp *http.Response
+    resp, err = urlfetch.Client(c).Do(req)
+    if err == nil {
+      resp.Body.Close()
+      d.Status = resp.StatusCode
+      d.Delivered = resp.StatusCode >= 200 && resp.StatusCode < 300
+    }
+  }
+  if err != nil {
+    d.Error = err.Error()
+  }
+  _, err = datastore.Put(c, key, &d)
+  if err != nil {
+    c.Errorf("Unable to update webhook delivery: %v", err)
+  }
+  if !d.Delivered {
+    http.Error(w, fmt.Sprintf("Delivery failed with status %d: %s", d.Status, d.Error), http.StatusInternalServerError)
+  }
+}
+
+type webhookWithDeliveries struct {
+  Webhook
+  Deliveries []WebhookDelivery
+}
+
+type webhooksTemplateData struct {
+  Election Election
+  Webhooks []webhookWithDeliveries
+  Events   []string
+}
+
+var webhooksTemplate = template.Must(template.New("webhooks").Parse(webhooksTemplateHTML))
+
+const webhooksTemplateHTML = `
+  <body>
+    Webhooks for {{.Election.Title}}:<br/>
+    {{range .Webhooks}}
+      <br/>
+      <form action="/delete_webhook" method="post">
+        {{.URL}}
+        <input type="hidden" name="key" value="{{.Key_str}}"/>
+        <input type="submit" value="Delete"/>
+      </form>
+      Events: {{range .Events}}{{.}} {{end}}<br/>
+      Secret: {{.Secret}}<br/>
+      <table border="1">
+        <tr><td>Event</td><td>Queued</td><td>Attempts</td><td>Last attempt</td><td>Status</td><td>Error</td></tr>
+        {{range .Deliveries}}
+          <tr>
+            <td>{{.Event}}</td>
+            <td>{{.Created}}</td>
+            <td>{{.Attempts}}</td>
+            <td>{{.Last_attempt}}</td>
+            <td>{{if .Delivered}}delivered{{else}}{{.Status}}{{end}}</td>
+            <td>{{.Error}}</td>
+          </tr>
+        {{end}}
+      </table>
+    {{end}}
+    <br/>
+    <form action="/add_webhook" method="post">
+      <input type="hidden" name="key" value="{{.Election.Key_str}}"/>
+      Add a webhook: <input type="text" name="url" size="60"/><br/>
+      {{range .Events}}
+        <input type="checkbox" name="event" value="{{.}}" checked/>{{.}}
+      {{end}}
+      <br/>
+      <input type="submit" value="Add"/>
+    </form>
+  </body>
+`
+
+// Shows the organizer of an election its webhooks and the most recent
+// attempts to deliver to each of them.
+func viewWebhooks(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  key, e, _, ok := getElectionFor(w, r, c, u, permManage)
+  if !ok {
+    return
+  }
+  var hooks []Webhook
+  hook_keys, err := datastore.NewQuery("Webhook").Ancestor(key).Order("Created").GetAll(c, &hooks)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  data := webhooksTemplateData{Election: *e, Events: webhookEvents}
+  for i := range hooks {
+    hd := webhookWithDeliveries{Webhook: hooks[i]}
+    query := datastore.NewQuery("WebhookDelivery").Ancestor(hook_keys[i]).Order("-Created").Limit(20)
+    _, err := query.GetAll(c, &hd.Deliveries)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    data.Webhooks = append(data.Webhooks, hd)
+  }
+  webhooksTemplate.Execute(w, data)
+}
+
+func addWebhook(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  key, e, _, ok := getElectionFor(w, r, c, u, permManage)
+  if !ok {
+    return
+  }
+  hook_url, err := parseWebhookURL(r.FormValue("url"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  events, err := parseWebhookEvents(r.Form["event"])
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  secret, err := newSecret()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  wh := Webhook{
+    URL:     hook_url,
+    Secret:  secret,
+    Events:  events,
+    Created: time.Now(),
+  }
+  err = putWebhook(c, key, &wh)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  recordAudit(c, key, u.Email, "Added a webhook for %s", hook_url)
+  fmt.Fprintf(w, `Added.  <a href="/webhooks?key=%s">Back to the webhooks for %s</a>.`, e.Key_str, template.HTMLEscapeString(e.Title))
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+  htmlWrapBegin(w)
+  defer htmlWrapEnd(w)
+  c, u, logged_in := promptLogin(w, r)
+  if !logged_in {
+    return
+  }
+  if !requirePost(w, r) {
+    return
+  }
+  key, err := datastore.DecodeKey(r.FormValue("key"))
+  if err != nil || key.Kind() != "Webhook" || key.Parent() == nil || key.Parent().Kind() != "Election" {
+    http.Error(w, fmt.Sprintf("Bad webhook key: '%s'", r.FormValue("key")), http.StatusInternalServerError)
+    return
+  }
+  var e Election
+  err = datastore.Get(c, key.Parent(), &e)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  _, ok := checkElectionAccess(w, c, key.Parent(), &e, u, permManage)
+  if !ok {
+    return
+  }
+  // The delivery log goes along with the webhook.
+  keys, err := datastore.NewQuery("WebhookDelivery").Ancestor(key).KeysOnly().GetAll(c, nil)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  err = datastore.DeleteMulti(c, append(keys, key))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  recordAudit(c, key.Parent(), u.Email, "Deleted a webhook")
+  fmt.Fprintf(w, `Deleted.  <a href="/webhooks?key=%s">Back to the webhooks for %s</a>.`, e.Key_str, template.HTMLEscapeString(e.Title))
+}
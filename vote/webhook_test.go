@@ -0,0 +1,56 @@
+package vote
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestParseWebhookURL(t *testing.T) {
+  tests := []struct {
+    url string
+    ok  bool
+  }{
+    {"https://example.com/hook", true},
+    {"http://example.com:8080/hook", true},
+    {"http://93.184.216.34/hook", true},
+    {"ftp://example.com/hook", false},
+    {"example.com/hook", false},
+    {"http://localhost/hook", false},
+    {"http://LOCALHOST./hook", false},
+    {"http://127.0.0.1:8080/hook", false},
+    {"http://10.1.2.3/hook", false},
+    {"http://172.16.0.1/hook", false},
+    {"http://192.168.1.1/hook", false},
+    {"http://169.254.169.254/computeMetadata/v1/", false},
+    {"http://metadata.google.internal/computeMetadata/v1/", false},
+    {"http://[::1]/hook", false},
+    {"http://[fd00::1]:80/hook", false},
+  }
+  for _, test := range tests {
+    _, err := parseWebhookURL(test.url)
+    if (err == nil) != test.ok {
+      t.Errorf("parseWebhookURL(%q) returned error %v, want ok = %v", test.url, err, test.ok)
+    }
+  }
+}
+
+func TestParseWebhookEvents(t *testing.T) {
+  tests := []struct {
+    events []string
+    ok     bool
+  }{
+    {[]string{eventOpened, eventClosed}, true},
+    {webhookEvents, true},
+    {nil, false},
+    {[]string{eventOpened, "deleted"}, false},
+  }
+  for _, test := range tests {
+    events, err := parseWebhookEvents(test.events)
+    if (err == nil) != test.ok {
+      t.Errorf("parseWebhookEvents(%q) returned error %v, want ok = %v", test.events, err, test.ok)
+    }
+    if err == nil && !reflect.DeepEqual(events, test.events) {
+      t.Errorf("parseWebhookEvents(%q) = %q", test.events, events)
+    }
+  }
+}